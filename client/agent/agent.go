@@ -0,0 +1,294 @@
+// Package agent keeps unlocked private keys in a long-running process, like
+// ssh-agent, and answers sign and decrypt requests over a Unix socket. The
+// keys never leave the agent: clients only get signatures and plaintext.
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"chat-client/utils"
+)
+
+// DefaultSocket is used when CHAT_AGENT_SOCK is unset
+const DefaultSocket = "keys/agent.sock"
+
+// pruneInterval is how often expired keys are dropped between requests
+const pruneInterval = 30 * time.Second
+
+var (
+	ErrLocked     = errors.New("agent is locked")
+	ErrUnknownKey = errors.New("agent does not hold that key")
+)
+
+// Key is an unlocked private key held by the agent
+type Key interface {
+	Type() string
+	PublicPEM() string
+	// Sign signs a SHA-256 digest
+	Sign(digest []byte) ([]byte, error)
+	// Decrypt opens a message envelope addressed to the key
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// ParseFunc turns a PEM private key into a Key
+type ParseFunc func(privPEM string) (Key, error)
+
+// KeyInfo describes a held key without revealing it
+type KeyInfo struct {
+	Username  string `json:"username"`
+	Digest    string `json:"digest"` // hex SHA-256 of the public key DER
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"`
+	Current   bool   `json:"current"` // false for keys retired by rotate-key
+	Expires   int64  `json:"expires"` // unix seconds, 0 if the key never expires
+}
+
+type entry struct {
+	info KeyInfo
+	key  Key
+}
+
+// Agent holds keys in memory. The zero value is not usable; see New.
+type Agent struct {
+	parse ParseFunc
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	keys []*entry
+	lock []byte // SHA-256 of the lock passphrase while locked
+}
+
+// New returns an agent that parses keys with parse and, unless a request
+// says otherwise, forgets them after ttl (0 keeps them until removed)
+func New(parse ParseFunc, ttl time.Duration) *Agent {
+	return &Agent{parse: parse, ttl: ttl}
+}
+
+// SocketPath returns CHAT_AGENT_SOCK, or DefaultSocket
+func SocketPath() string {
+	if p := os.Getenv("CHAT_AGENT_SOCK"); p != "" {
+		return p
+	}
+	return DefaultSocket
+}
+
+// Listen opens the agent socket at path, readable only by the current user.
+// A stale socket left by an agent that died is replaced.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already running on %s", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve answers requests on l until it is closed
+func (a *Agent) Serve(l net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.mu.Lock()
+				a.prune()
+				a.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+// handle answers one request per connection
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(response{Error: "malformed request"})
+		return
+	}
+	resp, err := a.do(req)
+	if err != nil {
+		resp = response{Error: err.Error()}
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (a *Agent) do(req request) (response, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune()
+
+	if req.Op == opUnlock {
+		if a.lock == nil {
+			return response{}, errors.New("agent is not locked")
+		}
+		sum := sha256.Sum256([]byte(req.Passphrase))
+		if subtle.ConstantTimeCompare(sum[:], a.lock) != 1 {
+			return response{}, errors.New("wrong passphrase")
+		}
+		a.lock = nil
+		return response{}, nil
+	}
+	if a.lock != nil {
+		return response{}, ErrLocked
+	}
+
+	switch req.Op {
+	case opAdd:
+		return response{}, a.add(req)
+	case opList:
+		infos := []KeyInfo{}
+		for _, e := range a.keys {
+			if req.Username == "" || e.info.Username == req.Username {
+				infos = append(infos, e.info)
+			}
+		}
+		return response{Keys: infos}, nil
+	case opRemove:
+		kept := a.keys[:0]
+		for _, e := range a.keys {
+			if req.Username != "" && e.info.Username != req.Username {
+				kept = append(kept, e)
+			}
+		}
+		a.keys = kept
+		return response{}, nil
+	case opLock:
+		if req.Passphrase == "" {
+			return response{}, errors.New("a passphrase is required")
+		}
+		sum := sha256.Sum256([]byte(req.Passphrase))
+		a.lock = sum[:]
+		return response{}, nil
+	case opSign, opDecrypt:
+		e := a.find(req.Key)
+		if e == nil {
+			return response{}, ErrUnknownKey
+		}
+		var data []byte
+		var err error
+		if req.Op == opSign {
+			data, err = e.key.Sign(req.Data)
+		} else {
+			data, err = e.key.Decrypt(req.Data)
+		}
+		if err != nil {
+			return response{}, err
+		}
+		return response{Data: data}, nil
+	default:
+		return response{}, fmt.Errorf("unknown operation %q", req.Op)
+	}
+}
+
+// add replaces the keys held for a user. The first key is the current one.
+func (a *Agent) add(req request) error {
+	if req.Username == "" || len(req.Keys) == 0 {
+		return errors.New("a username and at least one key are required")
+	}
+	ttl := a.ttl
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+
+	added := make([]*entry, 0, len(req.Keys))
+	for i, privPEM := range req.Keys {
+		key, err := a.parse(privPEM)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", i+1, err)
+		}
+		digest, err := utils.KeyDigest(key.PublicPEM())
+		if err != nil {
+			return fmt.Errorf("key %d: %w", i+1, err)
+		}
+		added = append(added, &entry{
+			info: KeyInfo{
+				Username:  req.Username,
+				Digest:    digest,
+				Type:      key.Type(),
+				PublicKey: key.PublicPEM(),
+				Current:   i == 0,
+				Expires:   expires,
+			},
+			key: key,
+		})
+	}
+
+	kept := a.keys[:0]
+	for _, e := range a.keys {
+		if e.info.Username != req.Username {
+			kept = append(kept, e)
+		}
+	}
+	a.keys = append(kept, added...)
+	sort.SliceStable(a.keys, func(i, j int) bool {
+		return a.keys[i].info.Username < a.keys[j].info.Username
+	})
+	return nil
+}
+
+func (a *Agent) find(digest string) *entry {
+	for _, e := range a.keys {
+		if e.info.Digest == digest {
+			return e
+		}
+	}
+	return nil
+}
+
+// prune drops expired keys. Callers hold mu.
+func (a *Agent) prune() {
+	now := time.Now().Unix()
+	kept := a.keys[:0]
+	for _, e := range a.keys {
+		if e.info.Expires == 0 || e.info.Expires > now {
+			kept = append(kept, e)
+		}
+	}
+	for i := len(kept); i < len(a.keys); i++ {
+		a.keys[i] = nil
+	}
+	a.keys = kept
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Operations, one per request
+const (
+	opAdd     = "add"
+	opList    = "list"
+	opRemove  = "remove"
+	opLock    = "lock"
+	opUnlock  = "unlock"
+	opSign    = "sign"
+	opDecrypt = "decrypt"
+)
+
+// dialTimeout bounds how long a client waits for the agent
+const dialTimeout = 2 * time.Second
+
+type request struct {
+	Op         string   `json:"op"`
+	Username   string   `json:"username,omitempty"`
+	Keys       []string `json:"keys,omitempty"` // add: PEM private keys, current key first
+	TTL        int64    `json:"ttl,omitempty"`  // add: seconds, 0 for the agent's default
+	Key        string   `json:"key,omitempty"`  // sign, decrypt: KeyInfo.Digest
+	Data       []byte   `json:"data,omitempty"` // sign: digest, decrypt: ciphertext
+	Passphrase string   `json:"passphrase,omitempty"`
+}
+
+type response struct {
+	Error string    `json:"error,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+	Keys  []KeyInfo `json:"keys,omitempty"`
+}
+
+// Client talks to an agent over its socket
+type Client struct {
+	path string
+}
+
+// NewClient returns a client for the agent at path. No connection is made
+// until the first request.
+func NewClient(path string) *Client {
+	return &Client{path: path}
+}
+
+func (c *Client) call(req request) (*response, error) {
+	conn, err := net.DialTimeout("unix", c.path, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("no agent running on %s", c.path)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("bad response from agent: %w", err)
+	}
+	if resp.Error != "" {
+		switch resp.Error {
+		case ErrLocked.Error():
+			return nil, ErrLocked
+		case ErrUnknownKey.Error():
+			return nil, ErrUnknownKey
+		}
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Add hands the agent a user's keys, current key first, replacing any it
+// held for them. A zero ttl uses the agent's default.
+func (c *Client) Add(username string, keys []string, ttl time.Duration) error {
+	_, err := c.call(request{Op: opAdd, Username: username, Keys: keys, TTL: int64(ttl / time.Second)})
+	return err
+}
+
+// List returns the keys held for username, or for everyone if it is empty
+func (c *Client) List(username string) ([]KeyInfo, error) {
+	resp, err := c.call(request{Op: opList, Username: username})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// Remove forgets the keys of username, or every key if it is empty
+func (c *Client) Remove(username string) error {
+	_, err := c.call(request{Op: opRemove, Username: username})
+	return err
+}
+
+// Lock refuses every request until Unlock is called with the same passphrase
+func (c *Client) Lock(passphrase string) error {
+	_, err := c.call(request{Op: opLock, Passphrase: passphrase})
+	return err
+}
+
+// Unlock reverses Lock
+func (c *Client) Unlock(passphrase string) error {
+	_, err := c.call(request{Op: opUnlock, Passphrase: passphrase})
+	return err
+}
+
+// Sign signs a SHA-256 digest with the key whose public key digest is key
+func (c *Client) Sign(key string, digest []byte) ([]byte, error) {
+	resp, err := c.call(request{Op: opSign, Key: key, Data: digest})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Decrypt opens a message envelope with the key whose public key digest is key
+func (c *Client) Decrypt(key string, ciphertext []byte) ([]byte, error) {
+	resp, err := c.call(request{Op: opDecrypt, Key: key, Data: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
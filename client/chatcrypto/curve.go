@@ -0,0 +1,248 @@
+package chatcrypto
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Curve25519v1 is the curve provider: an Ed25519 signing key plus an X25519
+// encryption key, and the X25519 envelope
+type Curve25519v1 struct{}
+
+// x25519EnvelopeInfo is the HKDF info string for VersionX25519 keys
+const x25519EnvelopeInfo = "cli-chat/x25519-envelope/v1"
+
+// curvePrivateKey keeps signing and encryption keys separate, since Ed25519
+// and X25519 keys shouldn't be converted into each other
+type curvePrivateKey struct {
+	sign ed25519.PrivateKey
+	dh   *ecdh.PrivateKey
+}
+
+type curvePublicKey struct {
+	sign ed25519.PublicKey
+	dh   *ecdh.PublicKey
+}
+
+func (k curvePrivateKey) Type() string { return KeyTypeCurve }
+
+func (k curvePrivateKey) Public() PublicKey {
+	return curvePublicKey{sign: k.sign.Public().(ed25519.PublicKey), dh: k.dh.PublicKey()}
+}
+
+// PEM writes the Ed25519 key, then the X25519 key, as PKCS#8 blocks
+func (k curvePrivateKey) PEM() string {
+	var b strings.Builder
+	for _, key := range []interface{}{k.sign, k.dh} {
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		b.Write(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	return b.String()
+}
+
+func (k curvePublicKey) Type() string { return KeyTypeCurve }
+
+// PEM writes the Ed25519 key, then the X25519 key, as PKIX blocks
+func (k curvePublicKey) PEM() string {
+	var b strings.Builder
+	for _, key := range []interface{}{k.sign, k.dh} {
+		der, _ := x509.MarshalPKIXPublicKey(key)
+		b.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	return b.String()
+}
+
+func (Curve25519v1) Name() string     { return "curve25519-v1" }
+func (Curve25519v1) KeyType() string  { return KeyTypeCurve }
+func (Curve25519v1) Versions() []byte { return []byte{VersionX25519} }
+
+func (Curve25519v1) GenerateKey() (PrivateKey, error) {
+	_, sign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return curvePrivateKey{sign: sign, dh: dh}, nil
+}
+
+func (Curve25519v1) ParsePrivateKey(blocks []*pem.Block) (PrivateKey, error) {
+	if len(blocks) == 0 || blocks[0].Type != "PRIVATE KEY" {
+		return nil, ErrOtherKeyType
+	}
+	if len(blocks) != 2 || blocks[1].Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("invalid private key PEM")
+	}
+
+	sign, err := x509.ParsePKCS8PrivateKey(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	dh, err := x509.ParsePKCS8PrivateKey(blocks[1].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+	}
+	signKey, ok := sign.(ed25519.PrivateKey)
+	dhKey, ok2 := dh.(*ecdh.PrivateKey)
+	if !ok || !ok2 || dhKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("expected an Ed25519 and an X25519 private key")
+	}
+	return curvePrivateKey{sign: signKey, dh: dhKey}, nil
+}
+
+func (Curve25519v1) ParsePublicKey(blocks []*pem.Block) (PublicKey, error) {
+	if len(blocks) == 0 || blocks[0].Type != "PUBLIC KEY" {
+		return nil, ErrOtherKeyType
+	}
+	first, err := x509.ParsePKIXPublicKey(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	sign, ok := first.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrOtherKeyType
+	}
+	if len(blocks) != 2 || blocks[1].Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("Ed25519 key without an X25519 encryption key")
+	}
+	second, err := x509.ParsePKIXPublicKey(blocks[1].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+	}
+	dh, ok := second.(*ecdh.PublicKey)
+	if !ok || dh.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("expected an X25519 encryption key")
+	}
+	return curvePublicKey{sign: sign, dh: dh}, nil
+}
+
+// Sign uses Ed25519 over the digest
+func (Curve25519v1) Sign(priv PrivateKey, digest []byte) ([]byte, error) {
+	k, ok := priv.(curvePrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("curve25519-v1 can't sign with a %s key", priv.Type())
+	}
+	return ed25519.Sign(k.sign, digest), nil
+}
+
+func (Curve25519v1) Verify(pub PublicKey, digest, sig []byte) error {
+	k, ok := pub.(curvePublicKey)
+	if !ok {
+		return fmt.Errorf("curve25519-v1 can't verify with a %s key", pub.Type())
+	}
+	if !ed25519.Verify(k.sign, digest, sig) {
+		return fmt.Errorf("ed25519: invalid signature")
+	}
+	return nil
+}
+
+// Encrypt seals msg in the X25519 envelope:
+//
+//	version(1) | ephemeral public key(32) | nonce(12) | AES-GCM ciphertext
+//
+// The AES key is HKDF-SHA256 over the shared secret, salted with both public
+// keys. The version byte and ephemeral key are authenticated as additional data.
+func (Curve25519v1) Encrypt(pub PublicKey, msg []byte) ([]byte, error) {
+	k, ok := pub.(curvePublicKey)
+	if !ok {
+		return nil, fmt.Errorf("curve25519-v1 can't encrypt to a %s key", pub.Type())
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return sealX25519(k.dh, eph, nonce, msg)
+}
+
+// sealX25519 builds an X25519 envelope from a given ephemeral key and nonce
+func sealX25519(pub *ecdh.PublicKey, eph *ecdh.PrivateKey, nonce, msg []byte) ([]byte, error) {
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := x25519EnvelopeAEAD(shared, eph.PublicKey(), pub)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{VersionX25519}, eph.PublicKey().Bytes()...)
+	out := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(out, nonce, msg, header), nil
+}
+
+// x25519EnvelopeAEAD derives the envelope cipher from the shared secret
+// between the ephemeral and recipient keys
+func x25519EnvelopeAEAD(shared []byte, eph, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(eph.Bytes(), recipient.Bytes()...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519EnvelopeInfo)), key); err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+func (Curve25519v1) Decrypt(priv PrivateKey, ciphertext []byte) ([]byte, error) {
+	k, ok := priv.(curvePrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("message version %d can't be opened with a %s key", ciphertext[0], priv.Type())
+	}
+	const headerLen = 1 + 32
+	if len(ciphertext) < headerLen {
+		return nil, fmt.Errorf("invalid ciphertext: truncated header")
+	}
+	header := ciphertext[:headerLen]
+	eph, err := ecdh.X25519().NewPublicKey(header[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: bad ephemeral key")
+	}
+
+	shared, err := k.dh.ECDH(eph)
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
+	}
+	gcm, err := x25519EnvelopeAEAD(shared, eph, k.dh.PublicKey())
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
+	}
+	rest := ciphertext[headerLen:]
+	if len(rest) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("invalid ciphertext: truncated body")
+	}
+	nonce, body := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, body, header)
+	if err != nil {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return plain, nil
+}
+
+// keyAgreement returns the X25519 shared secret between priv and a raw
+// peer key. Only curve keys can do this.
+func keyAgreement(priv PrivateKey, peer []byte) ([]byte, error) {
+	k, ok := priv.(curvePrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s keys have no key agreement", priv.Type())
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("malformed X25519 key")
+	}
+	return k.dh.ECDH(pub)
+}
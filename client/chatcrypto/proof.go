@@ -0,0 +1,34 @@
+package chatcrypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// ProveKey answers a server challenge: a signature over the SHA-256 of
+// statement and, for curve keys, the HMAC-SHA256 of that digest keyed with
+// the X25519 shared secret with serverKey, proving the encryption key too.
+// Both are base64; the proof is empty for RSA keys.
+func ProveKey(key PrivateKey, statement, serverKey string) (sig, proof string, err error) {
+	digest := sha256.Sum256([]byte(statement))
+	raw, err := Sign(key, digest[:])
+	if err != nil {
+		return "", "", err
+	}
+	if key.Type() != KeyTypeCurve {
+		return base64.StdEncoding.EncodeToString(raw), "", nil
+	}
+	serverRaw, err := base64.StdEncoding.DecodeString(serverKey)
+	if err != nil {
+		return "", "", fmt.Errorf("malformed server key")
+	}
+	shared, err := keyAgreement(key, serverRaw)
+	if err != nil {
+		return "", "", err
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(digest[:])
+	return base64.StdEncoding.EncodeToString(raw), base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
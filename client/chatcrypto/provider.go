@@ -0,0 +1,238 @@
+// Package chatcrypto holds the long-term key algorithms of the client behind
+// a Provider interface. Each provider owns one key type and the message
+// envelope versions written for it; the first byte of every ciphertext
+// selects the provider that opens it.
+package chatcrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Key types, as tagged on users and devices by the server
+const (
+	KeyTypeRSA   = "rsa"        // one RSA key for both encryption and signatures
+	KeyTypeCurve = "curve25519" // Ed25519 signing key plus X25519 encryption key
+)
+
+// Envelope versions. Version 3 is a double ratchet message and belongs to
+// package session, not to a provider.
+const (
+	VersionLegacy = 0x01 // chunked RSA PKCS#1 v1.5, read only
+	VersionHybrid = 0x02 // AES-256-GCM body, key wrapped with RSA-OAEP (SHA-256)
+	VersionX25519 = 0x04 // AES-256-GCM body, key agreed with ephemeral X25519
+)
+
+// PrivateKey is the long-term key pair of an account or device
+type PrivateKey interface {
+	Type() string
+	Public() PublicKey
+	// PEM returns the unencrypted key in PEM form
+	PEM() string
+}
+
+// PublicKey is the public half of a PrivateKey
+type PublicKey interface {
+	Type() string
+	// PEM returns the PKIX PEM form uploaded to the server
+	PEM() string
+}
+
+// Provider implements one key type
+type Provider interface {
+	// Name identifies the provider and its envelope format, e.g. "rsa-v1"
+	Name() string
+	// KeyType is the tag the server stores for the provider's keys
+	KeyType() string
+	// Versions lists the envelope versions Decrypt opens. Encrypt writes the first.
+	Versions() []byte
+
+	GenerateKey() (PrivateKey, error)
+	// ParsePrivateKey and ParsePublicKey return ErrOtherKeyType for PEM
+	// blocks that hold another provider's keys
+	ParsePrivateKey(blocks []*pem.Block) (PrivateKey, error)
+	ParsePublicKey(blocks []*pem.Block) (PublicKey, error)
+
+	Encrypt(pub PublicKey, msg []byte) ([]byte, error)
+	Decrypt(priv PrivateKey, ciphertext []byte) ([]byte, error)
+	// Sign signs a SHA-256 digest
+	Sign(priv PrivateKey, digest []byte) ([]byte, error)
+	// Verify checks a signature made by Sign over digest
+	Verify(pub PublicKey, digest, sig []byte) error
+}
+
+// ErrOtherKeyType is returned by a provider's parsers for keys it doesn't own
+var ErrOtherKeyType = errors.New("not a key of this type")
+
+var (
+	providersMu sync.RWMutex
+	providers   = []Provider{RSAv1{}, Curve25519v1{}}
+)
+
+// Register adds a provider. Its key type and envelope versions must not be
+// taken by another provider.
+func Register(p Provider) error {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	for _, other := range providers {
+		if other.KeyType() == p.KeyType() {
+			return fmt.Errorf("key type %s is already provided by %s", p.KeyType(), other.Name())
+		}
+		for _, v := range p.Versions() {
+			for _, w := range other.Versions() {
+				if v == w {
+					return fmt.Errorf("envelope version %d is already provided by %s", v, other.Name())
+				}
+			}
+		}
+	}
+	providers = append(providers, p)
+	return nil
+}
+
+// Providers returns every registered provider
+func Providers() []Provider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return append([]Provider{}, providers...)
+}
+
+// ForKeyType returns the provider of keys tagged keyType
+func ForKeyType(keyType string) (Provider, error) {
+	for _, p := range Providers() {
+		if p.KeyType() == keyType {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
+// ForVersion returns the provider that opens envelopes of the given version
+func ForVersion(version byte) (Provider, error) {
+	for _, p := range Providers() {
+		for _, v := range p.Versions() {
+			if v == version {
+				return p, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported message version: %d", version)
+}
+
+// GenerateKey creates a new key pair of the given type
+func GenerateKey(keyType string) (PrivateKey, error) {
+	p, err := ForKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return p.GenerateKey()
+}
+
+// Encrypt seals msg for pub in its provider's current envelope
+func Encrypt(pub PublicKey, msg []byte) ([]byte, error) {
+	p, err := ForKeyType(pub.Type())
+	if err != nil {
+		return nil, err
+	}
+	return p.Encrypt(pub, msg)
+}
+
+// Decrypt opens a ciphertext with the provider its version byte names. Each
+// key type only opens its own envelopes.
+func Decrypt(priv PrivateKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 2 {
+		return nil, fmt.Errorf("invalid ciphertext: too short")
+	}
+	p, err := ForVersion(ciphertext[0])
+	if err != nil {
+		return nil, err
+	}
+	if p.KeyType() != priv.Type() {
+		return nil, fmt.Errorf("message version %d can't be opened with a %s key", ciphertext[0], priv.Type())
+	}
+	return p.Decrypt(priv, ciphertext)
+}
+
+// Sign signs a SHA-256 digest with priv
+func Sign(priv PrivateKey, digest []byte) ([]byte, error) {
+	p, err := ForKeyType(priv.Type())
+	if err != nil {
+		return nil, err
+	}
+	return p.Sign(priv, digest)
+}
+
+// Verify checks a signature made by Sign
+func Verify(pub PublicKey, digest, sig []byte) error {
+	p, err := ForKeyType(pub.Type())
+	if err != nil {
+		return err
+	}
+	return p.Verify(pub, digest, sig)
+}
+
+// ParsePrivateKey parses a PEM private key of any registered type
+func ParsePrivateKey(privPEM string) (PrivateKey, error) {
+	blocks := PEMBlocks(privPEM)
+	for _, p := range Providers() {
+		key, err := p.ParsePrivateKey(blocks)
+		if errors.Is(err, ErrOtherKeyType) {
+			continue
+		}
+		return key, err
+	}
+	return nil, fmt.Errorf("invalid private key PEM")
+}
+
+// ParsePublicKey parses a PEM public key of any registered type
+func ParsePublicKey(pubPEM string) (PublicKey, error) {
+	blocks := PEMBlocks(pubPEM)
+	for _, p := range Providers() {
+		key, err := p.ParsePublicKey(blocks)
+		if errors.Is(err, ErrOtherKeyType) {
+			continue
+		}
+		return key, err
+	}
+	return nil, fmt.Errorf("invalid public key PEM")
+}
+
+// ParseTaggedPublicKey parses a key the server returned along with its type
+// tag, refusing keys whose contents don't match the tag. Servers that predate
+// the tag send none.
+func ParseTaggedPublicKey(pubPEM, keyType string) (PublicKey, error) {
+	key, err := ParsePublicKey(pubPEM)
+	if err != nil {
+		return nil, err
+	}
+	if keyType != "" && keyType != key.Type() {
+		return nil, fmt.Errorf("key is tagged %s but is a %s key", keyType, key.Type())
+	}
+	return key, nil
+}
+
+// PEMBlocks decodes every PEM block in data
+func PEMBlocks(data string) []*pem.Block {
+	var blocks []*pem.Block
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,208 @@
+package chatcrypto
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+)
+
+// RSAv1 is the RSA provider: 2048-bit keys, RSA-PSS signatures and the
+// hybrid envelope. It still opens the legacy chunked envelope.
+type RSAv1 struct{}
+
+type rsaPrivateKey struct{ key *rsa.PrivateKey }
+
+type rsaPublicKey struct{ key *rsa.PublicKey }
+
+func (k rsaPrivateKey) Type() string      { return KeyTypeRSA }
+func (k rsaPrivateKey) Public() PublicKey { return rsaPublicKey{&k.key.PublicKey} }
+
+func (k rsaPrivateKey) PEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k.key)}))
+}
+
+func (k rsaPublicKey) Type() string { return KeyTypeRSA }
+
+func (k rsaPublicKey) PEM() string {
+	der, _ := x509.MarshalPKIXPublicKey(k.key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (RSAv1) Name() string     { return "rsa-v1" }
+func (RSAv1) KeyType() string  { return KeyTypeRSA }
+func (RSAv1) Versions() []byte { return []byte{VersionHybrid, VersionLegacy} }
+
+func (RSAv1) GenerateKey() (PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return rsaPrivateKey{key}, nil
+}
+
+func (RSAv1) ParsePrivateKey(blocks []*pem.Block) (PrivateKey, error) {
+	if len(blocks) != 1 || blocks[0].Type != "RSA PRIVATE KEY" {
+		return nil, ErrOtherKeyType
+	}
+	key, err := x509.ParsePKCS1PrivateKey(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return rsaPrivateKey{key}, nil
+}
+
+func (RSAv1) ParsePublicKey(blocks []*pem.Block) (PublicKey, error) {
+	if len(blocks) == 0 || blocks[0].Type != "PUBLIC KEY" {
+		return nil, ErrOtherKeyType
+	}
+	parsed, err := x509.ParsePKIXPublicKey(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrOtherKeyType
+	}
+	if len(blocks) != 1 {
+		return nil, fmt.Errorf("unexpected data after RSA public key")
+	}
+	return rsaPublicKey{key}, nil
+}
+
+// Sign uses RSA-PSS
+func (RSAv1) Sign(priv PrivateKey, digest []byte) ([]byte, error) {
+	k, ok := priv.(rsaPrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("rsa-v1 can't sign with a %s key", priv.Type())
+	}
+	return rsa.SignPSS(rand.Reader, k.key, crypto.SHA256, digest, nil)
+}
+
+func (RSAv1) Verify(pub PublicKey, digest, sig []byte) error {
+	k, ok := pub.(rsaPublicKey)
+	if !ok {
+		return fmt.Errorf("rsa-v1 can't verify with a %s key", pub.Type())
+	}
+	return rsa.VerifyPSS(k.key, crypto.SHA256, digest, sig, nil)
+}
+
+// Encrypt seals msg in the hybrid envelope:
+//
+//	version(1) | wrapped key length(2) | RSA-OAEP(aes key) | nonce(12) | AES-GCM ciphertext
+//
+// Everything before the nonce is authenticated as additional data, so the
+// version byte and wrapped key cannot be swapped without failing decryption.
+func (RSAv1) Encrypt(pub PublicKey, msg []byte) ([]byte, error) {
+	k, ok := pub.(rsaPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("rsa-v1 can't encrypt to a %s key", pub.Type())
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return sealHybrid(k.key, key, nonce, msg)
+}
+
+// sealHybrid builds a hybrid envelope from a given AES key and nonce
+func sealHybrid(pub *rsa.PublicKey, key, nonce, msg []byte) ([]byte, error) {
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("key wrap error: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3, 3+len(wrappedKey)+len(nonce)+len(msg)+gcm.Overhead())
+	header[0] = VersionHybrid
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, msg, header), nil
+}
+
+func (RSAv1) Decrypt(priv PrivateKey, ciphertext []byte) ([]byte, error) {
+	k, ok := priv.(rsaPrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("message version %d can't be opened with a %s key", ciphertext[0], priv.Type())
+	}
+	switch ciphertext[0] {
+	case VersionHybrid:
+		return decryptHybrid(k.key, ciphertext)
+	case VersionLegacy:
+		return decryptLegacy(k.key, ciphertext)
+	}
+	return nil, fmt.Errorf("unsupported message version: %d", ciphertext[0])
+}
+
+func decryptHybrid(privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 3 {
+		return nil, fmt.Errorf("invalid ciphertext: truncated header")
+	}
+	keyLen := int(binary.BigEndian.Uint16(ciphertext[1:3]))
+	if keyLen == 0 || 3+keyLen > len(ciphertext) {
+		return nil, fmt.Errorf("invalid ciphertext: bad wrapped key length")
+	}
+	header := ciphertext[:3+keyLen]
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privKey, header[3:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("key unwrap error: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
+	}
+	rest := ciphertext[len(header):]
+	if len(rest) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("invalid ciphertext: truncated body")
+	}
+	nonce, body := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, body, header)
+	if err != nil {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return plain, nil
+}
+
+// decryptLegacy opens messages sent before the hybrid envelope existed: a
+// sequence of RSA chunks, each prefixed with a 2-byte big-endian length.
+// With 2048-bit keys every chunk is 256 bytes long, so those messages always
+// start with 0x01 and read as envelope version 1.
+func decryptLegacy(privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	var decrypted []byte
+	i := 0
+	for i < len(ciphertext) {
+		if i+2 > len(ciphertext) {
+			return nil, fmt.Errorf("invalid ciphertext: truncated chunk header")
+		}
+		size := int(ciphertext[i])<<8 | int(ciphertext[i+1])
+		i += 2
+		if size <= 0 || size > 256 || i+size > len(ciphertext) {
+			return nil, fmt.Errorf("invalid chunk size in ciphertext")
+		}
+		chunk := ciphertext[i : i+size]
+		plain, err := rsa.DecryptPKCS1v15(rand.Reader, privKey, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("chunk decryption error: %w", err)
+		}
+		decrypted = append(decrypted, plain...)
+		i += size
+	}
+	return decrypted, nil
+}
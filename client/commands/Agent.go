@@ -0,0 +1,255 @@
+package commands
+
+import (
+	"chat-client/agent"
+	"chat-client/chatcrypto"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// heldKey is a private key as the agent holds it
+type heldKey struct{ chatcrypto.PrivateKey }
+
+func (k heldKey) PublicPEM() string { return k.Public().PEM() }
+
+func (k heldKey) Sign(digest []byte) ([]byte, error) {
+	return chatcrypto.Sign(k.PrivateKey, digest)
+}
+
+func (k heldKey) Decrypt(ciphertext []byte) ([]byte, error) {
+	return chatcrypto.Decrypt(k.PrivateKey, ciphertext)
+}
+
+func parseHeldKey(privPEM string) (agent.Key, error) {
+	key, err := chatcrypto.ParsePrivateKey(privPEM)
+	if err != nil {
+		return nil, err
+	}
+	return heldKey{key}, nil
+}
+
+// agentKey is a private key that lives in the agent: signing and decryption
+// are requests over its socket, and the key itself can't be exported
+type agentKey struct {
+	client *agent.Client
+	digest string
+	pub    chatcrypto.PublicKey
+}
+
+func (k agentKey) Type() string                 { return k.pub.Type() }
+func (k agentKey) Public() chatcrypto.PublicKey { return k.pub }
+
+// PEM is empty: commands that export the key (export-key, escrow) read the
+// key file instead
+func (k agentKey) PEM() string { return "" }
+
+func (k agentKey) decrypt(ciphertext []byte) ([]byte, error) {
+	return k.client.Decrypt(k.digest, ciphertext)
+}
+
+// signDigest signs a SHA-256 digest with key, through the agent if it holds it
+func signDigest(key chatcrypto.PrivateKey, digest []byte) ([]byte, error) {
+	if k, ok := key.(agentKey); ok {
+		return k.client.Sign(k.digest, digest)
+	}
+	return chatcrypto.Sign(key, digest)
+}
+
+// agentKeys returns the keys the agent holds for username, current key
+// first, or nil if no agent is running, it is locked or it has none
+func agentKeys(username string) []chatcrypto.PrivateKey {
+	client := agent.NewClient(agent.SocketPath())
+	infos, err := client.List(username)
+	if err != nil {
+		return nil
+	}
+	var current, retired []chatcrypto.PrivateKey
+	for _, info := range infos {
+		pub, err := chatcrypto.ParseTaggedPublicKey(info.PublicKey, info.Type)
+		if err != nil {
+			continue
+		}
+		k := agentKey{client: client, digest: info.Digest, pub: pub}
+		if info.Current {
+			current = append(current, k)
+		} else {
+			retired = append(retired, k)
+		}
+	}
+	if len(current) == 0 {
+		return nil
+	}
+	return append(current, retired...)
+}
+
+// useKey returns username's current private key from the agent if it holds
+// it, else from the key file
+func useKey(username string) (chatcrypto.PrivateKey, error) {
+	if keys := agentKeys(username); keys != nil {
+		return keys[0], nil
+	}
+	return loadPrivateKey(username)
+}
+
+// useRetiredKeys is loadRetiredKeys, served by the agent when it holds the
+// user's keys. Call it after useKey.
+func useRetiredKeys(username string) []chatcrypto.PrivateKey {
+	if keys := agentKeys(username); keys != nil {
+		return keys[1:]
+	}
+	return loadRetiredKeys(username)
+}
+
+// RunAgent runs the key agent in the foreground (`chat-client agent`)
+func RunAgent(args []string) {
+	socket := agent.SocketPath()
+	var ttl time.Duration
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: chat-client agent [--socket:<path>] [--ttl:<duration>]")
+			fmt.Println("Holds unlocked private keys in memory and signs and decrypts for other chat-client processes.")
+			fmt.Println("Load keys with the `agent --add` command. --ttl sets how long added keys are kept, e.g. 1h (default: until removed).")
+			return
+		}
+		if strings.HasPrefix(arg, "--socket:") {
+			socket = strings.TrimPrefix(arg, "--socket:")
+		}
+		if strings.HasPrefix(arg, "--ttl:") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--ttl:"))
+			if err != nil || d < 0 {
+				fmt.Println("Invalid ttl:", strings.TrimPrefix(arg, "--ttl:"))
+				os.Exit(1)
+			}
+			ttl = d
+		}
+	}
+
+	l, err := agent.Listen(socket)
+	if err != nil {
+		fmt.Println("❌ Failed to start agent:", err)
+		os.Exit(1)
+	}
+	// Remove the socket on the way out so clients don't dial a dead agent
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	abs, _ := filepath.Abs(socket)
+	fmt.Printf("Agent listening on %s\n", abs)
+	fmt.Printf("export CHAT_AGENT_SOCK=%s\n", abs)
+	if err := agent.New(parseHeldKey, ttl).Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("Agent stopped:", err)
+	}
+	os.Remove(socket)
+}
+
+// Agent loads keys into a running agent and manages it
+func Agent(args []string) {
+	username := os.Getenv("CURRENT_USER")
+	var op string
+	var ttl time.Duration
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: agent [--add [--ttl:<duration>]] [--remove] [--lock] [--unlock] [--username:<name>]")
+			fmt.Println("Start the agent in another terminal with `chat-client agent`.")
+			fmt.Println("Without flags, lists the keys the agent holds.")
+			fmt.Println("--add unlocks your key file and retired keys and hands them to the agent; chat, prekeys, verify and")
+			fmt.Println("login --key then use the agent instead of the key file. --ttl overrides the agent's default lifetime.")
+			fmt.Println("--remove makes the agent forget your keys. --lock refuses every request until --unlock with the same passphrase.")
+			return
+		}
+		switch {
+		case arg == "--add", arg == "--remove", arg == "--lock", arg == "--unlock":
+			op = arg
+		case strings.HasPrefix(arg, "--ttl:"):
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--ttl:"))
+			if err != nil || d <= 0 {
+				fmt.Println("Invalid ttl:", strings.TrimPrefix(arg, "--ttl:"))
+				return
+			}
+			ttl = d
+		case strings.HasPrefix(arg, "--username:"):
+			username = strings.TrimPrefix(arg, "--username:")
+		}
+	}
+
+	client := agent.NewClient(agent.SocketPath())
+	switch op {
+	case "--add":
+		if username == "" {
+			fmt.Println("Please login first, or name the key with --username:<name>.")
+			return
+		}
+		privKey, err := loadPrivateKey(username)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		keys := []string{privKey.PEM()}
+		for _, k := range loadRetiredKeys(username) {
+			keys = append(keys, k.PEM())
+		}
+		if err := client.Add(username, keys, ttl); err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("✅ Added %d key(s) for %s to the agent.\n", len(keys), username)
+	case "--remove":
+		if err := client.Remove(username); err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Println("✅ Agent forgot the keys.")
+	case "--lock", "--unlock":
+		p, err := readPassphrase("Agent lock passphrase: ")
+		if err != nil {
+			fmt.Println("Failed to read passphrase:", err)
+			return
+		}
+		if op == "--lock" {
+			err = client.Lock(p)
+		} else {
+			err = client.Unlock(p)
+		}
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("✅ Agent %sed.\n", strings.TrimPrefix(op, "--"))
+	default:
+		infos, err := client.List("")
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		if len(infos) == 0 {
+			fmt.Println("The agent holds no keys.")
+			return
+		}
+		fmt.Printf("%-16s %-10s %-8s %-20s %s\n", "USER", "TYPE", "STATUS", "EXPIRES", "DIGEST")
+		for _, info := range infos {
+			status := "current"
+			if !info.Current {
+				status = "retired"
+			}
+			expires := "never"
+			if info.Expires != 0 {
+				expires = time.Unix(info.Expires, 0).Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-16s %-10s %-8s %-20s %s\n", info.Username, info.Type, status, expires, info.Digest[:16])
+		}
+	}
+}
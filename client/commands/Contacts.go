@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"chat-client/utils"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Contacts lists the user's accepted connections with whether they are
+// online and whether their key was verified
+func Contacts(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: contacts")
+			fmt.Println("Lists your accepted connections, who is online, and when the others were last seen.")
+			return
+		}
+	}
+
+	list, err := utils.GetPresence(jwtToken)
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("No contacts yet. Send a request with the add command.")
+		return
+	}
+	store, err := utils.LoadContacts(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load contacts:", err)
+		return
+	}
+
+	fmt.Printf("%-20s %-28s %s\n", "USERNAME", "STATUS", "VERIFIED")
+	for _, p := range list {
+		verified := "no"
+		if fp := store.PinnedFingerprint(p.Username); fp == "" {
+			verified = "-" // never chatted, no key pinned
+		} else if store.IsVerified(p.Username, fp) {
+			verified = "yes"
+		}
+		fmt.Printf("%-20s %-28s %s\n", p.Username, presenceStatus(p), verified)
+	}
+}
+
+// presenceStatus describes a contact's presence for the contacts listing
+func presenceStatus(p utils.Presence) string {
+	switch {
+	case p.Online:
+		return "online"
+	case p.LastSeenAt == nil:
+		return "never seen"
+	}
+	seen := p.LastSeenAt.Local()
+	ago := time.Since(seen)
+	switch {
+	case ago < time.Minute:
+		return "last seen just now"
+	case ago < time.Hour:
+		return fmt.Sprintf("last seen %d min ago", int(ago.Minutes()))
+	case ago < 24*time.Hour:
+		return "last seen " + seen.Format("15:04")
+	}
+	return "last seen " + seen.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,391 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Devices lists the current user's devices, registers this machine as a new
+// device, or removes one
+func Devices(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	var add, certify, remove string
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: devices [--add:<name>] [--certify:<request>] [--remove:<id>]")
+			fmt.Println("Without flags, lists your devices.")
+			fmt.Println("--add registers this machine as a new device with its own key pair.")
+			fmt.Println("  It prints a request to certify on your primary device.")
+			fmt.Println("--certify signs a new device's request with your primary key (primary device only).")
+			fmt.Println("--remove deletes another of your devices; the primary device can't be removed.")
+			return
+		}
+		if strings.HasPrefix(arg, "--add:") {
+			add = strings.TrimPrefix(arg, "--add:")
+		}
+		if strings.HasPrefix(arg, "--certify:") {
+			certify = strings.TrimPrefix(arg, "--certify:")
+		}
+		if strings.HasPrefix(arg, "--remove:") {
+			remove = strings.TrimPrefix(arg, "--remove:")
+		}
+	}
+
+	switch {
+	case add != "":
+		addDevice(currentUser, add, jwtToken)
+	case certify != "":
+		certifyDevice(currentUser, certify)
+	case remove != "":
+		id, err := strconv.ParseUint(remove, 10, 64)
+		if err != nil {
+			fmt.Println("Invalid device id:", remove)
+			return
+		}
+		if uint(id) == utils.CurrentDevice() {
+			fmt.Println("You can't remove the device you are using. Remove it from another device.")
+			return
+		}
+		if err := utils.RemoveDevice(uint(id), jwtToken); err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("✅ Device %d removed.\n", id)
+	default:
+		devices, err := utils.GetDevices(currentUser, jwtToken)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("%-4s %-20s %-11s %s\n", "ID", "NAME", "TYPE", "FINGERPRINT")
+		for _, d := range devices {
+			fp, _ := utils.Fingerprint(d.PublicKey)
+			name := d.Name
+			if d.ID == utils.CurrentDevice() {
+				name += " (this device)"
+			}
+			fmt.Printf("%-4d %-20s %-11s %s\n", d.ID, name, d.KeyType, fp)
+		}
+	}
+}
+
+// addDevice generates a key pair for this machine and registers it as a new
+// device of username. New devices always get curve keys, whatever the
+// account's primary key is.
+func addDevice(username, name, jwtToken string) {
+	keyFileName := fmt.Sprintf("keys/%s_private.pem", username)
+	if _, err := os.Stat(keyFileName); err == nil {
+		fmt.Printf("This machine already has a key for %s in %s.\n", username, keyFileName)
+		return
+	}
+
+	if strings.ContainsAny(name, "\r\n") || len(name) > 64 {
+		fmt.Println("Device names must be 1-64 characters on one line.")
+		return
+	}
+
+	privPEM, pubPEM, err := GenerateKeys(chatcrypto.KeyTypeCurve)
+	if err != nil {
+		fmt.Println("Key generation failed:", err)
+		return
+	}
+	privKey, err := chatcrypto.ParsePrivateKey(privPEM)
+	if err != nil {
+		fmt.Println("Key generation failed:", err)
+		return
+	}
+	passphrase, err := newPassphrase(keyFilePrompt)
+	if err != nil {
+		fmt.Println("Failed to read passphrase:", err)
+		return
+	}
+	if err := os.MkdirAll("keys", 0700); err != nil {
+		fmt.Println("Failed to create keys directory:", err)
+		return
+	}
+	// Save the key first: a registered device whose key was lost would
+	// receive messages nobody can read
+	if err := writeKeyFile(keyFileName, privPEM, passphrase); err != nil {
+		fmt.Println("Failed to save private key:", err)
+		return
+	}
+
+	device, err := registerDevice(username, name, privKey, pubPEM, jwtToken)
+	if err != nil {
+		os.Remove(keyFileName)
+		fmt.Println("❌", err)
+		return
+	}
+	if err := utils.SaveLocalDevice(username, *device); err != nil {
+		fmt.Println("Failed to save device record:", err)
+		return
+	}
+	os.Setenv("DEVICE_ID", strconv.FormatUint(uint64(device.ID), 10))
+	passphrases[username] = passphrase
+	fmt.Printf("✅ Registered this machine as device %d (%s).\n", device.ID, device.Name)
+
+	sessions, err := openSessions(username)
+	if err != nil {
+		fmt.Println("Warning: failed to load sessions:", err)
+		return
+	}
+	if _, err := publishPrekeys(sessions, username, privKey, jwtToken, false); err != nil {
+		fmt.Println("Warning: could not publish prekeys, run `prekeys`:", err)
+	}
+}
+
+// deviceRequest is what a new device asks the primary device to certify.
+// It is passed between the two machines by hand, base64 encoded.
+type deviceRequest struct {
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+// registerDevice gets the new key certified by the primary device, then
+// registers it, answering a device challenge to prove we hold it
+func registerDevice(username, name string, privKey chatcrypto.PrivateKey, pubPEM, jwtToken string) (*utils.Device, error) {
+	raw, err := json.Marshal(deviceRequest{Username: username, Name: name, PublicKey: pubPEM})
+	if err != nil {
+		return nil, err
+	}
+	fp, _ := utils.Fingerprint(pubPEM)
+	fmt.Println("Your primary device has to certify this one. On it, run:")
+	fmt.Printf("\n  devices --certify:%s\n\n", base64.StdEncoding.EncodeToString(raw))
+	fmt.Printf("and check it shows this fingerprint:\n  %s\n", fp)
+	fmt.Print("Paste the certificate it prints: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	certificate := strings.TrimSpace(answer)
+	if certificate == "" {
+		return nil, fmt.Errorf("no certificate given")
+	}
+
+	challenge, err := utils.GetDeviceChallenge(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := deviceChallengeStatement(username, pubPEM, challenge.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	signature, keyProof, err := chatcrypto.ProveKey(privKey, statement, challenge.ServerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to answer device challenge: %w", err)
+	}
+	return utils.RegisterDevice(utils.DeviceRegistration{
+		Name:        name,
+		PublicKey:   pubPEM,
+		Certificate: certificate,
+		Challenge:   challenge.Challenge,
+		Signature:   signature,
+		KeyProof:    keyProof,
+	}, jwtToken)
+}
+
+// certifyDevice signs a new device's request with the primary key, after
+// the user confirms the fingerprint matches the one the device shows
+func certifyDevice(username, request string) {
+	if utils.CurrentDevice() != utils.PrimaryDevice {
+		fmt.Println("Only the primary device can certify new devices.")
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(request)
+	var req deviceRequest
+	if err == nil {
+		err = json.Unmarshal(raw, &req)
+	}
+	if err != nil {
+		fmt.Println("Malformed device request:", err)
+		return
+	}
+	if req.Username != username {
+		fmt.Printf("This request is for %s, not %s.\n", req.Username, username)
+		return
+	}
+	fp, err := utils.Fingerprint(req.PublicKey)
+	if err != nil {
+		fmt.Println("Invalid device key:", err)
+		return
+	}
+
+	fmt.Printf("Device %q wants to join your account. Fingerprint:\n  %s\n", req.Name, fp)
+	fmt.Println("It will be able to read every message sent to you from now on.")
+	fmt.Print("Certify it only if you just added it yourself and the fingerprint matches. Certify? (y/N): ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("Not certified.")
+		return
+	}
+
+	privKey, err := useKey(username)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	statement, err := deviceStatement(username, req.Name, req.PublicKey)
+	if err != nil {
+		fmt.Println("Failed to build device statement:", err)
+		return
+	}
+	certificate, err := signStatement(privKey, statement)
+	if err != nil {
+		fmt.Println("Failed to sign:", err)
+		return
+	}
+	fmt.Printf("Certificate for %q (paste it on the new device):\n\n%s\n\n", req.Name, certificate)
+}
+
+// deviceStatement builds the statement the primary key signs to certify a
+// device (see deviceStatement on the server)
+func deviceStatement(username, name, pubPEM string) (string, error) {
+	digest, err := utils.KeyDigest(pubPEM)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("cli-chat device\nusername: %s\nname: %s\nkey: %s", username, name, digest), nil
+}
+
+// deviceChallengeStatement builds the text a new device signs with its own
+// key (see deviceChallengeStatement on the server)
+func deviceChallengeStatement(username, pubPEM, challenge string) (string, error) {
+	digest, err := utils.KeyDigest(pubPEM)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("cli-chat device registration\nusername: %s\nkey: %s\nchallenge: %s", username, digest, challenge), nil
+}
+
+// verifyDeviceCertificate checks that the account's primary key certified
+// the device
+func verifyDeviceCertificate(primary chatcrypto.PublicKey, username string, d utils.Device) error {
+	statement, err := deviceStatement(username, d.Name, d.PublicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(d.Certificate)
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	digest := sha256.Sum256([]byte(statement))
+	if err := chatcrypto.Verify(primary, digest[:], sig); err != nil {
+		return fmt.Errorf("certificate not signed by the primary key")
+	}
+	return nil
+}
+
+// printLine is the say func used before a chat screen is up
+func printLine(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+// peerDevice is one of a contact's devices whose key we trust
+type peerDevice struct {
+	ID   uint
+	Name string
+	Key  chatcrypto.PublicKey
+}
+
+// peerDevices tracks the devices of the contact we are chatting with. It is
+// refreshed when a message arrives from a device we haven't seen. Notices go
+// through say, which may be called from the receive goroutine.
+type peerDevices struct {
+	mu       sync.Mutex
+	username string
+	say      func(format string, args ...interface{})
+	devices  map[uint]peerDevice
+}
+
+// refresh reloads the contact's device list. The primary device must match
+// the key pinned for the contact, and every extra device must carry a
+// certificate from it. New extra devices are pinned with a notice; a device
+// whose key changed is dropped, since device keys never change.
+func (p *peerDevices) refresh(contacts *utils.ContactStore, jwtToken string) error {
+	list, err := utils.GetDevices(p.username, jwtToken)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	devices := map[uint]peerDevice{}
+	var primary chatcrypto.PublicKey
+	for _, d := range list {
+		key, err := chatcrypto.ParseTaggedPublicKey(d.PublicKey, d.KeyType)
+		if err != nil {
+			p.say("Ignoring %s's device %d: %v", p.username, d.ID, err)
+			continue
+		}
+		fp, _ := utils.Fingerprint(d.PublicKey)
+		if d.ID == utils.PrimaryDevice {
+			if fp != contacts.PinnedFingerprint(p.username) {
+				p.say("⚠ %s's primary key no longer matches the pinned key; restart the chat to review it.", p.username)
+				continue
+			}
+			primary = key
+		} else {
+			// The primary device comes first, so it is known by now
+			if primary == nil {
+				continue
+			}
+			if err := verifyDeviceCertificate(primary, p.username, d); err != nil {
+				p.say("⚠ Ignoring %s's device %q (id %d): %v.", p.username, d.Name, d.ID, err)
+				continue
+			}
+			status, err := contacts.CheckDevice(p.username, d.ID, d.PublicKey)
+			if err != nil {
+				continue
+			}
+			switch status {
+			case utils.PinNew:
+				p.say("%s added a device %q (id %d), certified by their primary key. Fingerprint:\n  %s", p.username, d.Name, d.ID, fp)
+			case utils.PinChanged:
+				p.say("⚠ The key of %s's device %q (id %d) changed. Messages to and from it are refused.", p.username, d.Name, d.ID)
+				continue
+			}
+		}
+		devices[d.ID] = peerDevice{ID: d.ID, Name: d.Name, Key: key}
+	}
+	p.devices = devices
+	return contacts.Save()
+}
+
+// get returns the device with the given ID, if trusted
+func (p *peerDevices) get(id uint) (peerDevice, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.devices[id]
+	return d, ok
+}
+
+// list returns the trusted devices ordered by ID
+func (p *peerDevices) list() []peerDevice {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]peerDevice, 0, len(p.devices))
+	for _, d := range p.devices {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
@@ -0,0 +1,93 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/utils"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Escrow uploads this device's private key to the server, encrypted under a
+// recovery code the user writes down, so `recover` can restore it on a new
+// machine. The login password plays no part, so the server can't open it.
+func Escrow(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: escrow [--disable]")
+			fmt.Println("Stores your private key on the server, encrypted with a recovery code you write down.")
+			fmt.Println("Running it again replaces the escrow and the recovery code. --disable deletes it.")
+			return
+		}
+		if arg == "--disable" {
+			if err := utils.DeleteEscrow(jwtToken); err != nil {
+				fmt.Println("❌", err)
+				return
+			}
+			fmt.Println("✅ Key escrow deleted from the server.")
+			return
+		}
+	}
+
+	privKey, err := loadPrivateKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	backup := &utils.Backup{
+		Username:    currentUser,
+		ServerURL:   utils.BaseURL,
+		DeviceID:    utils.CurrentDevice(),
+		ExportedAt:  time.Now(),
+		PrivateKey:  privKey.PEM(),
+		RetiredKeys: collectRetiredKeys(currentUser),
+	}
+
+	code, err := utils.GenerateRecoveryCode()
+	if err != nil {
+		fmt.Println("Failed to generate recovery code:", err)
+		return
+	}
+	fmt.Println("\n----- RECOVERY CODE -----")
+	fmt.Printf("    %s\n", code)
+	fmt.Println("-------------------------")
+	fmt.Println("Write this down and keep it offline. It is the only way to open the escrow;")
+	fmt.Println("anyone with it and your login can recover your key.")
+
+	// Make sure it was written down before the escrow depends on it
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Type the recovery code to confirm (or 'cancel'): ")
+		typed, _ := reader.ReadString('\n')
+		typed = strings.TrimSpace(typed)
+		if typed == "cancel" {
+			fmt.Println("Escrow cancelled.")
+			return
+		}
+		if utils.NormalizeRecoveryCode(typed) == utils.NormalizeRecoveryCode(code) {
+			break
+		}
+		fmt.Println("That doesn't match.")
+	}
+
+	blob, err := utils.EncryptBackup(backup, utils.NormalizeRecoveryCode(code))
+	if err != nil {
+		fmt.Println("Failed to encrypt escrow:", err)
+		return
+	}
+	if err := utils.StoreEscrow(blob, jwtToken); err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	fmt.Println("✅ Key escrow stored. Use `recover` after logging in on a new machine.")
+}
@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportKey writes an encrypted backup of the current user's private key,
+// retired keys, pinned contacts and session state to a single file
+func ExportKey(args []string) {
+	currentUser := os.Getenv("CURRENT_USER")
+	var out string
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: export-key [--username:<username>] [--out:<file>]")
+			fmt.Println("Writes a passphrase-encrypted backup of your keys, pinned contacts, key log state and sessions.")
+			fmt.Println("Restore it on another machine with import-key. Defaults to <username>_backup.pem.")
+			return
+		}
+		if strings.HasPrefix(arg, "--username:") {
+			currentUser = strings.TrimPrefix(arg, "--username:")
+		}
+		if strings.HasPrefix(arg, "--out:") {
+			out = strings.TrimPrefix(arg, "--out:")
+		}
+	}
+	if currentUser == "" {
+		fmt.Print("Enter username: ")
+		u, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		currentUser = strings.TrimSpace(u)
+	}
+	if out == "" {
+		out = currentUser + "_backup.pem"
+	}
+	if _, err := os.Stat(out); err == nil {
+		fmt.Printf("%s already exists. Choose another file with --out:<file>.\n", out)
+		return
+	}
+
+	privKey, err := loadPrivateKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	deviceID, err := utils.LoadLocalDevice(currentUser)
+	if err != nil {
+		fmt.Println("Failed to read device record:", err)
+		return
+	}
+
+	backup := &utils.Backup{
+		Username:   currentUser,
+		ServerURL:  utils.BaseURL,
+		DeviceID:   deviceID,
+		ExportedAt: time.Now(),
+		PrivateKey: privKey.PEM(),
+	}
+
+	backup.RetiredKeys = collectRetiredKeys(currentUser)
+
+	if data, err := os.ReadFile(fmt.Sprintf("keys/%s_contacts.json", currentUser)); err == nil {
+		backup.Contacts = data
+	}
+	if data, err := os.ReadFile(fmt.Sprintf("keys/%s_keylog.json", currentUser)); err == nil {
+		backup.KeyLog = data
+	}
+	// Session state goes in decrypted; the backup has its own passphrase
+	sessions, err := openSessions(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load sessions:", err)
+		return
+	}
+	if backup.Identity, backup.Sessions, err = sessions.Export(); err != nil {
+		fmt.Println("Failed to read sessions:", err)
+		return
+	}
+
+	passphrase, err := newPassphrase("Choose a passphrase for the backup: ")
+	if err != nil {
+		fmt.Println("Failed to read passphrase:", err)
+		return
+	}
+	data, err := utils.EncryptBackup(backup, passphrase)
+	if err != nil {
+		fmt.Println("Failed to encrypt backup:", err)
+		return
+	}
+	if err := os.WriteFile(out, data, 0600); err != nil {
+		fmt.Println("Failed to write backup:", err)
+		return
+	}
+
+	fmt.Printf("✅ Backup written to %s\n", out)
+	fmt.Printf("   %d retired key(s), %d session(s)", len(backup.RetiredKeys), len(backup.Sessions))
+	if backup.Contacts != nil {
+		fmt.Print(", pinned contacts")
+	}
+	if backup.KeyLog != nil {
+		fmt.Print(", key log state")
+	}
+	fmt.Println()
+	fmt.Println("Restore it with `import-key --file:" + out + "`. If you restore it on a new machine,")
+	fmt.Println("stop chatting from this one: both would share the same sessions.")
+}
+
+// collectRetiredKeys returns the plaintext PEM of every key archived by
+// rotate-key, by retirement time. Call it after loadPrivateKey so encrypted
+// files can be opened with the cached passphrase.
+func collectRetiredKeys(username string) map[int64]string {
+	keys := map[int64]string{}
+	retired, _ := filepath.Glob(fmt.Sprintf("keys/%s_private.*.retired.pem", username))
+	for _, path := range retired {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), username+"_private."), ".retired.pem")
+		unix, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Warning: skipping %s: %v\n", path, err)
+			continue
+		}
+		if utils.IsEncryptedKey(data) {
+			privPEM, err := utils.DecryptKeyFile(data, passphrases[username])
+			if err != nil {
+				fmt.Printf("Warning: skipping %s: %v\n", path, err)
+				continue
+			}
+			data = []byte(privPEM)
+		}
+		keys[unix] = string(data)
+	}
+	return keys
+}
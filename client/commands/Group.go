@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"chat-client/utils"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// groupUsage is printed for `group --help` and unknown subcommands
+const groupUsage = `Usage: group <subcommand> [flags]
+  create --name:<name>                       create a group you own
+  list                                       list your groups
+  info --id:<id>                             show a group's members and roles
+  invite --id:<id> --username:<user>         add one of your connections (owner and admins)
+  kick --id:<id> --username:<user>           remove a member (owner and admins)
+  leave --id:<id>                            leave a group; an owner hands it to the next admin or member
+  role --id:<id> --username:<user> --role:admin|member
+                                             change a member's role (owner)
+  chat --id:<id>                             chat with the group`
+
+// Group creates, lists and manages groups, and starts group chats
+func Group(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	var sub, name, username, role string
+	var id uint
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for i, arg := range args {
+		switch {
+		case helpRegex.MatchString(arg):
+			fmt.Println(groupUsage)
+			return
+		case strings.HasPrefix(arg, "--name:"):
+			// Names may have spaces, so the name runs up to the next flag
+			words := []string{strings.TrimPrefix(arg, "--name:")}
+			for _, w := range args[i+1:] {
+				if strings.HasPrefix(w, "--") {
+					break
+				}
+				words = append(words, w)
+			}
+			name = strings.Join(words, " ")
+		case strings.HasPrefix(arg, "--id:"):
+			n, err := strconv.ParseUint(strings.TrimPrefix(arg, "--id:"), 10, 64)
+			if err != nil || n == 0 {
+				fmt.Println("Invalid group id:", strings.TrimPrefix(arg, "--id:"))
+				return
+			}
+			id = uint(n)
+		case strings.HasPrefix(arg, "--username:"):
+			username = strings.TrimPrefix(arg, "--username:")
+		case strings.HasPrefix(arg, "--role:"):
+			role = strings.TrimPrefix(arg, "--role:")
+		case i == 0:
+			sub = strings.ToLower(arg)
+		}
+	}
+
+	needID := func() bool {
+		if id == 0 {
+			fmt.Printf("Usage: group %s --id:<id> (see `group list`)\n", sub)
+		}
+		return id != 0
+	}
+	needUser := func() bool {
+		if username == "" {
+			fmt.Printf("Usage: group %s --id:<id> --username:<user>\n", sub)
+		}
+		return username != ""
+	}
+
+	switch sub {
+	case "create":
+		if strings.TrimSpace(name) == "" {
+			fmt.Println("Usage: group create --name:<name>")
+			return
+		}
+		newID, err := utils.CreateGroup(name, jwtToken)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("✅ Created group %q with id %d. Invite members with `group invite --id:%d --username:<user>`.\n", name, newID, newID)
+	case "list":
+		groups, err := utils.ListGroups(jwtToken)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		if len(groups) == 0 {
+			fmt.Println("You are not in any group. Create one with `group create --name:<name>`.")
+			return
+		}
+		fmt.Printf("%-6s %-30s %-8s %s\n", "ID", "NAME", "ROLE", "MEMBERS")
+		for _, g := range groups {
+			fmt.Printf("%-6d %-30s %-8s %d\n", g.ID, g.Name, g.Role, g.Members)
+		}
+	case "info":
+		if !needID() {
+			return
+		}
+		group, members, err := utils.GetGroup(id, jwtToken)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("Group %d: %s (you are %s)\n", group.ID, group.Name, group.Role)
+		fmt.Printf("%-20s %-8s %s\n", "USERNAME", "ROLE", "JOINED")
+		for _, m := range members {
+			fmt.Printf("%-20s %-8s %s\n", m.Username, m.Role, m.JoinedAt.Local().Format("2006-01-02 15:04"))
+		}
+	case "invite", "kick":
+		if !needID() || !needUser() {
+			return
+		}
+		groupAction(id, sub, map[string]string{"username": username}, jwtToken)
+	case "leave":
+		if !needID() {
+			return
+		}
+		groupAction(id, sub, nil, jwtToken)
+	case "role":
+		if !needID() || !needUser() {
+			return
+		}
+		if role != "admin" && role != "member" {
+			fmt.Println("Usage: group role --id:<id> --username:<user> --role:admin|member")
+			return
+		}
+		groupAction(id, sub, map[string]string{"username": username, "role": role}, jwtToken)
+	case "chat":
+		if !needID() {
+			return
+		}
+		groupChat(id, currentUser, jwtToken)
+	default:
+		fmt.Println(groupUsage)
+	}
+}
+
+// groupAction runs a membership change and prints the outcome
+func groupAction(id uint, action string, body map[string]string, jwtToken string) {
+	msg, err := utils.GroupAction(id, action, body, jwtToken)
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	fmt.Println("✅", msg)
+}
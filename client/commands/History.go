@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/session"
+	"chat-client/utils"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Chat history is fetched this many messages at a time
+const historyPage = 20
+
+// History shows the stored messages of a conversation, newest page first,
+// decrypted with the local keys
+func History(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	var username string
+	limit := historyPage
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: history --username:<username> [--limit:<n>]")
+			fmt.Println("Shows your messages with a connection, newest last, n at a time (default 20).")
+			fmt.Println("Press Enter for older messages, or q to stop.")
+			fmt.Println("Forward-secret messages can't be decrypted again; they are shown from the local")
+			fmt.Println("archive `chat` keeps on this device, which needs a passphrase-protected key file.")
+			return
+		}
+		if strings.HasPrefix(arg, "--username:") {
+			username = strings.TrimPrefix(arg, "--username:")
+		}
+		if strings.HasPrefix(arg, "--limit:") {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--limit:"))
+			if err != nil || n <= 0 {
+				fmt.Println("Invalid limit:", strings.TrimPrefix(arg, "--limit:"))
+				return
+			}
+			limit = n
+		}
+	}
+	if username == "" {
+		fmt.Println("Usage: history --username:<username> [--limit:<n>]")
+		return
+	}
+
+	privKey, err := useKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	decryptKeys := append([]chatcrypto.PrivateKey{privKey}, useRetiredKeys(currentUser)...)
+
+	// Signatures are checked against the keys pinned for the contact
+	userInfo, exists := utils.GetUser(username, jwtToken)
+	if !exists {
+		fmt.Println("User not found:", username)
+		return
+	}
+	contacts, err := utils.LoadContacts(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load contacts:", err)
+		return
+	}
+	reader := bufio.NewReader(os.Stdin)
+	if !confirmContactKey(contacts, username, userInfo.PublicKey, userInfo.KeyHistory, reader) {
+		return
+	}
+	devices := &peerDevices{username: username, say: printLine}
+	if err := devices.refresh(contacts, jwtToken); err != nil {
+		fmt.Println("Failed to load devices:", err)
+		return
+	}
+	storage, err := storageKey(currentUser)
+	if err != nil {
+		fmt.Println("Failed to unlock storage key:", err)
+		return
+	}
+	archive, err := utils.LoadArchive(currentUser, username, storage)
+	if err != nil {
+		fmt.Println("Failed to load message archive:", err)
+		return
+	}
+
+	var before uint
+	for {
+		msgs, next, err := utils.GetHistory(username, before, limit, jwtToken)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		if len(msgs) == 0 && before == 0 {
+			fmt.Printf("No messages with %s yet.\n", username)
+			return
+		}
+		// Pages come newest first; each is printed oldest first
+		for i := len(msgs) - 1; i >= 0; i-- {
+			fmt.Println(historyLine(msgs[i], currentUser, username, decryptKeys, devices, archive))
+		}
+		if next == 0 {
+			fmt.Println("-- start of conversation --")
+			return
+		}
+		before = next
+
+		fmt.Print("-- Enter for older messages, q to stop -- ")
+		answer, err := reader.ReadString('\n')
+		if err != nil || strings.TrimSpace(strings.ToLower(answer)) == "q" {
+			return
+		}
+	}
+}
+
+// historyLine decrypts a stored message, or reads it from the archive, and
+// formats it for History
+func historyLine(m utils.HistoryMessage, currentUser, username string, keys []chatcrypto.PrivateKey, devices *peerDevices, archive *utils.Archive) string {
+	ts := m.CreatedAt.Local().Format("2006-01-02 15:04")
+	from := username
+	badge := ""
+	var plain []byte
+	var err error
+
+	if m.Outgoing {
+		from = "You"
+		// Forward-secret messages go without a sender copy; `chat` keeps
+		// them in the archive under the send's ID
+		if m.Content == "" {
+			kept, ok := archive.Get(m.ID)
+			if !ok {
+				return fmt.Sprintf("[%s] You: (forward-secret message, not kept on this device)", ts)
+			}
+			return messageLine(ts, "", from, kept.Body)
+		}
+		// The copy is encrypted to the key of the device that sent it
+		plain, err = openSenderCopy(keys, currentUser, username, m.Content, m.Signature)
+		if err != nil && m.SenderDeviceID != utils.CurrentDevice() {
+			return fmt.Sprintf("[%s] You: (sent from your device %d, which has its own key)", ts, m.SenderDeviceID)
+		}
+	} else {
+		encrypted, decodeErr := base64.StdEncoding.DecodeString(m.Content)
+		if decodeErr != nil {
+			return fmt.Sprintf("[%s] %s: (malformed message)", ts, from)
+		}
+		dev, known := devices.get(m.SenderDeviceID)
+		from = senderLabel(username, dev, known)
+		badge = signatureBadge(dev, known, m.SenderDeviceID, func(key chatcrypto.PublicKey) error {
+			return verifyMessage(key, username, currentUser, encrypted, m.Signature)
+		})
+		// Ratchet message keys are deleted once used, so those are read
+		// from the archive `chat` kept when they arrived
+		if len(encrypted) > 0 && encrypted[0] == session.Version {
+			kept, ok := archive.Get(m.ID)
+			if !ok {
+				return fmt.Sprintf("[%s] %s: (forward-secret message, not kept on this device)", ts, from)
+			}
+			if !kept.SentAt.IsZero() {
+				ts = kept.SentAt.Local().Format("2006-01-02 15:04")
+			}
+			return messageLine(ts, badge, from, kept.Body)
+		}
+		plain, err = decryptWithKeys(keys, encrypted)
+	}
+	if err != nil {
+		return fmt.Sprintf("[%s] %s: (can't decrypt: %v)", ts, from, err)
+	}
+
+	inner, err := openPlaintext(plain)
+	if err != nil {
+		return fmt.Sprintf("[%s] %s: (unreadable: %v)", ts, from, err)
+	}
+	// Prefer the sender's clock, which is inside the signed ciphertext
+	if !inner.SentAt.IsZero() {
+		ts = inner.SentAt.Local().Format("2006-01-02 15:04")
+	}
+	return messageLine(ts, badge, from, inner.Body)
+}
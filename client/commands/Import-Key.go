@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ImportKey restores a backup written by export-key into keys/
+func ImportKey(args []string) {
+	var file string
+	force := false
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: import-key [--file:<backup file>] [--force]")
+			fmt.Println("Restores keys, pinned contacts, key log state and sessions from an export-key backup.")
+			fmt.Println("--force replaces keys already on this machine; a different key is kept as a retired key.")
+			return
+		}
+		if strings.HasPrefix(arg, "--file:") {
+			file = strings.TrimPrefix(arg, "--file:")
+		}
+		if arg == "--force" {
+			force = true
+		}
+	}
+	if file == "" {
+		fmt.Print("Backup file: ")
+		f, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		file = strings.TrimSpace(f)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Println("Failed to read backup:", err)
+		return
+	}
+
+	var backup *utils.Backup
+	var passphrase string
+	for attempt := 0; attempt < 3 && backup == nil; attempt++ {
+		if passphrase, err = readPassphrase("Backup passphrase: "); err != nil {
+			fmt.Println("Failed to read passphrase:", err)
+			return
+		}
+		backup, err = utils.DecryptBackup(data, passphrase)
+		if errors.Is(err, utils.ErrWrongPassphrase) {
+			fmt.Println("Wrong passphrase.")
+			continue
+		}
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+	}
+	if backup == nil {
+		return
+	}
+
+	if !restoreBackup(backup, passphrase, force) {
+		return
+	}
+
+	username := backup.Username
+	passphrases[username] = passphrase
+	fmt.Printf("✅ Restored %s's keys from a backup made %s.\n", username, backup.ExportedAt.Format("2006-01-02 15:04"))
+	fmt.Println("Your key files now use the backup passphrase.")
+	fmt.Printf("Log in with `login --username:%s` to continue.\n", username)
+}
+
+// restoreBackup writes the contents of a backup into keys/, encrypting key
+// files with passphrase. Existing keys are only replaced when force is set.
+func restoreBackup(backup *utils.Backup, passphrase string, force bool) bool {
+	username := backup.Username
+	if filepath.Base(username) != username || strings.ContainsAny(username, `/\ `) {
+		fmt.Printf("❌ Backup has an invalid username %q\n", username)
+		return false
+	}
+	if _, err := chatcrypto.ParsePrivateKey(backup.PrivateKey); err != nil {
+		fmt.Println("❌ Backup private key is invalid:", err)
+		return false
+	}
+	keyFileName := fmt.Sprintf("keys/%s_private.pem", username)
+	if _, err := os.Stat(keyFileName); err == nil && !force {
+		fmt.Printf("%s already exists. Re-run with --force to replace it.\n", keyFileName)
+		return false
+	}
+	if backup.ServerURL != "" && backup.ServerURL != utils.BaseURL {
+		fmt.Printf("Warning: the backup was made for %s, this client uses %s.\n", backup.ServerURL, utils.BaseURL)
+	}
+
+	if err := os.MkdirAll(fmt.Sprintf("keys/%s_sessions", username), 0700); err != nil {
+		fmt.Println("Failed to create keys directory:", err)
+		return false
+	}
+
+	// A key being replaced may still be needed for messages encrypted to it,
+	// so it is archived like rotate-key archives old keys
+	if existing, err := os.ReadFile(keyFileName); err == nil {
+		if !retireReplacedKey(username, keyFileName, existing, backup.PrivateKey, passphrase) {
+			return false
+		}
+	}
+	if err := writeKeyFile(keyFileName, backup.PrivateKey, passphrase); err != nil {
+		fmt.Println("Failed to save private key:", err)
+		return false
+	}
+	for unix, privPEM := range backup.RetiredKeys {
+		path := fmt.Sprintf("keys/%s_private.%d.retired.pem", username, unix)
+		if err := writeKeyFile(path, privPEM, passphrase); err != nil {
+			fmt.Printf("Warning: failed to restore %s: %v\n", path, err)
+		}
+	}
+	if backup.DeviceID != utils.PrimaryDevice {
+		if err := utils.SaveLocalDevice(username, utils.Device{ID: backup.DeviceID}); err != nil {
+			fmt.Println("Warning: failed to restore device record:", err)
+		}
+	} else {
+		os.Remove(fmt.Sprintf("keys/%s_device.json", username))
+	}
+	if backup.Contacts != nil {
+		if err := os.WriteFile(fmt.Sprintf("keys/%s_contacts.json", username), backup.Contacts, 0600); err != nil {
+			fmt.Println("Warning: failed to restore contacts:", err)
+		}
+	}
+	// Without the pinned log key and tree head, the next key check would
+	// trust whatever log the server shows
+	if backup.KeyLog != nil {
+		if err := os.WriteFile(fmt.Sprintf("keys/%s_keylog.json", username), backup.KeyLog, 0600); err != nil {
+			fmt.Println("Warning: failed to restore key log state:", err)
+		}
+	}
+	// Session state is sealed under the storage key, which goes under the
+	// passphrase the restored key files use
+	if !resealStorageKey(username, passphrase) {
+		return false
+	}
+	sessions, err := openSessions(username)
+	if err == nil {
+		err = sessions.Import(backup.Identity, backup.Sessions)
+	}
+	if err != nil {
+		fmt.Println("Warning: failed to restore sessions:", err)
+	}
+
+	return true
+}
+
+// retireReplacedKey moves the key file at path aside as a retired key,
+// unless it holds privPEM already. The archived key is re-encrypted under
+// passphrase, which the restored key files use, when it can be opened.
+func retireReplacedKey(username, path string, data []byte, privPEM, passphrase string) bool {
+	var old chatcrypto.PrivateKey
+	var err error
+	if utils.IsEncryptedKey(data) {
+		old, err = openKeyFile(data, passphrases[username])
+		if errors.Is(err, utils.ErrWrongPassphrase) {
+			var p string
+			if p, err = readPassphrase(fmt.Sprintf("Passphrase for the existing %s: ", path)); err == nil {
+				old, err = openKeyFile(data, p)
+			}
+		}
+	} else {
+		old, err = chatcrypto.ParsePrivateKey(string(data))
+	}
+	if err == nil && old.PEM() == privPEM {
+		return true
+	}
+
+	retiredPath := fmt.Sprintf("keys/%s_private.%d.retired.pem", username, time.Now().Unix())
+	if err == nil {
+		if err := writeKeyFile(retiredPath, old.PEM(), passphrase); err != nil {
+			fmt.Println("Failed to archive the existing private key:", err)
+			return false
+		}
+	} else {
+		fmt.Printf("Warning: could not open the existing private key (%v); it keeps its old passphrase.\n", err)
+		if err := os.Rename(path, retiredPath); err != nil {
+			fmt.Println("Failed to archive the existing private key:", err)
+			return false
+		}
+	}
+	fmt.Println("The existing private key was archived at", retiredPath)
+	return true
+}
+
+// resealStorageKey puts username's storage key under passphrase, keeping the
+// key already on this machine if the old or new passphrase opens it, so
+// local state sealed under it stays readable
+func resealStorageKey(username, passphrase string) bool {
+	delete(storageKeys, username)
+	var key *utils.StorageKey
+	if data, err := os.ReadFile(storageKeyPath(username)); err == nil {
+		for _, p := range []string{passphrases[username], passphrase} {
+			if key, err = utils.OpenStorageKey(data, p); err == nil {
+				break
+			}
+		}
+		if key == nil {
+			fmt.Printf("Warning: %s doesn't open with the backup passphrase; replacing it.\n", storageKeyPath(username))
+		}
+	}
+	if key == nil {
+		var err error
+		if key, err = utils.NewStorageKey(); err != nil {
+			fmt.Println("Failed to create storage key:", err)
+			return false
+		}
+	}
+	if err := writeStorageKey(username, key, passphrase); err != nil {
+		fmt.Println("Failed to save storage key:", err)
+		return false
+	}
+	storageKeys[username] = key
+	return true
+}
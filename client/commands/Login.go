@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"chat-client/utils"
@@ -28,7 +29,16 @@ func Login(args []string) {
 	for _, arg := range args {
 		if helpRegex.MatchString(arg) {
 			fmt.Println("Usage: login [--username:<username>] [--password:<password>]")
+			fmt.Println("       login --key [--username:<username>]")
 			fmt.Println("If no username/password is provided, you will be prompted interactively.")
+			fmt.Println("--key logs in without a password by signing a server challenge with keys/<username>_private.pem.")
+			return
+		}
+	}
+
+	for i, arg := range args {
+		if arg == "--key" {
+			loginWithKey(append(append([]string{}, args[:i]...), args[i+1:]...))
 			return
 		}
 	}
@@ -89,10 +99,87 @@ func Login(args []string) {
 		log.Fatal("Failed to parse login response:", err)
 	}
 
-	JWTToken = res.Token                // store for session
+	finishLogin(client, username, res.Token)
+}
+
+// loginWithKey logs in by signing a server challenge with this machine's
+// device key instead of sending a password
+func loginWithKey(args []string) {
+	var username string
+	if len(args) >= 1 && strings.HasPrefix(args[0], "--username:") {
+		username = strings.TrimPrefix(args[0], "--username:")
+	} else {
+		fmt.Print("Enter username: ")
+		u, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		username = strings.TrimSpace(u)
+	}
+	if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(username) {
+		fmt.Println("❌ Username can only contain letters, numbers, and underscores.")
+		return
+	}
+
+	deviceID, err := utils.LoadLocalDevice(username)
+	if err != nil {
+		fmt.Println("Could not read device record:", err)
+		return
+	}
+	privKey, err := useKey(username)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	client := resty.New()
+	challenge, err := utils.GetLoginChallenge()
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	// Same text as loginStatement on the server
+	statement := fmt.Sprintf("cli-chat login\nusername: %s\ndevice: %d\nchallenge: %s", username, deviceID, challenge)
+	signature, err := signStatement(privKey, statement)
+	if err != nil {
+		fmt.Println("❌ Failed to sign login challenge:", err)
+		return
+	}
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(map[string]interface{}{
+			"username":  username,
+			"device_id": deviceID,
+			"challenge": challenge,
+			"signature": signature,
+		}).
+		SetResult(&res).
+		Post(utils.BaseURL + "/auth/login/key")
+	if err != nil {
+		log.Fatal("Login request failed:", err)
+	}
+	if resp.StatusCode() != 200 {
+		fmt.Println("Login failed:", resp.String())
+		return
+	}
+
+	finishLogin(client, username, res.Token)
+}
+
+// finishLogin stores the session for username and reports pending requests
+func finishLogin(client *resty.Client, username, token string) {
+	JWTToken = token                    // store for session
 	os.Setenv("JWT_TOKEN", JWTToken)    // store JWT token
 	os.Setenv("CURRENT_USER", username) // store username for later use
 
+	// Machines added with `devices --add` act as that device from now on
+	deviceID, err := utils.LoadLocalDevice(username)
+	if err != nil {
+		fmt.Println("Warning: could not read device record:", err)
+	}
+	os.Setenv("DEVICE_ID", strconv.FormatUint(uint64(deviceID), 10))
+
 	fmt.Println("Login successful! JWT stored for session.")
 	pendingResp, err := client.R().
 		SetHeader("Content-Type", "application/json").
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MigrateKeys encrypts plaintext private key files left by older versions
+// of the client with a passphrase
+func MigrateKeys(args []string) {
+	username := os.Getenv("CURRENT_USER")
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: migrate-keys [--username:<username>]")
+			fmt.Println("Encrypts keys/<username>_private.pem (and retired keys) with a passphrase,")
+			fmt.Println("and session state under a storage key protected by the same passphrase.")
+			fmt.Println("Defaults to the logged in user.")
+			return
+		}
+		if strings.HasPrefix(arg, "--username:") {
+			username = strings.TrimPrefix(arg, "--username:")
+		}
+	}
+	if username == "" {
+		fmt.Print("Enter username: ")
+		u, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		username = strings.TrimSpace(u)
+	}
+
+	paths := []string{fmt.Sprintf("keys/%s_private.pem", username)}
+	retired, _ := filepath.Glob(fmt.Sprintf("keys/%s_private.*.retired.pem", username))
+	paths = append(paths, retired...)
+
+	var plaintext []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if !utils.IsEncryptedKey(data) {
+			plaintext = append(plaintext, path)
+		}
+	}
+	if len(plaintext) == 0 {
+		fmt.Printf("No plaintext key files found for %s.\n", username)
+	} else {
+		passphrase, err := keyPassphrase(username)
+		if err != nil {
+			fmt.Println("Failed to read passphrase:", err)
+			return
+		}
+		for _, path := range plaintext {
+			if err := encryptKeyFileInPlace(path, passphrase); err != nil {
+				fmt.Printf("❌ %s: %v\n", path, err)
+				continue
+			}
+			fmt.Printf("✅ Encrypted %s\n", path)
+		}
+	}
+
+	// Session state follows the key file: opening it with the key file
+	// protected seals what is still in plaintext
+	if _, err := os.Stat(fmt.Sprintf("keys/%s_identity.json", username)); err != nil {
+		return
+	}
+	if _, err := openSessions(username); err != nil {
+		fmt.Println("❌ Failed to encrypt session state:", err)
+		return
+	}
+	if _, err := os.Stat(storageKeyPath(username)); err == nil {
+		fmt.Printf("✅ Session state is encrypted under %s\n", storageKeyPath(username))
+	}
+}
+
+// encryptKeyFileInPlace replaces a plaintext key file with its encrypted
+// form, checking the result opens before the original is overwritten
+func encryptKeyFileInPlace(path, passphrase string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := chatcrypto.ParsePrivateKey(string(data)); err != nil {
+		return err
+	}
+	encrypted, err := utils.EncryptKeyFile(string(data), passphrase)
+	if err != nil {
+		return err
+	}
+	if _, err := openKeyFile(encrypted, passphrase); err != nil {
+		return fmt.Errorf("encrypted key failed to open: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, encrypted, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
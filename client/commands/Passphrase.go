@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// minPassphraseLength is the shortest passphrase accepted for a new key file
+const minPassphraseLength = 8
+
+// passphrases caches key file passphrases per user for the rest of the
+// session, so only the first command that needs the key prompts for it
+var passphrases = map[string]string{}
+
+// readPassphrase prompts for a passphrase without echoing it
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// keyFilePrompt is the prompt used when choosing a key file passphrase
+const keyFilePrompt = "Choose a passphrase to protect your private key: "
+
+// newPassphrase asks for a new passphrase, twice
+func newPassphrase(prompt string) (string, error) {
+	for {
+		p, err := readPassphrase(prompt)
+		if err != nil {
+			return "", err
+		}
+		if len(p) < minPassphraseLength {
+			fmt.Printf("Passphrase must be at least %d characters.\n", minPassphraseLength)
+			continue
+		}
+		confirm, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if p != confirm {
+			fmt.Println("Passphrases do not match.")
+			continue
+		}
+		return p, nil
+	}
+}
+
+// keyPassphrase returns the cached passphrase for username, asking for a new
+// one if their key file was never protected
+func keyPassphrase(username string) (string, error) {
+	if p, ok := passphrases[username]; ok {
+		return p, nil
+	}
+	p, err := newPassphrase(keyFilePrompt)
+	if err != nil {
+		return "", err
+	}
+	passphrases[username] = p
+	return p, nil
+}
+
+// writeKeyFile encrypts privPEM under passphrase and writes it to path
+func writeKeyFile(path, privPEM, passphrase string) error {
+	data, err := utils.EncryptKeyFile(privPEM, passphrase)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// loadPrivateKey reads and parses keys/<username>_private.pem, prompting for
+// its passphrase unless one is cached
+func loadPrivateKey(username string) (chatcrypto.PrivateKey, error) {
+	keyFileName := fmt.Sprintf("keys/%s_private.pem", username)
+	privKeyData, err := os.ReadFile(keyFileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find private key file at %s (on a new machine, run `devices --add:<name>`)", keyFileName)
+	}
+
+	if !utils.IsEncryptedKey(privKeyData) {
+		fmt.Printf("Warning: %s is not passphrase protected. Run `migrate-keys` to encrypt it.\n", keyFileName)
+		privKey, err := chatcrypto.ParsePrivateKey(string(privKeyData))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key in %s: %w", keyFileName, err)
+		}
+		return privKey, nil
+	}
+
+	var privKey chatcrypto.PrivateKey
+	err = unlockFile(username, keyFileName, func(passphrase string) (err error) {
+		privKey, err = openKeyFile(privKeyData, passphrase)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening private key in %s: %w", keyFileName, err)
+	}
+	return privKey, nil
+}
+
+// unlockFile calls open with the passphrase cached for username, or with
+// ones read from the terminal, up to three, until it stops failing with
+// ErrWrongPassphrase. The passphrase that worked is cached.
+func unlockFile(username, path string, open func(passphrase string) error) error {
+	if p, ok := passphrases[username]; ok {
+		if err := open(p); err == nil {
+			return nil
+		}
+		delete(passphrases, username)
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		p, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+		if err != nil {
+			return err
+		}
+		err = open(p)
+		if errors.Is(err, utils.ErrWrongPassphrase) {
+			fmt.Println("Wrong passphrase.")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		passphrases[username] = p
+		return nil
+	}
+	return errors.New("too many wrong passphrases")
+}
+
+// storageKeys caches unlocked storage keys per user, like passphrases
+var storageKeys = map[string]*utils.StorageKey{}
+
+// storageKeyPath is where username's sealed storage key is kept
+func storageKeyPath(username string) string {
+	return fmt.Sprintf("keys/%s_storage.pem", username)
+}
+
+// storageKey returns the key that encrypts username's session state and
+// message archive, making one under the key file passphrase the first time.
+// It is nil while the key file itself is in plaintext: state files stay in
+// plaintext too until `migrate-keys`.
+func storageKey(username string) (*utils.StorageKey, error) {
+	if key, ok := storageKeys[username]; ok {
+		return key, nil
+	}
+	path := storageKeyPath(username)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		keyData, err := os.ReadFile(fmt.Sprintf("keys/%s_private.pem", username))
+		if err != nil || !utils.IsEncryptedKey(keyData) {
+			return nil, nil
+		}
+		// Opening the key file checks the passphrase before anything is
+		// sealed under it
+		if _, ok := passphrases[username]; !ok {
+			if _, err := loadPrivateKey(username); err != nil {
+				return nil, err
+			}
+		}
+		key, err := utils.NewStorageKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeStorageKey(username, key, passphrases[username]); err != nil {
+			return nil, fmt.Errorf("failed to save storage key: %w", err)
+		}
+		storageKeys[username] = key
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var key *utils.StorageKey
+	err = unlockFile(username, path, func(passphrase string) (err error) {
+		key, err = utils.OpenStorageKey(data, passphrase)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening storage key in %s: %w", path, err)
+	}
+	storageKeys[username] = key
+	return key, nil
+}
+
+// writeStorageKey seals key under passphrase into keys/<username>_storage.pem
+func writeStorageKey(username string, key *utils.StorageKey, passphrase string) error {
+	data, err := key.Encode(passphrase)
+	if err != nil {
+		return err
+	}
+	path := storageKeyPath(username)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// openKeyFile decrypts and parses an encrypted key file
+func openKeyFile(data []byte, passphrase string) (chatcrypto.PrivateKey, error) {
+	privPEM, err := utils.DecryptKeyFile(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return chatcrypto.ParsePrivateKey(privPEM)
+}
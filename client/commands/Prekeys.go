@@ -0,0 +1,250 @@
+package commands
+
+import (
+	"chat-client/chatcrypto"
+	"chat-client/session"
+	"chat-client/utils"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+const (
+	// oneTimePrekeyTarget is how many unused one-time prekeys we keep on the server
+	oneTimePrekeyTarget = 100
+	// oneTimePrekeyLow triggers a top-up when chat starts
+	oneTimePrekeyLow = 20
+)
+
+// Prekeys publishes (or refreshes) the signed prekey bundle others use to
+// start forward-secret sessions with us
+func Prekeys(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	rotate := false
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: prekeys [--rotate]")
+			fmt.Println("Uploads your signed prekey bundle and tops up one-time prekeys.")
+			fmt.Println("--rotate replaces the signed prekey; existing sessions keep working.")
+			return
+		}
+		if arg == "--rotate" {
+			rotate = true
+		}
+	}
+
+	privKey, err := useKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sessions, err := openSessions(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load sessions:", err)
+		return
+	}
+
+	remaining, err := publishPrekeys(sessions, currentUser, privKey, jwtToken, rotate)
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	fmt.Printf("Prekey bundle published. %d one-time prekey(s) available on the server.\n", remaining)
+}
+
+// openSessions loads the session store for username, encrypted under their
+// storage key
+func openSessions(username string) (*session.Manager, error) {
+	key, err := storageKey(username)
+	if err != nil {
+		return nil, err
+	}
+	var sealer session.Sealer
+	if key != nil {
+		sealer = key
+	}
+	return session.Open(
+		fmt.Sprintf("keys/%s_identity.json", username),
+		fmt.Sprintf("keys/%s_sessions", username),
+		sealer,
+	)
+}
+
+// publishPrekeys uploads our signed bundle, creating the identity on first
+// use, and tops up one-time prekeys to oneTimePrekeyTarget.
+func publishPrekeys(sessions *session.Manager, username string, privKey chatcrypto.PrivateKey, jwtToken string, rotate bool) (int64, error) {
+	id := sessions.Identity()
+	fresh := id == nil
+	if fresh {
+		var err error
+		if id, err = session.NewIdentity(); err != nil {
+			return 0, fmt.Errorf("failed to generate identity: %w", err)
+		}
+	} else if rotate {
+		if err := id.RotateSignedPrekey(); err != nil {
+			return 0, fmt.Errorf("failed to rotate signed prekey: %w", err)
+		}
+	}
+
+	var onServer int64
+	if !fresh {
+		if own, err := utils.GetPrekeyBundle(username, utils.CurrentDevice(), jwtToken); err == nil {
+			onServer = own.OneTimePrekeys
+		} else if !errors.Is(err, utils.ErrNoPrekeys) {
+			return 0, err
+		}
+	}
+	var oneTime []session.Prekey
+	if need := oneTimePrekeyTarget - int(onServer); need > 0 {
+		var err error
+		if oneTime, err = id.GenerateOneTimePrekeys(need); err != nil {
+			return 0, fmt.Errorf("failed to generate one-time prekeys: %w", err)
+		}
+	}
+
+	// Save before uploading: a bundle the server knows about but we can't
+	// answer would break every session started against it.
+	if err := os.MkdirAll("keys", 0700); err != nil {
+		return 0, err
+	}
+	if err := sessions.SaveIdentity(id); err != nil {
+		return 0, fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	bundle, err := id.Bundle()
+	if err != nil {
+		return 0, err
+	}
+	sig, err := signDigest(privKey, bundle.SignedData())
+	if err != nil {
+		return 0, fmt.Errorf("failed to sign prekeys: %w", err)
+	}
+
+	upload := utils.PrekeyUpload{
+		IdentityKey:    base64.StdEncoding.EncodeToString(bundle.IdentityKey),
+		SignedPrekeyID: bundle.SignedPrekeyID,
+		SignedPrekey:   base64.StdEncoding.EncodeToString(bundle.SignedPrekey),
+		Signature:      base64.StdEncoding.EncodeToString(sig),
+	}
+	for _, k := range oneTime {
+		upload.OneTimePrekeys = append(upload.OneTimePrekeys, utils.OneTimePrekey{
+			ID:  k.ID,
+			Key: base64.StdEncoding.EncodeToString(k.Key),
+		})
+	}
+	return utils.UploadPrekeys(upload, jwtToken)
+}
+
+// ensurePrekeys publishes our bundle if we never have, or tops up one-time
+// prekeys when the server is running low
+func ensurePrekeys(sessions *session.Manager, username string, privKey chatcrypto.PrivateKey, jwtToken string) error {
+	if sessions.Identity() != nil {
+		own, err := utils.GetPrekeyBundle(username, utils.CurrentDevice(), jwtToken)
+		if err == nil && own.OneTimePrekeys >= oneTimePrekeyLow {
+			return nil
+		}
+		if err != nil && !errors.Is(err, utils.ErrNoPrekeys) {
+			return err
+		}
+	}
+	_, err := publishPrekeys(sessions, username, privKey, jwtToken, false)
+	return err
+}
+
+// sessionName is the session store key for one of peer's devices. The
+// primary device keeps the plain username so existing sessions still load.
+func sessionName(peer string, deviceID uint) string {
+	if deviceID == utils.PrimaryDevice {
+		return peer
+	}
+	return fmt.Sprintf("%s.%d", peer, deviceID)
+}
+
+// ensureSession starts a session with one of peer's devices from its
+// published bundle if we don't have one yet. It returns false when the device
+// hasn't published prekeys, in which case messages fall back to the hybrid
+// envelope.
+func ensureSession(sessions *session.Manager, peer string, deviceID uint, peerKey chatcrypto.PublicKey, jwtToken string) (bool, error) {
+	name := sessionName(peer, deviceID)
+	if sessions.HasSession(name) {
+		return true, nil
+	}
+	if sessions.Identity() == nil {
+		return false, nil
+	}
+
+	remote, err := utils.GetPrekeyBundle(peer, deviceID, jwtToken)
+	if errors.Is(err, utils.ErrNoPrekeys) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	bundle, err := verifiedBundle(remote, peer, peerKey)
+	if err != nil {
+		return false, err
+	}
+	if remote.OneTimePrekey != nil {
+		key, err := base64.StdEncoding.DecodeString(remote.OneTimePrekey.Key)
+		if err != nil {
+			return false, fmt.Errorf("malformed one-time prekey: %w", err)
+		}
+		bundle.OneTimePrekey = &session.Prekey{ID: remote.OneTimePrekey.ID, Key: key}
+	}
+
+	if err := sessions.Start(name, bundle); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// trustedInitiator accepts a session handshake from one of peer's devices
+// only if the identity key it claims is the one in the bundle that device
+// signed with its long-term key
+func trustedInitiator(peer string, deviceID uint, peerKey chatcrypto.PublicKey, jwtToken string) func([]byte) error {
+	return func(identityKey []byte) error {
+		remote, err := utils.GetSignedPrekeys(peer, deviceID, jwtToken)
+		if err != nil {
+			return fmt.Errorf("can't check %s's identity key: %w", peer, err)
+		}
+		bundle, err := verifiedBundle(remote, peer, peerKey)
+		if err != nil {
+			return err
+		}
+		if err := bundle.CheckIdentity(identityKey); err != nil {
+			return fmt.Errorf("%s's device: %w", peer, err)
+		}
+		return nil
+	}
+}
+
+// verifiedBundle decodes a published bundle and checks it is signed by the
+// device's long-term key
+func verifiedBundle(remote *utils.PrekeyBundle, peer string, peerKey chatcrypto.PublicKey) (session.Bundle, error) {
+	var err error
+	bundle := session.Bundle{SignedPrekeyID: remote.SignedPrekeyID}
+	if bundle.IdentityKey, err = base64.StdEncoding.DecodeString(remote.IdentityKey); err != nil {
+		return bundle, fmt.Errorf("malformed identity key: %w", err)
+	}
+	if bundle.SignedPrekey, err = base64.StdEncoding.DecodeString(remote.SignedPrekey); err != nil {
+		return bundle, fmt.Errorf("malformed signed prekey: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(remote.Signature)
+	if err != nil {
+		return bundle, fmt.Errorf("malformed prekey signature: %w", err)
+	}
+	if err := chatcrypto.Verify(peerKey, bundle.SignedData(), sig); err != nil {
+		return bundle, fmt.Errorf("%s's prekey bundle is not signed by their key", peer)
+	}
+	return bundle, nil
+}
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Recover rebuilds keys/<user>_private.pem from the server-side escrow,
+// using the recovery code shown by `escrow`
+func Recover(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	deviceID := utils.CurrentDevice()
+	force := false
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: recover [--device:<id>] [--force]")
+			fmt.Println("Restores your private key from the escrow stored with `escrow`.")
+			fmt.Println("--device picks which device's escrow to restore (default: primary).")
+			fmt.Println("--force replaces a key already on this machine; a different key is kept as a retired key.")
+			return
+		}
+		if strings.HasPrefix(arg, "--device:") {
+			id, err := strconv.ParseUint(strings.TrimPrefix(arg, "--device:"), 10, 64)
+			if err != nil {
+				fmt.Println("Invalid device id:", arg)
+				return
+			}
+			deviceID = uint(id)
+		}
+		if arg == "--force" {
+			force = true
+		}
+	}
+
+	blob, err := utils.GetEscrow(deviceID, jwtToken)
+	if errors.Is(err, utils.ErrNoEscrow) {
+		fmt.Println("No key escrow is stored for this device. Use import-key if you have a backup file.")
+		return
+	}
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+
+	var backup *utils.Backup
+	for attempt := 0; attempt < 3 && backup == nil; attempt++ {
+		code, err := readPassphrase("Recovery code: ")
+		if err != nil {
+			fmt.Println("Failed to read recovery code:", err)
+			return
+		}
+		backup, err = utils.DecryptBackup(blob, utils.NormalizeRecoveryCode(code))
+		if errors.Is(err, utils.ErrWrongPassphrase) {
+			fmt.Println("Wrong recovery code.")
+			continue
+		}
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+	}
+	if backup == nil {
+		return
+	}
+	if backup.Username != currentUser {
+		fmt.Printf("❌ The escrow belongs to %q, not %q.\n", backup.Username, currentUser)
+		return
+	}
+
+	// A key rotated after the escrow was made can still read old messages,
+	// but it is no longer the device's key
+	if devices, err := utils.GetDevices(currentUser, jwtToken); err == nil {
+		for _, d := range devices {
+			if d.ID != backup.DeviceID {
+				continue
+			}
+			if privKey, err := chatcrypto.ParsePrivateKey(backup.PrivateKey); err == nil {
+				if privKey.Public().PEM() != d.PublicKey {
+					fmt.Println("Warning: the escrowed key was replaced after the escrow was made. Run `escrow` again once recovered.")
+				}
+			}
+		}
+	}
+
+	passphrase, err := newPassphrase(keyFilePrompt)
+	if err != nil {
+		fmt.Println("Failed to read passphrase:", err)
+		return
+	}
+	if !restoreBackup(backup, passphrase, force) {
+		return
+	}
+	passphrases[currentUser] = passphrase
+	os.Setenv("DEVICE_ID", strconv.FormatUint(uint64(backup.DeviceID), 10))
+
+	fmt.Printf("✅ Recovered %s's private key from the escrow made %s.\n", currentUser, backup.ExportedAt.Format("2006-01-02 15:04"))
+	fmt.Println("Sessions aren't part of the escrow; new ones are started on your next chat.")
+}
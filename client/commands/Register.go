@@ -2,11 +2,8 @@ package commands
 
 import (
 	"bufio"
+	"chat-client/chatcrypto"
 	"chat-client/utils"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
@@ -19,31 +16,25 @@ import (
 
 // var baseURL = "http://localhost:8080/auth"
 
-// GenerateKeys generates a 2048-bit RSA key pair and returns PEM strings
-func GenerateKeys() (privateKeyPEM string, publicKeyPEM string, err error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// GenerateKeys generates a key pair of the given type (chatcrypto.KeyTypeRSA
+// for 2048-bit RSA, chatcrypto.KeyTypeCurve for Ed25519 plus X25519) and
+// returns PEM strings
+func GenerateKeys(keyType string) (privateKeyPEM string, publicKeyPEM string, err error) {
+	key, err := chatcrypto.GenerateKey(keyType)
 	if err != nil {
 		return "", "", err
 	}
+	return key.PEM(), key.Public().PEM(), nil
+}
 
-	privDER := x509.MarshalPKCS1PrivateKey(privateKey)
-	privBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privDER,
-	}
-	privateKeyPEM = string(pem.EncodeToMemory(privBlock))
-
-	pubDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+// registrationStatement builds the text signed at registration (see
+// registrationStatement on the server)
+func registrationStatement(username string, pub chatcrypto.PublicKey, challenge string) (string, error) {
+	digest, err := utils.KeyDigest(pub.PEM())
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-	pubBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pubDER,
-	}
-	publicKeyPEM = string(pem.EncodeToMemory(pubBlock))
-
-	return
+	return fmt.Sprintf("cli-chat registration\nusername: %s\nkey: %s\nchallenge: %s", username, digest, challenge), nil
 }
 
 // Register handles CLI registration
@@ -52,13 +43,29 @@ func Register(args []string) {
 	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
 	for _, arg := range args {
 		if helpRegex.MatchString(arg) {
-			fmt.Println("Usage: register [--username:<username>] [--password:<password>]")
+			fmt.Println("Usage: register [--username:<username>] [--password:<password>] [--key-type:curve25519|rsa]")
 			fmt.Println("If no username/password is provided, you will be prompted interactively.")
-			fmt.Println("A public/private key pair will be generated. The PRIVATE key will be displayed, store it safely!")
+			fmt.Println("A public/private key pair will be generated and the PRIVATE key saved under keys/, encrypted with a passphrase you choose.")
+			fmt.Println("New accounts use Ed25519/X25519 keys; --key-type:rsa creates a 2048-bit RSA key instead.")
 			return
 		}
 	}
 
+	keyType := chatcrypto.KeyTypeCurve
+	rest := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--key-type:") {
+			keyType = strings.TrimPrefix(arg, "--key-type:")
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	args = rest
+	if keyType != chatcrypto.KeyTypeCurve && keyType != chatcrypto.KeyTypeRSA {
+		fmt.Printf("❌ Unknown key type %q (use %s or %s).\n", keyType, chatcrypto.KeyTypeCurve, chatcrypto.KeyTypeRSA)
+		return
+	}
+
 	var username, password string
 
 	// Parse CLI args if provided
@@ -86,12 +93,41 @@ func Register(args []string) {
 		return
 	}
 
-	// Generate RSA key pair
-	privateKey, publicKey, err := GenerateKeys()
+	// Generate key pair
+	privateKey, publicKey, err := GenerateKeys(keyType)
 	if err != nil {
 		log.Fatal("Failed to generate keys:", err)
 	}
 
+	// Ask for the passphrase before registering, so a failed prompt
+	// doesn't leave an account without a saved key
+	passphrase, err := newPassphrase(keyFilePrompt)
+	if err != nil {
+		fmt.Println("❌ Failed to read passphrase:", err)
+		return
+	}
+
+	// Prove to the server that we hold the key we register
+	key, err := chatcrypto.ParsePrivateKey(privateKey)
+	if err != nil {
+		log.Fatal("Failed to parse generated key:", err)
+	}
+	challenge, err := utils.GetRegisterChallenge()
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	statement, err := registrationStatement(username, key.Public(), challenge.Challenge)
+	if err != nil {
+		fmt.Println("❌ Failed to build registration statement:", err)
+		return
+	}
+	signature, keyProof, err := chatcrypto.ProveKey(key, statement, challenge.ServerKey)
+	if err != nil {
+		fmt.Println("❌ Failed to answer registration challenge:", err)
+		return
+	}
+
 	// Send public key to server
 	client := resty.New()
 	resp, err := client.R().
@@ -100,6 +136,9 @@ func Register(args []string) {
 			"username":   username,
 			"password":   password,
 			"public_key": publicKey,
+			"challenge":  challenge.Challenge,
+			"signature":  signature,
+			"key_proof":  keyProof,
 		}).
 		Post(utils.BaseURL + "/auth/register")
 
@@ -116,13 +155,16 @@ func Register(args []string) {
 
 		// Save private key to file
 		keyFileName := fmt.Sprintf("keys/%s_private.pem", username)
-		if err := os.WriteFile(keyFileName, []byte(privateKey), 0600); err != nil {
+		if err := writeKeyFile(keyFileName, privateKey, passphrase); err != nil {
 			log.Fatal("Failed to save private key:", err)
 		}
 
+		passphrases[username] = passphrase
+
 		fmt.Println("\n✅ Registration successful!")
 		fmt.Println("----- IMPORTANT -----")
 		fmt.Printf("Your private key has been saved to: %s\n", keyFileName)
+		fmt.Println("It is encrypted with your passphrase. There is no way to recover a forgotten passphrase.")
 		fmt.Println("Keep this file safe and secure. If lost, you will not be able to decrypt messages!")
 		fmt.Println("Recommended: Back up this file in a secure location.")
 	} else {
@@ -0,0 +1,293 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/agent"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RotateKey replaces the current user's key pair. The server only accepts
+// the new key with a statement signed by the old one, so contacts can see
+// the rotation was authorized by the key they pinned.
+func RotateKey(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	keyType := ""
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: rotate-key [--key-type:curve25519|rsa]")
+			fmt.Println("Generates a new key pair, signs the change with your current key and uploads it.")
+			fmt.Println("The old private key is kept so messages sent before the rotation stay readable.")
+			fmt.Println("The new key has the same type as the current one unless --key-type is given,")
+			fmt.Println("so --key-type:curve25519 moves an RSA account to Ed25519/X25519 keys.")
+			return
+		}
+		if strings.HasPrefix(arg, "--key-type:") {
+			keyType = strings.TrimPrefix(arg, "--key-type:")
+		}
+	}
+	if keyType != "" && keyType != chatcrypto.KeyTypeCurve && keyType != chatcrypto.KeyTypeRSA {
+		fmt.Printf("Unknown key type %q (use %s or %s).\n", keyType, chatcrypto.KeyTypeCurve, chatcrypto.KeyTypeRSA)
+		return
+	}
+
+	// The server only tracks a key history for the account key
+	if utils.CurrentDevice() != utils.PrimaryDevice {
+		fmt.Println("Only the primary device can rotate its key. Remove this device and add it again instead.")
+		return
+	}
+
+	oldKey, err := loadPrivateKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Print("Your contacts will be warned that your key changed. Continue? (y/N): ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("Key rotation cancelled.")
+		return
+	}
+
+	if keyType == "" {
+		keyType = oldKey.Type()
+	}
+	privPEM, pubPEM, err := GenerateKeys(keyType)
+	if err != nil {
+		fmt.Println("Key generation failed:", err)
+		return
+	}
+	newKey, err := chatcrypto.ParsePrivateKey(privPEM)
+	if err != nil {
+		fmt.Println("Key generation failed:", err)
+		return
+	}
+
+	statement, err := rotationStatement(currentUser, oldKey.Public(), newKey.Public())
+	if err != nil {
+		fmt.Println("Failed to build rotation statement:", err)
+		return
+	}
+	// Extra devices were certified by the old key. Only devices it really
+	// certified get a certificate from the new one.
+	devices, err := utils.GetDevices(currentUser, jwtToken)
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	certificates := map[uint]string{}
+	for _, d := range devices {
+		if d.ID == utils.PrimaryDevice {
+			continue
+		}
+		if err := verifyDeviceCertificate(oldKey.Public(), currentUser, d); err != nil {
+			fmt.Printf("❌ Device %d (%s): %v. Remove it with `devices --remove:%d` first.\n", d.ID, d.Name, err, d.ID)
+			return
+		}
+		deviceStmt, err := deviceStatement(currentUser, d.Name, d.PublicKey)
+		if err == nil {
+			certificates[d.ID], err = signStatement(newKey, deviceStmt)
+		}
+		if err != nil {
+			fmt.Printf("Failed to certify device %d with the new key: %v\n", d.ID, err)
+			return
+		}
+	}
+
+	oldSig, err := signStatement(oldKey, statement)
+	if err != nil {
+		fmt.Println("Failed to sign with current key:", err)
+		return
+	}
+	newSig, err := signStatement(newKey, statement)
+	if err != nil {
+		fmt.Println("Failed to sign with new key:", err)
+		return
+	}
+
+	// Write the new key before uploading it: if the upload succeeds and we
+	// crash before saving, the account would be left with a key nobody has.
+	passphrase, err := keyPassphrase(currentUser)
+	if err != nil {
+		fmt.Println("Failed to read passphrase:", err)
+		return
+	}
+	keyPath := fmt.Sprintf("keys/%s_private.pem", currentUser)
+	pendingPath := keyPath + ".new"
+	if err := writeKeyFile(pendingPath, privPEM, passphrase); err != nil {
+		fmt.Println("Failed to save new private key:", err)
+		return
+	}
+
+	err = utils.RotateKey(utils.KeyRotation{
+		NewPublicKey:       pubPEM,
+		Statement:          statement,
+		Signature:          oldSig,
+		NewSignature:       newSig,
+		DeviceCertificates: certificates,
+	}, jwtToken)
+	if err != nil {
+		os.Remove(pendingPath)
+		fmt.Println("❌", err)
+		return
+	}
+
+	retiredPath := fmt.Sprintf("keys/%s_private.%d.retired.pem", currentUser, time.Now().Unix())
+	if err := os.Rename(keyPath, retiredPath); err != nil {
+		fmt.Printf("Key rotated, but the old key could not be archived: %v\nYour new key is in %s\n", err, pendingPath)
+		return
+	}
+	if err := os.Rename(pendingPath, keyPath); err != nil {
+		fmt.Printf("Key rotated, but the new key could not be installed: %v\nYour new key is in %s\n", err, pendingPath)
+		return
+	}
+	fmt.Println("✅ Key rotated. Old key archived at", retiredPath)
+	if agentKeys(currentUser) != nil && agent.NewClient(agent.SocketPath()).Remove(currentUser) == nil {
+		fmt.Println("Your old key was removed from the agent. Run `agent --add` to load the new one.")
+	}
+	if _, err := utils.GetEscrow(utils.PrimaryDevice, jwtToken); err == nil {
+		fmt.Println("Your key escrow still holds the old key. Run `escrow` to replace it.")
+	}
+
+	// Prekey bundles are signed with the long-term key, and the server
+	// dropped ours with the old key
+	sessions, err := openSessions(currentUser)
+	if err != nil {
+		fmt.Println("Warning: failed to load sessions:", err)
+		return
+	}
+	if _, err := publishPrekeys(sessions, currentUser, newKey, jwtToken, true); err != nil {
+		fmt.Println("Warning: could not republish prekeys, run `prekeys`:", err)
+	}
+}
+
+// rotationStatement builds the statement the server checks before accepting
+// a new key (see checkRotationStatement on the server)
+func rotationStatement(username string, oldPub, newPub chatcrypto.PublicKey) (string, error) {
+	digests := make([]string, 2)
+	for i, pub := range []chatcrypto.PublicKey{oldPub, newPub} {
+		var err error
+		if digests[i], err = utils.KeyDigest(pub.PEM()); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("cli-chat key rotation\nusername: %s\nold-key: %s\nnew-key: %s\ntimestamp: %d",
+		username, digests[0], digests[1], time.Now().Unix()), nil
+}
+
+func signStatement(key chatcrypto.PrivateKey, statement string) (string, error) {
+	digest := sha256.Sum256([]byte(statement))
+	sig, err := signDigest(key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// loadRetiredKeys returns the private keys archived by rotate-key, newest
+// first. Encrypted files are opened with the cached passphrase, so call it
+// after loadPrivateKey; unreadable files are skipped.
+func loadRetiredKeys(username string) []chatcrypto.PrivateKey {
+	paths, _ := filepath.Glob(fmt.Sprintf("keys/%s_private.*.retired.pem", username))
+	keys := []chatcrypto.PrivateKey{}
+	for i := len(paths) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(paths[i])
+		if err != nil {
+			continue
+		}
+		var key chatcrypto.PrivateKey
+		if utils.IsEncryptedKey(data) {
+			key, err = openKeyFile(data, passphrases[username])
+		} else {
+			key, err = chatcrypto.ParsePrivateKey(string(data))
+		}
+		if err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// rotationChainValid reports whether history links fromPEM to toPEM through
+// rotation statements for username, each signed by the key it retires and
+// naming that key as the old one
+func rotationChainValid(username, fromPEM, toPEM string, history []utils.KeyHistoryEntry) bool {
+	target, err := utils.KeyDigest(toPEM)
+	if err != nil || fromPEM == "" {
+		return false
+	}
+	current := fromPEM
+	for range history {
+		var entry *utils.KeyHistoryEntry
+		for i := range history {
+			if history[i].PublicKey == current {
+				entry = &history[i]
+				break
+			}
+		}
+		if entry == nil {
+			return false
+		}
+		pub, err := chatcrypto.ParsePublicKey(entry.PublicKey)
+		if err != nil {
+			return false
+		}
+		sig, err := base64.StdEncoding.DecodeString(entry.Signature)
+		if err != nil {
+			return false
+		}
+		digest := sha256.Sum256([]byte(entry.Statement))
+		if chatcrypto.Verify(pub, digest[:], sig) != nil {
+			return false
+		}
+		// A signature by the key proves nothing unless the statement is this
+		// user's rotation away from it
+		oldKey, err := utils.KeyDigest(entry.PublicKey)
+		if err != nil || !strings.HasPrefix(entry.Statement, "cli-chat key rotation\n") ||
+			statementField(entry.Statement, "username") != username ||
+			statementField(entry.Statement, "old-key") != oldKey {
+			return false
+		}
+		next := statementField(entry.Statement, "new-key")
+		if next == target {
+			return true
+		}
+		// Find the intermediate key the statement points at
+		current = ""
+		for _, h := range history {
+			if d, err := utils.KeyDigest(h.PublicKey); err == nil && d == next {
+				current = h.PublicKey
+				break
+			}
+		}
+		if current == "" {
+			return false
+		}
+	}
+	return false
+}
+
+func statementField(statement, name string) string {
+	for _, line := range strings.Split(statement, "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok && k == name {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"chat-client/utils"
+)
+
+// Verify shows the safety number shared with another user and lets the
+// user mark that contact as verified once they've compared it out of band
+func Verify(args []string) {
+	jwtToken := os.Getenv("JWT_TOKEN")
+	currentUser := os.Getenv("CURRENT_USER")
+	if jwtToken == "" || currentUser == "" {
+		fmt.Println("You must login first using the login command.")
+		return
+	}
+
+	helpRegex := regexp.MustCompile(`^--help$|^-h$`)
+	unverify := false
+	var username string
+	for _, arg := range args {
+		if helpRegex.MatchString(arg) {
+			fmt.Println("Usage: verify [--username:<username>] [--unverify]")
+			fmt.Println("Compare the safety number with your contact in person or over a call.")
+			fmt.Println("If it matches on both screens, mark the contact as verified.")
+			return
+		}
+		if strings.HasPrefix(arg, "--username:") {
+			username = strings.TrimPrefix(arg, "--username:")
+		}
+		if arg == "--unverify" {
+			unverify = true
+		}
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	if username == "" {
+		fmt.Print("Enter username: ")
+		u, _ := reader.ReadString('\n')
+		username = strings.TrimSpace(u)
+	}
+
+	contacts, err := utils.LoadContacts(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load contacts:", err)
+		return
+	}
+	if unverify {
+		contacts.ClearVerified(username)
+		if err := contacts.Save(); err != nil {
+			fmt.Println("Failed to save contacts:", err)
+			return
+		}
+		fmt.Printf("%s is no longer marked as verified.\n", username)
+		return
+	}
+
+	privKey, err := useKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ownKey := privKey.Public().PEM()
+
+	userInfo, exists := utils.GetUser(username, jwtToken)
+	if !exists {
+		fmt.Println("User not found:", username)
+		return
+	}
+
+	if !confirmContactKey(contacts, username, userInfo.PublicKey, userInfo.KeyHistory, reader) {
+		return
+	}
+
+	theirKey, err := chatcrypto.ParseTaggedPublicKey(userInfo.PublicKey, userInfo.KeyType)
+	if err != nil {
+		fmt.Printf("Error parsing %s's public key: %v\n", username, err)
+		return
+	}
+
+	safety, err := utils.SafetyNumber(currentUser, ownKey, username, userInfo.PublicKey)
+	if err != nil {
+		fmt.Println("Failed to compute safety number:", err)
+		return
+	}
+	ownFingerprint, _ := utils.Fingerprint(ownKey)
+	theirFingerprint, err := utils.Fingerprint(userInfo.PublicKey)
+	if err != nil {
+		fmt.Printf("Error parsing %s's public key: %v\n", username, err)
+		return
+	}
+
+	fmt.Printf("\nSafety number with %s:\n\n", username)
+	groups := strings.Fields(safety)
+	for i := 0; i < len(groups); i += 4 {
+		fmt.Printf("    %s\n", strings.Join(groups[i:i+4], " "))
+	}
+	fmt.Printf("\nYour key fingerprint:      %s (%s)\n", ownFingerprint, privKey.Type())
+	fmt.Printf("%-26s %s (%s)\n", username+"'s key fingerprint:", theirFingerprint, theirKey.Type())
+	if devices, err := utils.GetDevices(username, jwtToken); err == nil && len(devices) > 1 {
+		fmt.Printf("\n%s's other devices (not covered by the safety number):\n", username)
+		for _, d := range devices[1:] {
+			fp, _ := utils.Fingerprint(d.PublicKey)
+			fmt.Printf("  %-3d %-16s %s\n", d.ID, d.Name, fp)
+		}
+	}
+
+	if head, err := utils.LastTreeHead(); err == nil && head != nil {
+		fmt.Printf("\nKey log: %d entries, root %s\n", head.TreeSize, utils.GroupHex(head.RootHash))
+		fmt.Println("(compare with your contact: a different root at the same size means the server forked its log)")
+	}
+
+	if contacts.IsVerified(username, theirFingerprint) {
+		fmt.Printf("\n✔ %s is already verified with this key.\n", username)
+		return
+	}
+
+	fmt.Print("\nDoes the safety number match on both devices? Mark as verified? (y/N): ")
+	answer, _ := reader.ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("Not verified.")
+		return
+	}
+	contacts.MarkVerified(username)
+	if err := contacts.Save(); err != nil {
+		fmt.Println("Failed to save contacts:", err)
+		return
+	}
+	fmt.Printf("✔ %s marked as verified.\n", username)
+}
+
+// confirmContactKey checks the key the server returned for username against
+// the pinned one. The first key seen is pinned; a changed key is only used
+// after the user explicitly accepts it. It returns false if the key must not
+// be used.
+func confirmContactKey(contacts *utils.ContactStore, username, pubPEM string, history []utils.KeyHistoryEntry, reader *bufio.Reader) bool {
+	oldFingerprint := contacts.PinnedFingerprint(username)
+	var pinnedPEM string
+	if c, ok := contacts.Contacts[username]; ok {
+		pinnedPEM = c.PublicKey
+	}
+	status, err := contacts.CheckPin(username, pubPEM)
+	if err != nil {
+		fmt.Printf("Error parsing %s's public key: %v\n", username, err)
+		return false
+	}
+	newFingerprint, _ := utils.Fingerprint(pubPEM)
+
+	switch status {
+	case utils.PinNew:
+		fmt.Printf("First contact with %s. Pinned key fingerprint:\n  %s\n", username, newFingerprint)
+	case utils.PinChanged:
+		fmt.Println("\n⚠⚠⚠ WARNING: " + strings.ToUpper(username) + "'S KEY HAS CHANGED ⚠⚠⚠")
+		fmt.Printf("Pinned fingerprint: %s\n", oldFingerprint)
+		fmt.Printf("New fingerprint:    %s\n", newFingerprint)
+		if rotationChainValid(username, pinnedPEM, pubPEM, history) {
+			fmt.Println("The change is signed by the pinned key (rotate-key), so it was authorized by")
+			fmt.Println("whoever held that key. If you think it was stolen, confirm with them out of band.")
+		} else {
+			fmt.Println("This happens if they re-registered or rotated their key, but it can also mean")
+			fmt.Println("the server is handing you someone else's key. Confirm with them out of band.")
+		}
+		fmt.Print("Type 'accept' to trust the new key: ")
+		answer, _ := reader.ReadString('\n')
+		if strings.TrimSpace(answer) != "accept" {
+			fmt.Printf("Key not accepted. Refusing to use %s's new key.\n", username)
+			return false
+		}
+		if err := contacts.AcceptKey(username, pubPEM); err != nil {
+			fmt.Println("Failed to accept key:", err)
+			return false
+		}
+		fmt.Printf("New key for %s accepted. Run `verify --username:%s` to verify it.\n", username, username)
+	}
+
+	if err := contacts.Save(); err != nil {
+		fmt.Println("Failed to save contacts:", err)
+		return false
+	}
+	return true
+}
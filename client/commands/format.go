@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"fmt"
+	"strings"
+)
+
+// messageLine formats a message for chat, group chat and history. Lines of
+// a multiline body continue below, without the carriage returns some
+// terminals send.
+func messageLine(ts, badge, from string, body []byte) string {
+	lines := strings.Split(string(body), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	return fmt.Sprintf("[%s] %s%s: %s", ts, badge, from, strings.Join(lines, "\n"))
+}
+
+// senderLabel names who sent a message, with the device name for extra
+// devices
+func senderLabel(sender string, dev peerDevice, known bool) string {
+	if known && dev.ID != utils.PrimaryDevice {
+		return fmt.Sprintf("%s (%s)", sender, dev.Name)
+	}
+	return sender
+}
+
+// signatureBadge flags a message from an unknown device, or whose signature
+// verify rejects with the device's key
+func signatureBadge(dev peerDevice, known bool, deviceID uint, verify func(chatcrypto.PublicKey) error) string {
+	if !known {
+		return fmt.Sprintf("⚠ UNVERIFIED (unknown device %d) ", deviceID)
+	}
+	if err := verify(dev.Key); err != nil {
+		return fmt.Sprintf("⚠ UNVERIFIED (%v) ", err)
+	}
+	return ""
+}
@@ -0,0 +1,386 @@
+package commands
+
+import (
+	"bufio"
+	"chat-client/chatcrypto"
+	"chat-client/utils"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupPeer names a group's local state: the seen-set and our transcript
+// chain, the sender copies of our messages, and, under it, the chain of
+// each member
+func groupPeer(id uint) string {
+	return fmt.Sprintf("groups/%d", id)
+}
+
+// groupMembers tracks the other members of a group and the devices of each
+// whose keys we trust. Group messages are encrypted to every member device's
+// public key in turn; ratchet sessions are kept for direct chats.
+type groupMembers struct {
+	mu       sync.Mutex
+	id       uint
+	me       string
+	contacts *utils.ContactStore
+	jwtToken string
+	say      func(format string, args ...interface{})
+	members  map[string]*peerDevices
+}
+
+// refresh reloads the member list. With a reader, changed keys can be
+// accepted as in `chat`; without one, members we have no key pinned for
+// are pinned on first use and members whose key changed are left out.
+func (g *groupMembers) refresh(reader *bufio.Reader) error {
+	_, list, err := utils.GetGroup(g.id, g.jwtToken)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	current := g.members
+	g.mu.Unlock()
+
+	members := map[string]*peerDevices{}
+	for _, m := range list {
+		if m.Username == g.me {
+			continue
+		}
+		if devices, ok := current[m.Username]; ok {
+			members[m.Username] = devices
+			continue
+		}
+		if !g.trust(m.Username, reader) {
+			continue
+		}
+		// Read g.say on each call: it switches to the chat screen later
+		devices := &peerDevices{username: m.Username, say: func(format string, args ...interface{}) { g.say(format, args...) }}
+		if err := devices.refresh(g.contacts, g.jwtToken); err != nil {
+			g.say("Failed to load %s's devices: %v", m.Username, err)
+			continue
+		}
+		members[m.Username] = devices
+	}
+
+	g.mu.Lock()
+	g.members = members
+	g.mu.Unlock()
+	return nil
+}
+
+// trust checks a member's key against the one pinned for them
+func (g *groupMembers) trust(username string, reader *bufio.Reader) bool {
+	info, ok := utils.GetUser(username, g.jwtToken)
+	if !ok {
+		return false
+	}
+	if reader != nil {
+		return confirmContactKey(g.contacts, username, info.PublicKey, info.KeyHistory, reader)
+	}
+	status, err := g.contacts.CheckPin(username, info.PublicKey)
+	if err != nil {
+		g.say("Error parsing %s's public key: %v", username, err)
+		return false
+	}
+	switch status {
+	case utils.PinChanged:
+		g.say("⚠ %s's key changed. They are left out until you accept it with `chat --username:%s`.", username, username)
+		return false
+	case utils.PinNew:
+		fp, _ := utils.Fingerprint(info.PublicKey)
+		g.say("First contact with %s. Pinned key fingerprint:\n  %s", username, fp)
+	}
+	if err := g.contacts.Save(); err != nil {
+		g.say("Failed to save contacts: %v", err)
+	}
+	return true
+}
+
+// get returns a member's devices, if the member is trusted
+func (g *groupMembers) get(username string) (*peerDevices, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	devices, ok := g.members[username]
+	return devices, ok
+}
+
+// list returns the trusted members ordered by username
+func (g *groupMembers) list() []*peerDevices {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]*peerDevices, 0, len(g.members))
+	for _, devices := range g.members {
+		out = append(out, devices)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].username < out[j].username })
+	return out
+}
+
+// groupChat runs a chat session with a group
+func groupChat(id uint, currentUser, jwtToken string) {
+	group, _, err := utils.GetGroup(id, jwtToken)
+	if err != nil {
+		fmt.Println("❌", err)
+		return
+	}
+	privKey, err := useKey(currentUser)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	decryptKeys := append([]chatcrypto.PrivateKey{privKey}, useRetiredKeys(currentUser)...)
+
+	contacts, err := utils.LoadContacts(currentUser)
+	if err != nil {
+		fmt.Println("Failed to load contacts:", err)
+		return
+	}
+	peer := groupPeer(id)
+	seen, err := utils.LoadSeen(currentUser, peer)
+	if err != nil {
+		fmt.Println("Failed to load seen messages:", err)
+		return
+	}
+	transcript, err := utils.LoadTranscript(currentUser, peer)
+	if err != nil {
+		fmt.Println("Failed to load transcript:", err)
+		return
+	}
+
+	// Keys are checked up front, where a changed one can still be accepted
+	members := &groupMembers{
+		id:       id,
+		me:       currentUser,
+		contacts: contacts,
+		jwtToken: jwtToken,
+		say:      printLine,
+	}
+	if err := members.refresh(bufio.NewReader(os.Stdin)); err != nil {
+		fmt.Println("Failed to load members:", err)
+		return
+	}
+
+	wsURL := "ws://localhost:8080/chat"
+	client, err := utils.NewWSClient(jwtToken, wsURL)
+	if err != nil {
+		fmt.Println("Failed to connect to chat server:", err)
+		return
+	}
+	defer client.Close()
+
+	var unverified []string
+	for _, m := range members.list() {
+		if !contacts.IsVerified(m.username, contacts.PinnedFingerprint(m.username)) {
+			unverified = append(unverified, m.username)
+		}
+	}
+	fmt.Printf("\nStarting group chat %q with %d other member(s)...\n", group.Name, len(members.list()))
+	if len(unverified) > 0 {
+		fmt.Printf("⚠ unverified: %s — compare safety numbers with `verify`\n", strings.Join(unverified, ", "))
+	}
+	fmt.Println("Messages are encrypted to each member's devices, without forward secrecy.")
+	fmt.Println("Type your message and press Enter to send. Type 'exit' to quit.")
+	fmt.Println("----------------------------------------")
+
+	screen := newChatScreen("You: ")
+	defer screen.Close()
+	members.say = screen.Printf
+	sent := newSentLines()
+
+	// Each member's messages form their own transcript chain
+	chains := map[string]*utils.Transcript{}
+	chainOf := func(sender string) (*utils.Transcript, error) {
+		if t, ok := chains[sender]; ok {
+			return t, nil
+		}
+		t, err := utils.LoadTranscript(currentUser, peer+"/"+sender)
+		if err != nil {
+			return nil, err
+		}
+		chains[sender] = t
+		return t, nil
+	}
+
+	go client.ReceiveMessages(func(in utils.ChatMessage) {
+		// Direct messages are left for `chat`, other groups for their own chat
+		if in.GroupID != id {
+			return
+		}
+		sender := in.Sender
+		receipt := utils.ReceiptDelivered
+		defer func() {
+			if err := client.SendReceipt(receipt, []uint{in.ID}); err != nil {
+				screen.Println(err.Error())
+			}
+		}()
+		encryptedBytes, err := base64.StdEncoding.DecodeString(in.Content)
+		if err != nil {
+			screen.Printf("Error decoding message: %v", err)
+			return
+		}
+
+		// The sender may have joined, or added a device, since we started
+		devices, ok := members.get(sender)
+		if !ok {
+			if err := members.refresh(nil); err != nil {
+				screen.Printf("Failed to refresh members: %v", err)
+			}
+			devices, ok = members.get(sender)
+		}
+		var dev peerDevice
+		known := false
+		if ok {
+			if dev, known = devices.get(in.SenderDevice); !known {
+				if err := devices.refresh(contacts, jwtToken); err != nil {
+					screen.Printf("Failed to refresh %s's devices: %v", sender, err)
+				}
+				dev, known = devices.get(in.SenderDevice)
+			}
+		}
+
+		badge := signatureBadge(dev, known, in.SenderDevice, func(key chatcrypto.PublicKey) error {
+			return verifyGroupMessage(key, id, sender, currentUser, encryptedBytes, in.Signature)
+		})
+		from := senderLabel(sender, dev, known)
+
+		decrypted, err := decryptWithKeys(decryptKeys, encryptedBytes)
+		if err != nil {
+			screen.Printf("Failed to decrypt message from %s: %v", from, err)
+			return
+		}
+		inner, err := openPlaintext(decrypted)
+		if err != nil {
+			screen.Printf("Unreadable message from %s: %v", from, err)
+			return
+		}
+
+		ts := time.Now().Format("15:04")
+		if inner.ID == nil {
+			badge += "⚠ UNDATED (older client) "
+		} else {
+			switch seen.Check(inner.ID, inner.SentAt) {
+			case utils.SeenDuplicate:
+				screen.Printf("Dropped a repeated message from %s (sent %s).", from, inner.SentAt.Format("2006-01-02 15:04"))
+				return
+			case utils.SeenTooOld:
+				badge += "⚠ OLD (possible replay) "
+			case utils.SeenFuture:
+				badge += "⚠ FUTURE TIMESTAMP "
+			}
+			if err := seen.Save(); err != nil {
+				screen.Printf("Failed to save seen messages: %v", err)
+			}
+			if inner.Prev != nil {
+				if chain, err := chainOf(sender); err != nil {
+					screen.Printf("Failed to load transcript: %v", err)
+				} else {
+					badge += chainBadge(chain, in.SenderDevice, inner)
+					if err := chain.Save(); err != nil {
+						screen.Printf("Failed to save transcript: %v", err)
+					}
+				}
+			}
+			ts = inner.SentAt.Local().Format("15:04")
+			if time.Since(inner.SentAt) > 24*time.Hour {
+				ts = inner.SentAt.Local().Format("2006-01-02 15:04")
+			}
+		}
+		receipt = utils.ReceiptRead
+
+		screen.Printf("%s", messageLine(ts, badge, from, inner.Body))
+	}, func(ev utils.Event) {
+		switch ev.Type {
+		case utils.EventGroup:
+			if ev.Group != id {
+				return
+			}
+			switch {
+			case ev.Sender == currentUser && (ev.Change == "kicked" || ev.Change == "left"):
+				screen.Println("You are no longer in this group. Type 'exit' to quit.")
+				return
+			case ev.Change == "joined":
+				screen.Println(ev.Sender + " joined the group")
+			case ev.Change == "left":
+				screen.Println(ev.Sender + " left the group")
+			case ev.Change == "kicked":
+				screen.Println(ev.Sender + " was removed from the group")
+			case ev.Change == "role":
+				screen.Println(ev.Sender + "'s role changed")
+			}
+			if err := members.refresh(nil); err != nil {
+				screen.Printf("Failed to refresh members: %v", err)
+			}
+			return
+		case utils.EventTypingStart, utils.EventTypingStop, utils.EventPresence:
+			return
+		}
+		for _, line := range sent.apply(ev) {
+			screen.Println(line)
+		}
+	})
+
+	for {
+		msg, err := screen.ReadLine(nil)
+		if err != nil || msg == "exit" {
+			screen.Close()
+			fmt.Println("Exiting chat...")
+			return
+		}
+		if msg == "" {
+			continue
+		}
+
+		// Every copy carries the same message ID and our group transcript
+		// link; each is signed for its member and this group
+		seq, prev := transcript.NextLink()
+		plaintext, err := sealPlaintext([]byte(msg), seq, prev)
+		if err != nil {
+			screen.Printf("Failed to prepare message: %v", err)
+			continue
+		}
+		var copies []utils.MessageCopy
+		for _, member := range members.list() {
+			for _, dev := range member.list() {
+				encrypted := encryptMessage(dev.Key, plaintext)
+				if encrypted == nil {
+					screen.Printf("Failed to encrypt message for %s's device %q.", member.username, dev.Name)
+					continue
+				}
+				signature, err := signGroupMessage(privKey, id, currentUser, member.username, encrypted)
+				if err != nil {
+					screen.Printf("Failed to sign message: %v", err)
+					continue
+				}
+				copies = append(copies, utils.MessageCopy{
+					Username:  member.username,
+					DeviceID:  dev.ID,
+					Content:   base64.StdEncoding.EncodeToString(encrypted),
+					Signature: base64.StdEncoding.EncodeToString(signature),
+				})
+			}
+		}
+		if len(copies) == 0 {
+			screen.Println("Nobody else in the group can receive messages yet.")
+			continue
+		}
+		own, err := senderCopy(privKey, id, currentUser, "", plaintext)
+		if err != nil {
+			screen.Printf("Warning: could not keep a copy for your history: %v", err)
+		}
+
+		if err := client.SendGroupMessage(sent.add(msg), id, copies, own); err != nil {
+			screen.Printf("Failed to send message: %v", err)
+			continue
+		}
+		hash := sha256.Sum256(plaintext)
+		transcript.RecordSent(seq, hash[:])
+		if err := transcript.Save(); err != nil {
+			screen.Printf("Failed to save transcript: %v", err)
+		}
+	}
+}
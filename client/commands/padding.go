@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Plaintexts are wrapped in a versioned header before encryption. The first
+// byte is 0x80 | format version: a typed message is UTF-8 text, which never
+// starts with a byte in 0x80-0xBF, so messages from clients that predate the
+// header are still recognized and shown as they are.
+const (
+	innerHeaderFlag = 0x80
+	innerHeaderMask = 0xC0
+
+	// innerPadded is format 1, still read but no longer sent:
+	//
+	//	0x81 | plaintext length(4) | plaintext | zero padding
+	innerPadded = 0x01
+
+	// innerIdentified is format 2, still read but no longer sent. It adds a
+	// random message ID and the sender's clock so receivers can drop
+	// replayed messages:
+	//
+	//	0x82 | message id(16) | sent at(8, unix ms) | plaintext length(4) | plaintext | zero padding
+	innerIdentified = 0x02
+
+	// innerChained is format 3, which adds the sender's transcript chain: a
+	// per-conversation sequence number and the SHA-256 of the previous
+	// plaintext the sender sent us, so dropped or reordered messages show up:
+	//
+	//	0x83 | message id(16) | sent at(8, unix ms) | seq(4) | prev hash(32) | plaintext length(4) | plaintext | zero padding
+	innerChained = 0x03
+
+	messageIDSize = 16
+)
+
+// paddingBuckets are the padded sizes, header included. Longer messages are
+// padded to a multiple of the last bucket, so the ciphertext only reveals
+// which bucket a message falls in.
+var paddingBuckets = []int{128, 256, 512, 1024, 2048, 4096}
+
+// innerMessage is a decrypted message with its header fields
+type innerMessage struct {
+	ID     []byte    // nil for formats without a message ID
+	SentAt time.Time // zero for formats without a timestamp
+	Seq    uint32    // 0 for formats without a transcript chain
+	Prev   []byte    // hash of the sender's previous message; nil without a chain
+	Hash   []byte    // SHA-256 of the whole plaintext, what the next message points at
+	Body   []byte
+}
+
+// paddedSize returns the bucket n bytes are padded up to
+func paddedSize(n int) int {
+	for _, b := range paddingBuckets {
+		if n <= b {
+			return b
+		}
+	}
+	last := paddingBuckets[len(paddingBuckets)-1]
+	return (n + last - 1) / last * last
+}
+
+// sealPlaintext wraps msg in the current inner format with a fresh message
+// ID, as message seq of the sender's chain following the message hashed prev
+func sealPlaintext(msg []byte, seq uint32, prev []byte) ([]byte, error) {
+	const headerLen = 1 + messageIDSize + 8 + 4 + sha256.Size + 4
+	if len(prev) != sha256.Size {
+		return nil, fmt.Errorf("invalid previous message hash")
+	}
+	out := make([]byte, paddedSize(headerLen+len(msg)))
+	out[0] = innerHeaderFlag | innerChained
+	h := out[1:]
+	if _, err := rand.Read(h[:messageIDSize]); err != nil {
+		return nil, err
+	}
+	h = h[messageIDSize:]
+	binary.BigEndian.PutUint64(h, uint64(time.Now().UnixMilli()))
+	binary.BigEndian.PutUint32(h[8:], seq)
+	copy(h[12:], prev)
+	binary.BigEndian.PutUint32(h[12+sha256.Size:], uint32(len(msg)))
+	copy(out[headerLen:], msg)
+	return out, nil
+}
+
+// openPlaintext parses a decrypted message. Plaintexts without a header come
+// from older clients and are returned as is, without an ID.
+func openPlaintext(data []byte) (*innerMessage, error) {
+	if len(data) == 0 || data[0]&innerHeaderMask != innerHeaderFlag {
+		return &innerMessage{Body: data}, nil
+	}
+	sum := sha256.Sum256(data)
+	m := &innerMessage{Hash: sum[:]}
+	rest := data[1:]
+	switch format := data[0] &^ innerHeaderMask; format {
+	case innerPadded:
+	case innerIdentified, innerChained:
+		if len(rest) < messageIDSize+8 {
+			return nil, fmt.Errorf("invalid message: truncated header")
+		}
+		m.ID = rest[:messageIDSize]
+		m.SentAt = time.UnixMilli(int64(binary.BigEndian.Uint64(rest[messageIDSize:])))
+		rest = rest[messageIDSize+8:]
+		if format == innerChained {
+			if len(rest) < 4+sha256.Size {
+				return nil, fmt.Errorf("invalid message: truncated header")
+			}
+			m.Seq = binary.BigEndian.Uint32(rest)
+			m.Prev = rest[4 : 4+sha256.Size]
+			rest = rest[4+sha256.Size:]
+		}
+	default:
+		return nil, fmt.Errorf("message format %d is not supported by this client; please update", data[0]&^innerHeaderMask)
+	}
+
+	body, err := unpad(rest)
+	if err != nil {
+		return nil, err
+	}
+	m.Body = body
+	return m, nil
+}
+
+// unpad reads "length(4) | body | zero padding"
+func unpad(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("invalid message: truncated header")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, fmt.Errorf("invalid message: bad length")
+	}
+	for _, b := range data[4+n:] {
+		if b != 0 {
+			return nil, fmt.Errorf("invalid message: bad padding")
+		}
+	}
+	return data[4 : 4+n], nil
+}
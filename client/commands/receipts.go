@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"chat-client/utils"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Status of a line sent in a chat, in the order it can advance
+const (
+	lineSending   = iota // written to the socket, not yet stored
+	lineSent             // stored by the server
+	lineDelivered        // acknowledged by one of the receiver's devices
+	lineRead             // shown to the receiver
+	lineFailed           // refused by the server
+)
+
+// sentLine is a message typed in this chat session
+type sentLine struct {
+	text   string
+	status int
+}
+
+// sentLines tracks the lines sent in a chat, numbered from 1, so server
+// events can be shown next to them. A line has one server ID per receiver
+// device; the first device to deliver or read it advances the line.
+type sentLines struct {
+	mu    sync.Mutex
+	lines []sentLine
+	byID  map[uint]int
+}
+
+func newSentLines() *sentLines {
+	return &sentLines{byID: map[uint]int{}}
+}
+
+// add records a line about to be sent and returns its ref for SendMessage
+func (s *sentLines) add(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, sentLine{text: text, status: lineSending})
+	return strconv.Itoa(len(s.lines))
+}
+
+// apply updates the lines an event is about and returns the text to print
+// for each line whose status advanced
+func (s *sentLines) apply(ev utils.Event) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var nums []int
+	status := lineSent
+	switch ev.Type {
+	case utils.EventSent, utils.EventError:
+		n, err := strconv.Atoi(ev.Ref)
+		if err != nil || n < 1 || n > len(s.lines) {
+			return nil
+		}
+		nums = []int{n}
+		if ev.Type == utils.EventError {
+			status = lineFailed
+		}
+		for _, id := range ev.IDs {
+			s.byID[id] = n
+		}
+	case utils.EventReceipt:
+		status = lineDelivered
+		if ev.Status == utils.ReceiptRead {
+			status = lineRead
+		}
+		for _, id := range ev.IDs {
+			if n, ok := s.byID[id]; ok {
+				nums = append(nums, n)
+			}
+		}
+	}
+
+	var out []string
+	for _, n := range nums {
+		line := &s.lines[n-1]
+		if line.status >= status && status != lineFailed {
+			continue
+		}
+		line.status = status
+		marker := statusMarker(status)
+		if status == lineFailed {
+			marker += " " + ev.Error
+		}
+		out = append(out, fmt.Sprintf("You #%d: %s  %s", n, snippet(line.text, 40), marker))
+	}
+	return out
+}
+
+func statusMarker(status int) string {
+	switch status {
+	case lineSent:
+		return "✓"
+	case lineDelivered:
+		return "✓✓"
+	case lineRead:
+		return "✓✓ read"
+	case lineFailed:
+		return "✗"
+	}
+	return ""
+}
+
+// snippet shortens text to at most n runes
+func snippet(text string, n int) string {
+	r := []rune(text)
+	if len(r) <= n {
+		return text
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,206 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// chatScreen is the chat's terminal. Output is printed above the input line,
+// which is then redrawn with whatever the user has typed so far, under an
+// optional status line such as "alice is typing…".
+//
+// On a terminal keys are read in raw mode, so the chat can tell when the
+// user is composing. Otherwise whole lines are read and there is no status.
+type chatScreen struct {
+	mu       sync.Mutex
+	prompt   string
+	line     []rune
+	status   string
+	in       *bufio.Reader
+	fd       int
+	raw      bool
+	oldState *term.State
+	prompted bool // line mode: the prompt is the last thing printed
+}
+
+// newChatScreen takes over the terminal and shows the prompt. Call Close to
+// give it back.
+func newChatScreen(prompt string) *chatScreen {
+	s := &chatScreen{prompt: prompt, in: bufio.NewReader(os.Stdin), fd: int(os.Stdin.Fd())}
+	if term.IsTerminal(s.fd) {
+		if state, err := term.MakeRaw(s.fd); err == nil {
+			s.raw, s.oldState = true, state
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.raw {
+		s.drawInput()
+	} else {
+		fmt.Print(prompt)
+		s.prompted = true
+	}
+	return s
+}
+
+// Close clears the input line and restores the terminal
+func (s *chatScreen) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.raw {
+		return
+	}
+	s.clearInput()
+	term.Restore(s.fd, s.oldState)
+	s.raw = false
+}
+
+// Printf prints a line above the input line
+func (s *chatScreen) Printf(format string, args ...interface{}) {
+	s.Println(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+// Println prints text above the input line
+func (s *chatScreen) Println(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.raw {
+		fmt.Printf("\r%s\n%s", text, s.prompt)
+		s.prompted = true
+		return
+	}
+	s.clearInput()
+	// Raw mode doesn't turn \n into \r\n
+	os.Stdout.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+	s.drawInput()
+}
+
+// SetStatus shows status above the input line, or removes it if empty. It
+// is only shown on a terminal.
+func (s *chatScreen) SetStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.raw || status == s.status {
+		return
+	}
+	s.clearInput()
+	s.status = status
+	s.drawInput()
+}
+
+// ReadLine reads the next line the user enters. On a terminal onEdit is
+// called with the input after every change. Ctrl-C, and Ctrl-D on an empty
+// line, return io.EOF.
+func (s *chatScreen) ReadLine(onEdit func(line string)) (string, error) {
+	if !s.raw {
+		s.mu.Lock()
+		if !s.prompted {
+			fmt.Print(s.prompt)
+		}
+		s.prompted = false
+		s.mu.Unlock()
+		line, err := s.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	for {
+		r, _, err := s.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		s.mu.Lock()
+		changed := true
+		switch {
+		case r == '\r' || r == '\n':
+			line := string(s.line)
+			// Leave the entered line in the scrollback, then start a new one
+			s.clearInput()
+			os.Stdout.WriteString(s.prompt + line + "\r\n")
+			s.line = nil
+			s.drawInput()
+			s.mu.Unlock()
+			return strings.TrimSpace(line), nil
+		case r == 3, r == 4 && len(s.line) == 0: // Ctrl-C, Ctrl-D
+			s.mu.Unlock()
+			return "", io.EOF
+		case r == 127 || r == 8: // Backspace
+			if len(s.line) == 0 {
+				changed = false
+				break
+			}
+			s.line = s.line[:len(s.line)-1]
+			s.clearInput()
+			s.drawInput()
+		case r == 21: // Ctrl-U
+			s.line = nil
+			s.clearInput()
+			s.drawInput()
+		case r == 27: // Escape sequences (arrow keys and the like) are ignored
+			s.skipEscape()
+			changed = false
+		case r < 32:
+			changed = false
+		default:
+			s.line = append(s.line, r)
+			os.Stdout.WriteString(string(r))
+		}
+		line := string(s.line)
+		s.mu.Unlock()
+
+		if changed && onEdit != nil {
+			onEdit(line)
+		}
+	}
+}
+
+// skipEscape consumes the rest of an ANSI escape sequence
+func (s *chatScreen) skipEscape() {
+	b, err := s.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return
+	}
+	for {
+		b, err := s.in.ReadByte()
+		if err != nil || (b >= 0x40 && b <= 0x7e) {
+			return
+		}
+	}
+}
+
+// clearInput erases the status and input lines, leaving the cursor at the
+// start of the first. The cursor must be at the end of the input.
+func (s *chatScreen) clearInput() {
+	cols, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || cols <= 0 {
+		cols = 80
+	}
+	width := utf8.RuneCountInString(s.prompt) + len(s.line)
+	rows := 1 + (width-1)/cols
+	if s.status != "" {
+		rows++
+	}
+	out := "\r\x1b[2K"
+	for i := 1; i < rows; i++ {
+		out += "\x1b[1A\x1b[2K"
+	}
+	os.Stdout.WriteString(out)
+}
+
+// drawInput writes the status and input lines
+func (s *chatScreen) drawInput() {
+	if s.status != "" {
+		os.Stdout.WriteString(s.status + "\r\n")
+	}
+	os.Stdout.WriteString(s.prompt + string(s.line))
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"sync"
+	"time"
+)
+
+// While the user types, typing_start is repeated every typingRefresh, and a
+// pause of typingIdle sends typing_stop. A contact's indicator expires after
+// typingExpiry without news, in case their typing_stop was lost.
+const (
+	typingRefresh = 3 * time.Second
+	typingIdle    = 5 * time.Second
+	typingExpiry  = 8 * time.Second
+)
+
+// typingNotifier tells the contact when we start and stop typing
+type typingNotifier struct {
+	mu     sync.Mutex
+	send   func(typing bool)
+	active bool
+	last   time.Time
+	idle   *time.Timer
+}
+
+func newTypingNotifier(send func(typing bool)) *typingNotifier {
+	return &typingNotifier{send: send}
+}
+
+// edited is called with the input line after every change
+func (t *typingNotifier) edited(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if line == "" {
+		t.stopLocked()
+		return
+	}
+	if !t.active || time.Since(t.last) >= typingRefresh {
+		t.active = true
+		t.last = time.Now()
+		t.send(true)
+	}
+	if t.idle == nil {
+		t.idle = time.AfterFunc(typingIdle, t.stop)
+	} else {
+		t.idle.Reset(typingIdle)
+	}
+}
+
+// stop sends typing_stop if typing_start was sent
+func (t *typingNotifier) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+}
+
+func (t *typingNotifier) stopLocked() {
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	if t.active {
+		t.active = false
+		t.send(false)
+	}
+}
+
+// typingIndicator shows "<user> is typing…" on the screen
+type typingIndicator struct {
+	mu     sync.Mutex
+	screen *chatScreen
+	user   string
+	expire *time.Timer
+}
+
+// start shows the indicator, or keeps it up if it already is
+func (t *typingIndicator) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.screen.SetStatus(t.user + " is typing…")
+	if t.expire == nil {
+		t.expire = time.AfterFunc(typingExpiry, t.stop)
+	} else {
+		t.expire.Reset(typingExpiry)
+	}
+}
+
+// stop hides the indicator
+func (t *typingIndicator) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expire != nil {
+		t.expire.Stop()
+	}
+	t.screen.SetStatus("")
+}
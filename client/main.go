@@ -45,17 +45,44 @@ func executor(input string) {
 		commands.AddUser(cmdArgs)
 	case "view-requests":
 		commands.ViewPendingRequests()
+	case "contacts":
+		commands.Contacts(cmdArgs)
 	case "respond":
 		commands.RespondToConnectionRequest(cmdArgs)
 	case "chat":
 		commands.Chat(cmdArgs)
+	case "group":
+		commands.Group(cmdArgs)
+	case "history":
+		commands.History(cmdArgs)
+	case "prekeys":
+		commands.Prekeys(cmdArgs)
+	case "verify":
+		commands.Verify(cmdArgs)
+	case "rotate-key":
+		commands.RotateKey(cmdArgs)
+	case "migrate-keys":
+		commands.MigrateKeys(cmdArgs)
+	case "devices":
+		commands.Devices(cmdArgs)
+	case "export-key":
+		commands.ExportKey(cmdArgs)
+	case "import-key":
+		commands.ImportKey(cmdArgs)
+	case "escrow":
+		commands.Escrow(cmdArgs)
+	case "recover":
+		commands.Recover(cmdArgs)
+	case "agent":
+		commands.Agent(cmdArgs)
 	case "help":
 		fmt.Println("\n=== Chat Application CLI Help ===")
 		fmt.Println("\nAuthentication Commands:")
 		fmt.Printf("%-20s : %s\n", "register", "Register a new user account")
-		fmt.Printf("%-20s   %s\n", "", "Usage: register --username:yourname --password:yourpass")
+		fmt.Printf("%-20s   %s\n", "", "Usage: register --username:yourname --password:yourpass [--key-type:curve25519|rsa]")
 		fmt.Printf("%-20s : %s\n", "login", "Login to your account")
 		fmt.Printf("%-20s   %s\n", "", "Usage: login --username:yourname --password:yourpass")
+		fmt.Printf("%-20s   %s\n", "", "       login --key --username:yourname (sign in with your key)")
 
 		fmt.Println("\nConnection Management:")
 		fmt.Printf("%-20s : %s\n", "add", "Send a connection request to another user")
@@ -64,6 +91,38 @@ func executor(input string) {
 		fmt.Printf("%-20s   %s\n", "", "Usage: view-requests")
 		fmt.Printf("%-20s : %s\n", "respond", "Accept or reject a connection request")
 		fmt.Printf("%-20s   %s\n", "", "Usage: respond --username:requester")
+		fmt.Printf("%-20s : %s\n", "contacts", "List your connections and who is online")
+		fmt.Printf("%-20s   %s\n", "", "Usage: contacts")
+
+		fmt.Println("\nChat & Encryption:")
+		fmt.Printf("%-20s : %s\n", "chat", "Start an encrypted chat with an accepted connection")
+		fmt.Printf("%-20s   %s\n", "", "Usage: chat --username:targetuser")
+		fmt.Printf("%-20s : %s\n", "history", "Read earlier messages with a connection, page by page")
+		fmt.Printf("%-20s   %s\n", "", "Usage: history --username:targetuser [--limit:n]")
+		fmt.Printf("%-20s : %s\n", "group", "Create, manage and chat in groups")
+		fmt.Printf("%-20s   %s\n", "", "Usage: group create --name:name | list | info --id:id | chat --id:id")
+		fmt.Printf("%-20s   %s\n", "", "       group invite|kick --id:id --username:user | leave --id:id")
+		fmt.Printf("%-20s   %s\n", "", "       group role --id:id --username:user --role:admin|member")
+		fmt.Printf("%-20s : %s\n", "prekeys", "Publish or refresh your forward-secrecy prekeys")
+		fmt.Printf("%-20s   %s\n", "", "Usage: prekeys [--rotate]")
+		fmt.Printf("%-20s : %s\n", "verify", "Compare safety numbers and mark a contact as verified")
+		fmt.Printf("%-20s   %s\n", "", "Usage: verify --username:targetuser [--unverify]")
+		fmt.Printf("%-20s : %s\n", "rotate-key", "Replace your key pair, signed by your current key")
+		fmt.Printf("%-20s   %s\n", "", "Usage: rotate-key [--key-type:curve25519|rsa]")
+		fmt.Printf("%-20s : %s\n", "migrate-keys", "Encrypt plaintext private key files with a passphrase")
+		fmt.Printf("%-20s   %s\n", "", "Usage: migrate-keys [--username:yourname]")
+		fmt.Printf("%-20s : %s\n", "devices", "List, add, certify or remove your devices")
+		fmt.Printf("%-20s   %s\n", "", "Usage: devices [--add:name] [--certify:request] [--remove:id]")
+		fmt.Printf("%-20s : %s\n", "export-key", "Write an encrypted backup of your keys and contacts")
+		fmt.Printf("%-20s   %s\n", "", "Usage: export-key [--out:file]")
+		fmt.Printf("%-20s : %s\n", "import-key", "Restore keys and contacts from a backup")
+		fmt.Printf("%-20s   %s\n", "", "Usage: import-key --file:backup [--force]")
+		fmt.Printf("%-20s : %s\n", "escrow", "Store your key on the server under a recovery code")
+		fmt.Printf("%-20s   %s\n", "", "Usage: escrow [--disable]")
+		fmt.Printf("%-20s : %s\n", "recover", "Restore your key from the server escrow")
+		fmt.Printf("%-20s   %s\n", "", "Usage: recover [--device:id] [--force]")
+		fmt.Printf("%-20s : %s\n", "agent", "Load your keys into the key agent (start it with `chat-client agent`)")
+		fmt.Printf("%-20s   %s\n", "", "Usage: agent [--add [--ttl:1h]] [--remove] [--lock] [--unlock]")
 
 		fmt.Println("\nSystem Commands:")
 		fmt.Printf("%-20s : %s\n", "clear", "Clear the terminal screen")
@@ -88,6 +147,13 @@ func noCompleter(d prompt.Document) []prompt.Suggest {
 }
 
 func main() {
+	// `chat-client agent` runs the key agent instead of the prompt
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		godotenv.Load()
+		commands.RunAgent(os.Args[2:])
+		return
+	}
+
 	fmt.Println("Welcome to Chat Application")
 	fmt.Println("Type 'help' to see available commands")
 
@@ -0,0 +1,340 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Version is the envelope version byte of ratchet messages
+const Version = 0x03
+
+// maxSkip bounds how many message keys a single message can make us derive
+// and keep around for out-of-order delivery.
+const maxSkip = 1000
+
+const (
+	flagPrekey = 0x01
+
+	keySize       = 32
+	fixedHeader   = 2 + keySize + 4 + 4       // version | flags | dh | pn | n
+	prekeyHeaderN = keySize + keySize + 4 + 4 // identity | base | spk id | one-time id
+)
+
+// ErrNoSession is returned when a message can't be matched to any session
+var ErrNoSession = errors.New("no session for message")
+
+// State is one double ratchet session with a peer
+type State struct {
+	BaseKey   []byte        `json:"base_key"` // initiator's handshake key, identifies the session
+	AD        []byte        `json:"ad"`       // both identity keys, authenticated with every message
+	RootKey   []byte        `json:"root_key"`
+	SendChain []byte        `json:"send_chain,omitempty"`
+	RecvChain []byte        `json:"recv_chain,omitempty"`
+	DHSelf    []byte        `json:"dh_self"`
+	DHRemote  []byte        `json:"dh_remote,omitempty"`
+	Ns        uint32        `json:"ns"`
+	Nr        uint32        `json:"nr"`
+	PN        uint32        `json:"pn"`
+	Skipped   []skippedKey  `json:"skipped,omitempty"`
+	Pending   *prekeyHeader `json:"pending,omitempty"`
+}
+
+func initInitiator(sk, ad, remoteSPK []byte, header *prekeyHeader) (*State, error) {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{
+		BaseKey:  header.BaseKey,
+		AD:       ad,
+		DHSelf:   dhs.Bytes(),
+		DHRemote: remoteSPK,
+		Pending:  header,
+	}
+	out, err := dh(s.DHSelf, s.DHRemote)
+	if err != nil {
+		return nil, err
+	}
+	s.RootKey, s.SendChain = kdfRoot(sk, out)
+	return s, nil
+}
+
+func initResponder(sk, ad, spk, baseKey []byte) *State {
+	return &State{
+		BaseKey: baseKey,
+		AD:      ad,
+		RootKey: sk,
+		DHSelf:  spk,
+	}
+}
+
+// Encrypt advances the sending chain and seals plaintext into a ratchet message
+func (s *State) Encrypt(plaintext []byte) ([]byte, error) {
+	if s.SendChain == nil {
+		// The responder can't send until the initiator's first message has
+		// been decrypted, which performs the first DH ratchet step.
+		return nil, errors.New("session has no sending chain yet")
+	}
+	pub, err := publicKey(s.DHSelf)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, fixedHeader, fixedHeader+prekeyHeaderN)
+	header[0] = Version
+	copy(header[2:], pub)
+	binary.BigEndian.PutUint32(header[2+keySize:], s.PN)
+	binary.BigEndian.PutUint32(header[2+keySize+4:], s.Ns)
+	if p := s.Pending; p != nil {
+		header[1] |= flagPrekey
+		header = append(header, p.IdentityKey...)
+		header = append(header, p.BaseKey...)
+		header = binary.BigEndian.AppendUint32(header, p.SignedPrekeyID)
+		header = binary.BigEndian.AppendUint32(header, p.OneTimeID)
+	}
+
+	var mk []byte
+	s.SendChain, mk = kdfChain(s.SendChain)
+	s.Ns++
+
+	return seal(mk, header, plaintext, s.AD)
+}
+
+// Decrypt opens a ratchet message. On failure the state is left untouched.
+func (s *State) Decrypt(msg []byte) ([]byte, error) {
+	m, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	next := s.clone()
+	plain, err := next.decrypt(m)
+	if err != nil {
+		return nil, err
+	}
+	*s = *next
+	return plain, nil
+}
+
+func (s *State) decrypt(m *message) ([]byte, error) {
+	for i, sk := range s.Skipped {
+		if sk.N != m.n || !bytes.Equal(sk.DH, m.dh) {
+			continue
+		}
+		plain, err := open(sk.MK, m, s.AD)
+		if err != nil {
+			return nil, err
+		}
+		s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+		return plain, nil
+	}
+
+	if !bytes.Equal(m.dh, s.DHRemote) || s.RecvChain == nil {
+		if err := s.skip(m.pn); err != nil {
+			return nil, err
+		}
+		if err := s.ratchet(m.dh); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skip(m.n); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	s.RecvChain, mk = kdfChain(s.RecvChain)
+	s.Nr++
+
+	plain, err := open(mk, m, s.AD)
+	if err != nil {
+		return nil, err
+	}
+	// The peer has our ratchet key now, so stop sending the handshake
+	s.Pending = nil
+	return plain, nil
+}
+
+// skippedKey is the key of a message that hasn't arrived yet, kept so it can
+// still be decrypted if it is delivered out of order.
+type skippedKey struct {
+	DH []byte `json:"dh"`
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+// skip stores message keys up to (not including) until on the receiving
+// chain. Only the newest maxSkip keys are kept.
+func (s *State) skip(until uint32) error {
+	if s.RecvChain == nil || until <= s.Nr {
+		return nil
+	}
+	if until-s.Nr > maxSkip {
+		return errors.New("too many skipped messages")
+	}
+	for s.Nr < until {
+		var mk []byte
+		s.RecvChain, mk = kdfChain(s.RecvChain)
+		s.Skipped = append(s.Skipped, skippedKey{DH: s.DHRemote, N: s.Nr, MK: mk})
+		s.Nr++
+	}
+	if over := len(s.Skipped) - maxSkip; over > 0 {
+		s.Skipped = append([]skippedKey(nil), s.Skipped[over:]...)
+	}
+	return nil
+}
+
+// ratchet performs a DH ratchet step for a new remote ratchet key
+func (s *State) ratchet(remote []byte) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.DHRemote = remote
+
+	out, err := dh(s.DHSelf, s.DHRemote)
+	if err != nil {
+		return err
+	}
+	s.RootKey, s.RecvChain = kdfRoot(s.RootKey, out)
+
+	next, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	s.DHSelf = next.Bytes()
+	out, err = dh(s.DHSelf, s.DHRemote)
+	if err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain = kdfRoot(s.RootKey, out)
+	return nil
+}
+
+func (s *State) clone() *State {
+	c := *s
+	c.Skipped = append([]skippedKey(nil), s.Skipped...)
+	return &c
+}
+
+// message is a parsed ratchet message
+type message struct {
+	header []byte
+	dh     []byte
+	pn, n  uint32
+	prekey *prekeyHeader
+	body   []byte
+}
+
+func parseMessage(msg []byte) (*message, error) {
+	if len(msg) < fixedHeader || msg[0] != Version {
+		return nil, errors.New("invalid ratchet message")
+	}
+	m := &message{
+		dh: msg[2 : 2+keySize],
+		pn: binary.BigEndian.Uint32(msg[2+keySize:]),
+		n:  binary.BigEndian.Uint32(msg[2+keySize+4:]),
+	}
+	end := fixedHeader
+	if msg[1]&flagPrekey != 0 {
+		if len(msg) < end+prekeyHeaderN {
+			return nil, errors.New("invalid ratchet message: truncated prekey header")
+		}
+		p := msg[end:]
+		m.prekey = &prekeyHeader{
+			IdentityKey:    p[:keySize],
+			BaseKey:        p[keySize : 2*keySize],
+			SignedPrekeyID: binary.BigEndian.Uint32(p[2*keySize:]),
+			OneTimeID:      binary.BigEndian.Uint32(p[2*keySize+4:]),
+		}
+		end += prekeyHeaderN
+	}
+	m.header = msg[:end]
+	m.body = msg[end:]
+	return m, nil
+}
+
+// ------------------- KDFs and AEAD -------------------
+
+func kdfRoot(rk, dhOut []byte) (root, chain []byte) {
+	out := make([]byte, 2*keySize)
+	io.ReadFull(hkdf.New(sha256.New, dhOut, rk, []byte("cli-chat/ratchet/root")), out)
+	return out[:keySize], out[keySize:]
+}
+
+func kdfChain(ck []byte) (next, mk []byte) {
+	m := hmac.New(sha256.New, ck)
+	m.Write([]byte{0x01})
+	mk = m.Sum(nil)
+	m = hmac.New(sha256.New, ck)
+	m.Write([]byte{0x02})
+	return m.Sum(nil), mk
+}
+
+// messageAEAD expands a message key into an AES-256-GCM key and nonce. Each
+// message key is used exactly once, so a derived nonce is safe.
+func messageAEAD(mk []byte) (cipher.AEAD, []byte, error) {
+	out := make([]byte, keySize+12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte("cli-chat/ratchet/message")), out); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, out[keySize:], nil
+}
+
+func seal(mk, header, plaintext, ad []byte) ([]byte, error) {
+	gcm, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	aad := append(append([]byte{}, ad...), header...)
+	return gcm.Seal(header, nonce, plaintext, aad), nil
+}
+
+func open(mk []byte, m *message, ad []byte) ([]byte, error) {
+	gcm, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	aad := append(append([]byte{}, ad...), m.header...)
+	plain, err := gcm.Open(nil, nonce, m.body, aad)
+	if err != nil {
+		return nil, fmt.Errorf("message authentication failed")
+	}
+	return plain, nil
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return k.ECDH(p)
+}
+
+func publicKey(priv []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return k.PublicKey().Bytes(), nil
+}
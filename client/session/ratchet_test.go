@@ -0,0 +1,268 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// handshake starts a session from alice to bob's bundle, with a one-time
+// prekey, and has bob answer the first message the way Manager.Decrypt does
+func handshake(t *testing.T) (alice, bob *State) {
+	t.Helper()
+	aliceID, bobID := newIdentity(t), newIdentity(t)
+	bundle := oneTimeBundle(t, bobID)
+	alice, err := Initiate(aliceID, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := encrypt(t, alice, "hello")
+	m, err := parseMessage(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob, err = respond(bobID, m.prekey); err != nil {
+		t.Fatal(err)
+	}
+	if got := decrypt(t, bob, first); got != "hello" {
+		t.Fatalf("first message = %q", got)
+	}
+	return alice, bob
+}
+
+func newIdentity(t *testing.T) *Identity {
+	t.Helper()
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// oneTimeBundle is id's bundle with one of its one-time prekeys
+func oneTimeBundle(t *testing.T, id *Identity) Bundle {
+	t.Helper()
+	bundle, err := id.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prekeys, err := id.GenerateOneTimePrekeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.OneTimePrekey = &prekeys[0]
+	return bundle
+}
+
+func encrypt(t *testing.T, s *State, text string) []byte {
+	t.Helper()
+	msg, err := s.Encrypt([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func decrypt(t *testing.T, s *State, msg []byte) string {
+	t.Helper()
+	plain, err := s.Decrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+// snapshot is the persisted form of a state, to compare it before and after
+func snapshot(t *testing.T, s *State) string {
+	t.Helper()
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRoundTrip(t *testing.T) {
+	alice, bob := handshake(t)
+	if alice.Pending == nil {
+		t.Fatal("initiator stopped sending the handshake before a reply")
+	}
+	// Runs of messages in each direction, so every turn is a DH ratchet step
+	for turn := 0; turn < 4; turn++ {
+		from, to := alice, bob
+		if turn%2 == 0 {
+			from, to = bob, alice
+		}
+		for i := 0; i < 3; i++ {
+			text := fmt.Sprintf("turn %d message %d", turn, i)
+			if got := decrypt(t, to, encrypt(t, from, text)); got != text {
+				t.Fatalf("got %q, want %q", got, text)
+			}
+		}
+	}
+	if alice.Pending != nil {
+		t.Error("initiator still sends the handshake after a reply")
+	}
+}
+
+func TestResponderWaitsForFirstMessage(t *testing.T) {
+	aliceID, bobID := newIdentity(t), newIdentity(t)
+	alice, err := Initiate(aliceID, oneTimeBundle(t, bobID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMessage(encrypt(t, alice, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := respond(bobID, m.prekey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Encrypt([]byte("too early")); err == nil {
+		t.Error("responder encrypted before the first message arrived")
+	}
+	if _, ok := bobID.OneTimePrekeys[m.prekey.OneTimeID]; ok {
+		t.Error("one-time prekey was not consumed")
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	alice, bob := handshake(t)
+	var msgs [][]byte
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, encrypt(t, alice, fmt.Sprint(i)))
+	}
+	for _, i := range []int{4, 1, 0, 3} {
+		if got := decrypt(t, bob, msgs[i]); got != fmt.Sprint(i) {
+			t.Fatalf("message %d decrypted to %q", i, got)
+		}
+	}
+	if len(bob.Skipped) != 1 {
+		t.Fatalf("%d skipped keys left, want 1", len(bob.Skipped))
+	}
+	// A skipped key is deleted once used
+	if _, err := bob.Decrypt(msgs[1]); err == nil {
+		t.Error("replayed message decrypted")
+	}
+
+	// A message from the previous sending chain, after a DH ratchet step
+	decrypt(t, alice, encrypt(t, bob, "reply"))
+	later := encrypt(t, alice, "after the reply")
+	if got := decrypt(t, bob, later); got != "after the reply" {
+		t.Fatalf("got %q", got)
+	}
+	if got := decrypt(t, bob, msgs[2]); got != "2" {
+		t.Fatalf("late message decrypted to %q", got)
+	}
+	if len(bob.Skipped) != 0 {
+		t.Errorf("%d skipped keys left, want 0", len(bob.Skipped))
+	}
+}
+
+func TestMaxSkip(t *testing.T) {
+	alice, bob := handshake(t)
+	// bob has received message 0; msgs[n] is alice's message n
+	msgs := [][]byte{nil}
+	for n := 1; n <= maxSkip+2; n++ {
+		msgs = append(msgs, encrypt(t, alice, fmt.Sprint(n)))
+	}
+	before := snapshot(t, bob)
+	if _, err := bob.Decrypt(msgs[maxSkip+2]); err == nil {
+		t.Fatalf("decrypted a message %d ahead", maxSkip+1)
+	}
+	if snapshot(t, bob) != before {
+		t.Fatal("rejected message changed the state")
+	}
+	if got := decrypt(t, bob, msgs[maxSkip+1]); got != fmt.Sprint(maxSkip+1) {
+		t.Fatalf("got %q", got)
+	}
+	if len(bob.Skipped) != maxSkip {
+		t.Errorf("%d skipped keys, want %d", len(bob.Skipped), maxSkip)
+	}
+	if got := decrypt(t, bob, msgs[1]); got != "1" {
+		t.Errorf("oldest skipped message decrypted to %q", got)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	alice, bob := handshake(t)
+	decrypt(t, alice, encrypt(t, bob, "reply"))
+	msg := encrypt(t, alice, "tamper with me")
+
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"flags", 1},
+		{"ratchet key", 2},
+		{"previous chain length", 2 + keySize + 3},
+		{"message number", 2 + keySize + 4 + 3},
+		{"ciphertext", fixedHeader},
+		{"tag", len(msg) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := append([]byte{}, msg...)
+			bad[tt.offset] ^= 1
+			before := snapshot(t, bob)
+			if _, err := bob.Decrypt(bad); err == nil {
+				t.Fatal("tampered message decrypted")
+			}
+			if snapshot(t, bob) != before {
+				t.Error("tampered message changed the state")
+			}
+		})
+	}
+	if got := decrypt(t, bob, msg); got != "tamper with me" {
+		t.Errorf("got %q after the tampered copies", got)
+	}
+}
+
+func TestTrustedInitiator(t *testing.T) {
+	dir := t.TempDir()
+	bob, err := Open(filepath.Join(dir, "bob_identity.json"), filepath.Join(dir, "sessions"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID := newIdentity(t)
+	bundle := oneTimeBundle(t, bobID)
+	if err := bob.SaveIdentity(bobID); err != nil {
+		t.Fatal(err)
+	}
+	aliceID, malloryID := newIdentity(t), newIdentity(t)
+	aliceBundle, err := aliceID.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mallory starts a session under her own identity key, claiming to be
+	// the device whose signed bundle is alice's
+	mallory, err := Initiate(malloryID, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt("alice", encrypt(t, mallory, "it's alice"), aliceBundle.CheckIdentity); err == nil {
+		t.Fatal("accepted a handshake under an identity key alice didn't sign")
+	}
+	if bob.HasSession("alice") {
+		t.Error("rejected handshake started a session")
+	}
+	if _, ok := bob.Identity().OneTimePrekeys[bundle.OneTimePrekey.ID]; !ok {
+		t.Error("rejected handshake used up the one-time prekey")
+	}
+
+	alice, err := Initiate(aliceID, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := bob.Decrypt("alice", encrypt(t, alice, "hello"), aliceBundle.CheckIdentity)
+	if err != nil {
+		t.Fatalf("rejected alice's handshake: %v", err)
+	}
+	if !bytes.Equal(plain, []byte("hello")) || !bob.HasSession("alice") {
+		t.Errorf("got %q, session %v", plain, bob.HasSession("alice"))
+	}
+}
@@ -0,0 +1,372 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxPrevious is how many superseded sessions per peer are kept for late messages
+const maxPrevious = 3
+
+// peerRegex matches session names: a username, with ".<device id>" for a
+// peer's extra devices
+var peerRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+(\.[0-9]+)?$`)
+
+// Manager owns the local identity and every ratchet session, and persists
+// them after each change so sessions survive restarts.
+type Manager struct {
+	mu           sync.Mutex
+	identityPath string
+	dir          string
+	sealer       Sealer
+	identity     *Identity
+}
+
+// Sealer encrypts state files at rest. The name identifies the file, so a
+// sealer can bind the contents to it. Open returns files written before
+// sealing was turned on as they are.
+type Sealer interface {
+	Seal(name string, plaintext []byte) ([]byte, error)
+	Open(name string, data []byte) ([]byte, error)
+}
+
+// sessionFile is the on-disk record of the sessions with one peer device
+type sessionFile struct {
+	Current  *State   `json:"current"`
+	Previous []*State `json:"previous,omitempty"`
+}
+
+// Open loads the identity at identityPath, if there is one, and keeps
+// per-peer session files in dir. The identity and sessions hold private
+// keys; with a sealer they are written encrypted, and files left in
+// plaintext by earlier versions are sealed right away. A nil sealer keeps
+// them in plaintext.
+func Open(identityPath, dir string, sealer Sealer) (*Manager, error) {
+	m := &Manager{identityPath: identityPath, dir: dir, sealer: sealer}
+	data, err := m.readFile(identityPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, m.sealAll()
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.identity = &Identity{}
+	if err := json.Unmarshal(data, m.identity); err != nil {
+		return nil, fmt.Errorf("corrupt identity file %s: %w", identityPath, err)
+	}
+	return m, m.sealAll()
+}
+
+// sealAll rewrites plaintext state files through the sealer
+func (m *Manager) sealAll() error {
+	if m.sealer == nil {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range append(paths, m.identityPath) {
+		raw, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(raw) == 0 || raw[0] != '{' {
+			continue
+		}
+		if err := m.writeFile(p, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export returns the identity and every session as plaintext JSON, keyed
+// by peer, for backups
+func (m *Manager) Export() (json.RawMessage, map[string]json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var identity json.RawMessage
+	if m.identity != nil {
+		var err error
+		if identity, err = json.Marshal(m.identity); err != nil {
+			return nil, nil, err
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sessions := map[string]json.RawMessage{}
+	for _, p := range paths {
+		peer := strings.TrimSuffix(filepath.Base(p), ".json")
+		if !peerRegex.MatchString(peer) {
+			continue
+		}
+		data, err := m.readFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		sessions[peer] = data
+	}
+	return identity, sessions, nil
+}
+
+// Import stores an identity and sessions from Export, replacing any with
+// the same names
+func (m *Manager) Import(identity json.RawMessage, sessions map[string]json.RawMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for peer, data := range sessions {
+		var f sessionFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("corrupt session %q: %w", peer, err)
+		}
+		if err := m.save(peer, &f); err != nil {
+			return err
+		}
+	}
+	if identity == nil {
+		return nil
+	}
+	id := &Identity{}
+	if err := json.Unmarshal(identity, id); err != nil {
+		return fmt.Errorf("corrupt identity: %w", err)
+	}
+	if err := m.writeJSON(m.identityPath, id); err != nil {
+		return err
+	}
+	m.identity = id
+	return nil
+}
+
+// Identity returns the local identity, or nil if none has been created
+func (m *Manager) Identity() *Identity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.identity
+}
+
+// SaveIdentity replaces and persists the local identity
+func (m *Manager) SaveIdentity(id *Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identity = id
+	return m.writeJSON(m.identityPath, id)
+}
+
+// HasSession reports whether we can send to peer without a new handshake
+func (m *Manager) HasSession(peer string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.load(peer)
+	return err == nil && f.Current != nil && f.Current.SendChain != nil
+}
+
+// Start begins a new session with peer from their (verified) bundle
+func (m *Manager) Start(peer string, remote Bundle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.identity == nil {
+		return errors.New("no local identity")
+	}
+	state, err := Initiate(m.identity, remote)
+	if err != nil {
+		return err
+	}
+	f, err := m.load(peer)
+	if err != nil {
+		return err
+	}
+	f.push(state)
+	return m.save(peer, f)
+}
+
+// Encrypt seals plaintext for peer on the current session
+func (m *Manager) Encrypt(peer string, plaintext []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.load(peer)
+	if err != nil {
+		return nil, err
+	}
+	if f.Current == nil {
+		return nil, ErrNoSession
+	}
+	out, err := f.Current.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return out, m.save(peer, f)
+}
+
+// Decrypt opens a ratchet message from peer. A prekey message for a
+// handshake we haven't seen starts a new session and makes it current, but
+// only once trusted accepts the identity key the initiator claims; anyone
+// can send a handshake, so it proves nothing on its own.
+func (m *Manager) Decrypt(peer string, msg []byte, trusted func(identityKey []byte) error) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parsed, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	f, err := m.load(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range f.all() {
+		if parsed.prekey != nil && !bytes.Equal(s.BaseKey, parsed.prekey.BaseKey) {
+			continue
+		}
+		plain, err := s.Decrypt(msg)
+		if err != nil {
+			continue
+		}
+		return plain, m.save(peer, f)
+	}
+	if parsed.prekey == nil {
+		return nil, ErrNoSession
+	}
+
+	if m.identity == nil {
+		return nil, errors.New("received a session handshake but no local identity exists")
+	}
+	if err := trusted(parsed.prekey.IdentityKey); err != nil {
+		return nil, fmt.Errorf("rejected session handshake: %w", err)
+	}
+	// Work on a copy so a bad handshake doesn't burn a one-time prekey
+	local := *m.identity
+	local.OneTimePrekeys = make(map[uint32][]byte, len(m.identity.OneTimePrekeys))
+	for k, v := range m.identity.OneTimePrekeys {
+		local.OneTimePrekeys[k] = v
+	}
+	state, err := respond(&local, parsed.prekey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := state.Decrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+	f.push(state)
+	if err := m.writeJSON(m.identityPath, &local); err != nil {
+		return nil, err
+	}
+	m.identity = &local
+	return plain, m.save(peer, f)
+}
+
+func (f *sessionFile) all() []*State {
+	out := []*State{}
+	if f.Current != nil {
+		out = append(out, f.Current)
+	}
+	return append(out, f.Previous...)
+}
+
+func (f *sessionFile) push(s *State) {
+	if f.Current != nil {
+		f.Previous = append([]*State{f.Current}, f.Previous...)
+		if len(f.Previous) > maxPrevious {
+			f.Previous = f.Previous[:maxPrevious]
+		}
+	}
+	f.Current = s
+}
+
+func (m *Manager) path(peer string) (string, error) {
+	if !peerRegex.MatchString(peer) {
+		return "", fmt.Errorf("invalid username %q", peer)
+	}
+	return filepath.Join(m.dir, peer+".json"), nil
+}
+
+func (m *Manager) load(peer string) (*sessionFile, error) {
+	p, err := m.path(peer)
+	if err != nil {
+		return nil, err
+	}
+	f := &sessionFile{}
+	data, err := m.readFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("corrupt session file %s: %w", p, err)
+	}
+	return f, nil
+}
+
+func (m *Manager) save(peer string, f *sessionFile) error {
+	p, err := m.path(peer)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	return m.writeJSON(p, f)
+}
+
+// sealedName is the name a file's contents are sealed under: the identity
+// file, or sessions/<peer>.json
+func (m *Manager) sealedName(path string) string {
+	if path == m.identityPath {
+		return filepath.Base(path)
+	}
+	return "sessions/" + filepath.Base(path)
+}
+
+// readFile reads a state file, opening it with the sealer
+func (m *Manager) readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if m.sealer == nil {
+		if len(data) > 0 && data[0] != '{' {
+			return nil, fmt.Errorf("%s is encrypted, and its storage key isn't unlocked", path)
+		}
+		return data, nil
+	}
+	return m.sealer.Open(m.sealedName(path), data)
+}
+
+// writeJSON replaces path atomically so a crash never leaves a torn state file
+func (m *Manager) writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.writeFile(path, data)
+}
+
+// writeFile seals data, if there is a sealer, and replaces path with it
+func (m *Manager) writeFile(path string, data []byte) error {
+	if m.sealer != nil {
+		var err error
+		if data, err = m.sealer.Seal(m.sealedName(path), data); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
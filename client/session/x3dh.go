@@ -0,0 +1,296 @@
+// Package session implements forward-secret conversations: an X3DH-style
+// handshake against a peer's published prekey bundle, followed by a double
+// ratchet that derives a fresh key for every message.
+package session
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Identity holds the local X25519 private keys other users start sessions
+// against. The matching public keys are published as a Bundle.
+type Identity struct {
+	IdentityKey    []byte            `json:"identity_key"`
+	SignedPrekeyID uint32            `json:"signed_prekey_id"`
+	SignedPrekey   []byte            `json:"signed_prekey"`
+	OneTimePrekeys map[uint32][]byte `json:"one_time_prekeys"`
+	NextPrekeyID   uint32            `json:"next_prekey_id"`
+
+	// The signed prekey replaced by the last rotation, kept so handshakes
+	// started from a bundle fetched just before the rotation still succeed.
+	PreviousPrekeyID uint32 `json:"previous_prekey_id,omitempty"`
+	PreviousPrekey   []byte `json:"previous_prekey,omitempty"`
+}
+
+// Prekey is a public prekey and the id it is published under
+type Prekey struct {
+	ID  uint32
+	Key []byte
+}
+
+// Bundle is what a peer needs to start a session with us. OneTimePrekey is
+// optional; the server hands each one out at most once.
+type Bundle struct {
+	IdentityKey    []byte
+	SignedPrekeyID uint32
+	SignedPrekey   []byte
+	OneTimePrekey  *Prekey
+}
+
+// bundleContext separates prekey signatures from any other use of the signing key
+const bundleContext = "cli-chat/prekey-bundle/v1"
+
+// SignedData returns the bytes the bundle owner signs with their long-term
+// key, binding the identity key to the signed prekey.
+func (b Bundle) SignedData() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(bundleContext)
+	buf.Write(b.IdentityKey)
+	binary.Write(&buf, binary.BigEndian, b.SignedPrekeyID)
+	buf.Write(b.SignedPrekey)
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+// CheckIdentity accepts the identity key a handshake claims only if it is
+// the one in b. With b a bundle whose signature the caller has checked, it
+// serves as the trusted check of Manager.Decrypt.
+func (b Bundle) CheckIdentity(identityKey []byte) error {
+	if !bytes.Equal(b.IdentityKey, identityKey) {
+		return errors.New("identity key is not the one in the signed prekey bundle")
+	}
+	return nil
+}
+
+// NewIdentity generates an identity key and a signed prekey
+func NewIdentity() (*Identity, error) {
+	ik, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{
+		IdentityKey:    ik.Bytes(),
+		OneTimePrekeys: map[uint32][]byte{},
+		NextPrekeyID:   1,
+	}
+	if err := id.RotateSignedPrekey(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// RotateSignedPrekey replaces the signed prekey. Sessions already started
+// against the old one are unaffected.
+func (id *Identity) RotateSignedPrekey() error {
+	spk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	id.PreviousPrekeyID, id.PreviousPrekey = id.SignedPrekeyID, id.SignedPrekey
+	id.SignedPrekeyID = id.nextID()
+	id.SignedPrekey = spk.Bytes()
+	return nil
+}
+
+// GenerateOneTimePrekeys adds n one-time prekeys and returns their public halves
+func (id *Identity) GenerateOneTimePrekeys(n int) ([]Prekey, error) {
+	out := make([]Prekey, 0, n)
+	for i := 0; i < n; i++ {
+		k, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyID := id.nextID()
+		id.OneTimePrekeys[keyID] = k.Bytes()
+		out = append(out, Prekey{ID: keyID, Key: k.PublicKey().Bytes()})
+	}
+	return out, nil
+}
+
+// Bundle returns the public half of the identity, without one-time prekeys
+func (id *Identity) Bundle() (Bundle, error) {
+	ik, err := ecdh.X25519().NewPrivateKey(id.IdentityKey)
+	if err != nil {
+		return Bundle{}, err
+	}
+	spk, err := ecdh.X25519().NewPrivateKey(id.SignedPrekey)
+	if err != nil {
+		return Bundle{}, err
+	}
+	return Bundle{
+		IdentityKey:    ik.PublicKey().Bytes(),
+		SignedPrekeyID: id.SignedPrekeyID,
+		SignedPrekey:   spk.PublicKey().Bytes(),
+	}, nil
+}
+
+func (id *Identity) nextID() uint32 {
+	if id.NextPrekeyID == 0 {
+		id.NextPrekeyID = 1 // 0 means "no one-time prekey" on the wire
+	}
+	n := id.NextPrekeyID
+	id.NextPrekeyID++
+	return n
+}
+
+// prekeyHeader is carried by every message the initiator sends until the
+// responder has replied, so the responder can rebuild the shared secret.
+type prekeyHeader struct {
+	IdentityKey    []byte `json:"identity_key"`
+	BaseKey        []byte `json:"base_key"`
+	SignedPrekeyID uint32 `json:"signed_prekey_id"`
+	OneTimeID      uint32 `json:"one_time_id"`
+}
+
+// Initiate runs the initiator side of the handshake against a peer's bundle.
+// The caller must have verified the bundle signature first.
+func Initiate(local *Identity, remote Bundle) (*State, error) {
+	curve := ecdh.X25519()
+	ika, err := curve.NewPrivateKey(local.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	ikb, err := curve.NewPublicKey(remote.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	spkb, err := curve.NewPublicKey(remote.SignedPrekey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed prekey: %w", err)
+	}
+	eka, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	dhs := [][]byte{}
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  *ecdh.PublicKey
+	}{{ika, spkb}, {eka, ikb}, {eka, spkb}} {
+		out, err := pair.priv.ECDH(pair.pub)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	header := &prekeyHeader{
+		IdentityKey:    ika.PublicKey().Bytes(),
+		BaseKey:        eka.PublicKey().Bytes(),
+		SignedPrekeyID: remote.SignedPrekeyID,
+	}
+	if remote.OneTimePrekey != nil {
+		opkb, err := curve.NewPublicKey(remote.OneTimePrekey.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid one-time prekey: %w", err)
+		}
+		out, err := eka.ECDH(opkb)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+		header.OneTimeID = remote.OneTimePrekey.ID
+	}
+
+	sk, err := deriveSharedSecret(dhs)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, header.IdentityKey...), remote.IdentityKey...)
+	return initInitiator(sk, ad, remote.SignedPrekey, header)
+}
+
+// respond runs the responder side of the handshake for a prekey message.
+// It consumes the one-time prekey, so the caller must persist local after.
+func respond(local *Identity, header *prekeyHeader) (*State, error) {
+	var spk []byte
+	switch header.SignedPrekeyID {
+	case local.SignedPrekeyID:
+		spk = local.SignedPrekey
+	case local.PreviousPrekeyID:
+		spk = local.PreviousPrekey
+	}
+	if header.SignedPrekeyID == 0 || spk == nil {
+		return nil, fmt.Errorf("unknown signed prekey %d", header.SignedPrekeyID)
+	}
+	curve := ecdh.X25519()
+	ikb, err := curve.NewPrivateKey(local.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	spkb, err := curve.NewPrivateKey(spk)
+	if err != nil {
+		return nil, err
+	}
+	ika, err := curve.NewPublicKey(header.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	eka, err := curve.NewPublicKey(header.BaseKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base key: %w", err)
+	}
+
+	dhs := [][]byte{}
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  *ecdh.PublicKey
+	}{{spkb, ika}, {ikb, eka}, {spkb, eka}} {
+		out, err := pair.priv.ECDH(pair.pub)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	if header.OneTimeID != 0 {
+		opk, ok := local.OneTimePrekeys[header.OneTimeID]
+		if !ok {
+			return nil, fmt.Errorf("one-time prekey %d already used or unknown", header.OneTimeID)
+		}
+		priv, err := curve.NewPrivateKey(opk)
+		if err != nil {
+			return nil, err
+		}
+		out, err := priv.ECDH(eka)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	sk, err := deriveSharedSecret(dhs)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, header.IdentityKey...), ikb.PublicKey().Bytes()...)
+	state := initResponder(sk, ad, spk, header.BaseKey)
+
+	if header.OneTimeID != 0 {
+		delete(local.OneTimePrekeys, header.OneTimeID)
+	}
+	return state, nil
+}
+
+func deriveSharedSecret(dhs [][]byte) ([]byte, error) {
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		ikm = append(ikm, dh...)
+	}
+	sk := make([]byte, 32)
+	r := hkdf.New(sha256.New, ikm, make([]byte, 32), []byte("cli-chat/x3dh"))
+	if _, err := io.ReadFull(r, sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
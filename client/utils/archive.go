@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArchivedMessage is the plaintext of a message kept for history
+type ArchivedMessage struct {
+	Body   []byte    `json:"body"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// Archive keeps the plaintext of forward-secret messages exchanged with one
+// contact, by server message ID, in keys/<owner>_archive/<peer>.json. Their
+// ratchet keys are deleted once used, so the server's copy can't be
+// decrypted again; `history` reads them from here instead. The file is
+// sealed under the storage key. Without one (the key file is in plaintext)
+// nothing is kept, rather than leaving messages readable on disk.
+type Archive struct {
+	mu       sync.Mutex
+	path     string
+	key      *StorageKey
+	Messages map[uint]ArchivedMessage `json:"messages"`
+}
+
+// LoadArchive reads the archive of the conversation between owner and peer
+func LoadArchive(owner, peer string, key *StorageKey) (*Archive, error) {
+	a := &Archive{
+		path:     filepath.Join(fmt.Sprintf("keys/%s_archive", owner), peer+".json"),
+		key:      key,
+		Messages: map[uint]ArchivedMessage{},
+	}
+	if key == nil {
+		return a, nil
+	}
+	data, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = key.Open(a.name(), data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("corrupt archive %s: %w", a.path, err)
+	}
+	if a.Messages == nil {
+		a.Messages = map[uint]ArchivedMessage{}
+	}
+	return a, nil
+}
+
+// name is what the file's contents are sealed under
+func (a *Archive) name() string {
+	return "archive/" + filepath.Base(a.path)
+}
+
+// Keeping reports whether messages added to the archive are kept
+func (a *Archive) Keeping() bool {
+	return a.key != nil
+}
+
+// Add records the plaintext of message id
+func (a *Archive) Add(id uint, body []byte, sentAt time.Time) {
+	if a.key == nil || id == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Messages[id] = ArchivedMessage{Body: body, SentAt: sentAt}
+}
+
+// Get returns the plaintext kept for message id
+func (a *Archive) Get(id uint) (ArchivedMessage, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.Messages[id]
+	return m, ok
+}
+
+// Save seals the archive and writes it back to disk
+func (a *Archive) Save() error {
+	if a.key == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if data, err = a.key.Seal(a.name(), data); err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// BackupType is the PEM block type of a backup written by export-key
+const BackupType = "CLI-CHAT KEY BACKUP"
+
+// BackupVersion is the version of the Backup layout written by this client.
+// Import refuses newer versions rather than silently dropping fields.
+// Version 2 added the key log state.
+const BackupVersion = 2
+
+// Backup is everything needed to use an account on another machine. It is
+// only ever written to disk encrypted, see EncryptBackup.
+type Backup struct {
+	Version    int       `json:"version"`
+	Username   string    `json:"username"`
+	ServerURL  string    `json:"server_url"`
+	DeviceID   uint      `json:"device_id"`
+	ExportedAt time.Time `json:"exported_at"`
+
+	PrivateKey  string           `json:"private_key"`            // plaintext private key PEM
+	RetiredKeys map[int64]string `json:"retired_keys,omitempty"` // retirement time (unix) -> PEM
+	Contacts    json.RawMessage  `json:"contacts,omitempty"`     // the contact store, pins included
+	KeyLog      json.RawMessage  `json:"key_log,omitempty"`      // pinned key log key and largest verified tree head
+
+	// Session state, so conversations continue on the new machine. Using
+	// the old machine afterwards desynchronizes its sessions.
+	Identity json.RawMessage            `json:"identity,omitempty"`
+	Sessions map[string]json.RawMessage `json:"sessions,omitempty"`
+}
+
+// EncryptBackup serializes b and seals it under passphrase
+func EncryptBackup(b *Backup, passphrase string) ([]byte, error) {
+	b.Version = BackupVersion
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"Version": strconv.Itoa(BackupVersion)}
+	return sealPEM(BackupType, headers, plain, passphrase)
+}
+
+// DecryptBackup opens a backup written by EncryptBackup
+func DecryptBackup(data []byte, passphrase string) (*Backup, error) {
+	plain, _, err := openPEM(data, BackupType, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var b Backup
+	if err := json.Unmarshal(plain, &b); err != nil {
+		return nil, fmt.Errorf("corrupt backup: %w", err)
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d, update the client", b.Version)
+	}
+	if b.Username == "" || b.PrivateKey == "" {
+		return nil, fmt.Errorf("backup is missing the username or private key")
+	}
+	return &b, nil
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Contact is what we remember locally about another user. The first key we
+// see for a contact is pinned; later keys must be accepted explicitly.
+type Contact struct {
+	Username    string    `json:"username"`
+	PublicKey   string    `json:"public_key,omitempty"` // pinned key (PEM)
+	Fingerprint string    `json:"fingerprint"`          // fingerprint of the pinned key
+	FirstSeen   time.Time `json:"first_seen,omitempty"`
+	Verified    bool      `json:"verified"` // pinned key was verified out of band
+	VerifiedAt  time.Time `json:"verified_at,omitempty"`
+
+	// Devices pins the key fingerprint of each extra device by device ID.
+	// The primary device is pinned by Fingerprint above.
+	Devices map[uint]string `json:"devices,omitempty"`
+}
+
+// PinStatus is the result of checking a key against the pinned one
+type PinStatus int
+
+const (
+	PinNew     PinStatus = iota // no key was pinned; this one is now
+	PinMatch                    // same key as the pinned one
+	PinChanged                  // differs from the pinned key
+)
+
+// ContactStore is the local contact list, kept in keys/<owner>_contacts.json
+type ContactStore struct {
+	path     string
+	Contacts map[string]*Contact `json:"contacts"`
+}
+
+// LoadContacts reads the contact store of owner, or returns an empty one
+func LoadContacts(owner string) (*ContactStore, error) {
+	s := &ContactStore{
+		path:     fmt.Sprintf("keys/%s_contacts.json", owner),
+		Contacts: map[string]*Contact{},
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("corrupt contact store %s: %w", s.path, err)
+	}
+	if s.Contacts == nil {
+		s.Contacts = map[string]*Contact{}
+	}
+	return s, nil
+}
+
+// Save writes the store back to disk
+func (s *ContactStore) Save() error {
+	if err := os.MkdirAll("keys", 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// get returns the contact for username, creating it if needed
+func (s *ContactStore) get(username string) *Contact {
+	c, ok := s.Contacts[username]
+	if !ok {
+		c = &Contact{Username: username}
+		s.Contacts[username] = c
+	}
+	return c
+}
+
+// CheckPin compares pubPEM with the key pinned for username. The first key
+// seen is pinned (trust on first use); a different key is reported as
+// PinChanged and left unpinned until AcceptKey is called.
+func (s *ContactStore) CheckPin(username, pubPEM string) (PinStatus, error) {
+	fp, err := Fingerprint(pubPEM)
+	if err != nil {
+		return PinChanged, err
+	}
+	c := s.get(username)
+	switch {
+	case c.Fingerprint == "":
+		c.PublicKey = pubPEM
+		c.Fingerprint = fp
+		c.FirstSeen = time.Now()
+		return PinNew, nil
+	case c.Fingerprint == fp:
+		if c.PublicKey == "" {
+			c.PublicKey = pubPEM // contact verified before keys were pinned
+		}
+		return PinMatch, nil
+	default:
+		return PinChanged, nil
+	}
+}
+
+// AcceptKey pins pubPEM for username in place of the previous key. The
+// verified mark belonged to the old key, so it is cleared.
+func (s *ContactStore) AcceptKey(username, pubPEM string) error {
+	fp, err := Fingerprint(pubPEM)
+	if err != nil {
+		return err
+	}
+	c := s.get(username)
+	if c.Fingerprint == fp {
+		return nil
+	}
+	if c.FirstSeen.IsZero() {
+		c.FirstSeen = time.Now()
+	}
+	c.PublicKey = pubPEM
+	c.Fingerprint = fp
+	c.Verified = false
+	c.VerifiedAt = time.Time{}
+	return nil
+}
+
+// CheckDevice compares the key of one of username's extra devices with the
+// one pinned for that device ID, pinning it if the device is new. Device keys
+// never change, so PinChanged means the server substituted a key.
+func (s *ContactStore) CheckDevice(username string, deviceID uint, pubPEM string) (PinStatus, error) {
+	fp, err := Fingerprint(pubPEM)
+	if err != nil {
+		return PinChanged, err
+	}
+	c := s.get(username)
+	if c.Devices == nil {
+		c.Devices = map[uint]string{}
+	}
+	pinned, ok := c.Devices[deviceID]
+	switch {
+	case !ok:
+		c.Devices[deviceID] = fp
+		return PinNew, nil
+	case pinned == fp:
+		return PinMatch, nil
+	default:
+		return PinChanged, nil
+	}
+}
+
+// PinnedFingerprint returns the fingerprint pinned for username, if any
+func (s *ContactStore) PinnedFingerprint(username string) string {
+	if c, ok := s.Contacts[username]; ok {
+		return c.Fingerprint
+	}
+	return ""
+}
+
+// IsVerified reports whether username was verified with the key whose
+// fingerprint is given. A verification doesn't carry over to a new key.
+func (s *ContactStore) IsVerified(username, fingerprint string) bool {
+	c, ok := s.Contacts[username]
+	return ok && c.Verified && c.Fingerprint == fingerprint
+}
+
+// MarkVerified records that the user compared the pinned key of username
+// out of band
+func (s *ContactStore) MarkVerified(username string) {
+	c := s.get(username)
+	c.Verified = true
+	c.VerifiedAt = time.Now()
+}
+
+// ClearVerified removes the verified mark from username
+func (s *ContactStore) ClearVerified(username string) {
+	c := s.get(username)
+	c.Verified = false
+	c.VerifiedAt = time.Time{}
+}
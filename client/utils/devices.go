@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// PrimaryDevice is the device ID of the key the account was registered with
+const PrimaryDevice uint = 0
+
+// Device is one of a user's devices, each with its own key pair
+type Device struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	KeyType   string `json:"key_type"`
+	CreatedAt string `json:"created_at"`
+	// Signature by the primary key over the device statement; empty for
+	// the primary device
+	Certificate string `json:"certificate,omitempty"`
+	// Proof that PublicKey is in the key transparency log
+	Transparency *KeyLogProof `json:"transparency,omitempty"`
+}
+
+// localDevice is this machine's device record, kept in keys/<username>_device.json
+type localDevice struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// CurrentDevice returns the device ID this client runs as, set by login
+func CurrentDevice() uint {
+	id, err := strconv.ParseUint(os.Getenv("DEVICE_ID"), 10, 64)
+	if err != nil {
+		return PrimaryDevice
+	}
+	return uint(id)
+}
+
+// LoadLocalDevice returns the device ID registered on this machine for
+// username, or PrimaryDevice if the machine never registered one
+func LoadLocalDevice(username string) (uint, error) {
+	data, err := os.ReadFile(fmt.Sprintf("keys/%s_device.json", username))
+	if errors.Is(err, os.ErrNotExist) {
+		return PrimaryDevice, nil
+	}
+	if err != nil {
+		return PrimaryDevice, err
+	}
+	var d localDevice
+	if err := json.Unmarshal(data, &d); err != nil {
+		return PrimaryDevice, fmt.Errorf("corrupt device file: %w", err)
+	}
+	return d.ID, nil
+}
+
+// SaveLocalDevice records the device ID registered on this machine
+func SaveLocalDevice(username string, device Device) error {
+	data, err := json.MarshalIndent(localDevice{ID: device.ID, Name: device.Name}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fmt.Sprintf("keys/%s_device.json", username), data, 0600)
+}
+
+// GetDevices calls /auth/devices?username=<username>. The primary device is
+// always first. Fails if any key isn't in the key transparency log.
+func GetDevices(username string, jwtToken string) ([]Device, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetQueryParam("username", username).
+		Get(BaseURL + "/auth/devices")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch devices: %s", resp.String())
+	}
+
+	var result struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse devices: %w", err)
+	}
+	for _, d := range result.Devices {
+		if err := VerifyKeyLog(username, d.ID, d.PublicKey, d.Transparency); err != nil {
+			return nil, fmt.Errorf("key transparency check failed for %s's device %d: %w", username, d.ID, err)
+		}
+	}
+	return result.Devices, nil
+}
+
+// DeviceRegistration is the body of POST /auth/devices. Certificate is the
+// primary key's signature over the device statement; Signature and KeyProof
+// answer a device challenge with the new key.
+type DeviceRegistration struct {
+	Name        string `json:"name"`
+	PublicKey   string `json:"public_key"`
+	Certificate string `json:"certificate"`
+	Challenge   string `json:"challenge"`
+	Signature   string `json:"signature"`
+	KeyProof    string `json:"key_proof"`
+}
+
+// RegisterDevice adds a device with its own public key to the account
+func RegisterDevice(registration DeviceRegistration, jwtToken string) (*Device, error) {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetBody(registration).
+		Post(BaseURL + "/auth/devices")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to register device: %s", resp.String())
+	}
+
+	var result struct {
+		Device Device `json:"device"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result.Device, nil
+}
+
+// RemoveDevice deletes one of the caller's devices
+func RemoveDevice(id uint, jwtToken string) error {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		Delete(fmt.Sprintf("%s/auth/devices/%d", BaseURL, id))
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("failed to remove device: %s", resp.String())
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrNoEscrow is returned when no escrow is stored for the device
+var ErrNoEscrow = errors.New("no key escrow stored")
+
+// recoveryAlphabet is Crockford's base32: no I, L, O or U to misread
+const recoveryAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// recoveryCodeLength gives 125 bits of entropy, far beyond guessing even
+// for someone holding the escrow blob
+const recoveryCodeLength = 25
+
+// GenerateRecoveryCode returns a random code in groups of five, e.g.
+// "7K2QD-..."; it is the only secret protecting the key escrow
+func GenerateRecoveryCode() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(recoveryAlphabet)))
+	for i := 0; i < recoveryCodeLength; i++ {
+		if i > 0 && i%5 == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(recoveryAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// NormalizeRecoveryCode undoes the ways a written-down code gets mangled:
+// case, dashes, spaces and look-alike letters
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1").Replace(code)
+	return code
+}
+
+// StoreEscrow uploads the encrypted escrow blob of this device
+func StoreEscrow(blob []byte, jwtToken string) error {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetHeader("X-Device-ID", strconv.FormatUint(uint64(CurrentDevice()), 10)).
+		SetBody(map[string]string{"blob": string(blob)}).
+		Post(BaseURL + "/auth/escrow")
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("failed to store escrow: %s", resp.String())
+	}
+	return nil
+}
+
+// GetEscrow fetches the escrow blob stored for one of the caller's devices
+func GetEscrow(deviceID uint, jwtToken string) ([]byte, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetQueryParam("device_id", strconv.FormatUint(uint64(deviceID), 10)).
+		Get(BaseURL + "/auth/escrow")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, ErrNoEscrow
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch escrow: %s", resp.String())
+	}
+
+	var result struct {
+		Escrow struct {
+			Blob string `json:"blob"`
+		} `json:"escrow"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse escrow: %w", err)
+	}
+	return []byte(result.Escrow.Blob), nil
+}
+
+// DeleteEscrow removes the escrow of this device
+func DeleteEscrow(jwtToken string) error {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetHeader("X-Device-ID", strconv.FormatUint(uint64(CurrentDevice()), 10)).
+		Delete(BaseURL + "/auth/escrow")
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("failed to delete escrow: %s", resp.String())
+	}
+	return nil
+}
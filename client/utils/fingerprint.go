@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// safetyNumberIterations slows down brute-forcing a key whose safety number
+// collides with someone else's
+const safetyNumberIterations = 5200
+
+// publicKeyDER extracts the DER bytes of a PEM encoded public key. Curve
+// keys are two blocks (Ed25519, then X25519), fingerprinted together as the
+// concatenation of their DER bytes.
+func publicKeyDER(pubPEM string) ([]byte, error) {
+	var der []byte
+	rest := []byte(pubPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("invalid public key PEM")
+		}
+		der = append(der, block.Bytes...)
+	}
+	if der == nil {
+		return nil, fmt.Errorf("invalid public key PEM")
+	}
+	return der, nil
+}
+
+// KeyDigest returns the hex SHA-256 of a PEM public key's DER bytes, the
+// form key rotation statements name keys by
+func KeyDigest(pubPEM string) (string, error) {
+	der, err := publicKeyDER(pubPEM)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Fingerprint returns the hex SHA-256 of a PEM public key, grouped in fours
+// for reading aloud: "1a2b 3c4d ..."
+func Fingerprint(pubPEM string) (string, error) {
+	h, err := KeyDigest(pubPEM)
+	if err != nil {
+		return "", err
+	}
+	return groupHex(h), nil
+}
+
+// GroupHex formats a hash like a fingerprint: hex in groups of four
+func GroupHex(b []byte) string {
+	return groupHex(hex.EncodeToString(b))
+}
+
+func groupHex(h string) string {
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumber derives a 60-digit number from both users' keys. Both sides
+// compute the same number, so comparing it in person or over a call proves
+// neither key was substituted. Printed in groups of five digits.
+func SafetyNumber(userA, pubPEMA, userB, pubPEMB string) (string, error) {
+	a, err := numericFingerprint(userA, pubPEMA)
+	if err != nil {
+		return "", err
+	}
+	b, err := numericFingerprint(userB, pubPEMB)
+	if err != nil {
+		return "", err
+	}
+	halves := []string{a, b}
+	sort.Strings(halves)
+	digits := halves[0] + halves[1]
+
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// numericFingerprint turns one user's key into 30 digits: an iterated
+// SHA-512 over the key and username, read as six 5-digit chunks.
+func numericFingerprint(username, pubPEM string) (string, error) {
+	der, err := publicKeyDER(pubPEM)
+	if err != nil {
+		return "", err
+	}
+	hash := append([]byte{0, 0}, der...)
+	hash = append(hash, []byte(username)...)
+	for i := 0; i < safetyNumberIterations; i++ {
+		h := sha512.New()
+		h.Write(hash)
+		h.Write(der)
+		hash = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(hash[i])<<32 | uint64(binary.BigEndian.Uint32(hash[i+1:i+5]))
+		fmt.Fprintf(&sb, "%05d", chunk%100000)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Group is a group the logged-in user is in
+type Group struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`    // our role: owner, admin or member
+	Members int    `json:"members"` // number of members
+}
+
+// GroupMember is one member of a group
+type GroupMember struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// CreateGroup calls POST /groups and returns the new group's ID
+func CreateGroup(name, jwtToken string) (uint, error) {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetBody(map[string]string{"name": name}).
+		Post(BaseURL + "/groups")
+	if err != nil {
+		return 0, err
+	}
+	if !resp.IsSuccess() {
+		return 0, fmt.Errorf("failed to create group: %s", resp.String())
+	}
+	var result struct {
+		ID uint `json:"id"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return 0, fmt.Errorf("failed to parse group: %w", err)
+	}
+	return result.ID, nil
+}
+
+// ListGroups calls GET /groups
+func ListGroups(jwtToken string) ([]Group, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		Get(BaseURL + "/groups")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch groups: %s", resp.String())
+	}
+	var groups []Group
+	if err := json.Unmarshal(resp.Body(), &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse groups: %w", err)
+	}
+	return groups, nil
+}
+
+// GetGroup calls GET /groups/<id> for the group and its members, oldest
+// first
+func GetGroup(id uint, jwtToken string) (*Group, []GroupMember, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		Get(BaseURL + "/groups/" + strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, nil, fmt.Errorf("failed to fetch group: %s", resp.String())
+	}
+	var result struct {
+		ID      uint          `json:"id"`
+		Name    string        `json:"name"`
+		Role    string        `json:"role"`
+		Members []GroupMember `json:"members"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse group: %w", err)
+	}
+	return &Group{ID: result.ID, Name: result.Name, Role: result.Role, Members: len(result.Members)}, result.Members, nil
+}
+
+// GroupAction calls POST /groups/<id>/<action> (invite, kick, leave or
+// role) and returns the server's message
+func GroupAction(id uint, action string, body map[string]string, jwtToken string) (string, error) {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetBody(body).
+		Post(BaseURL + "/groups/" + strconv.FormatUint(uint64(id), 10) + "/" + action)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	json.Unmarshal(resp.Body(), &result)
+	if !resp.IsSuccess() {
+		if result.Error == "" {
+			result.Error = resp.String()
+		}
+		return "", fmt.Errorf("%s failed: %s", action, result.Error)
+	}
+	return result.Message, nil
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// HistoryMessage is a stored message of a conversation. Content is
+// encrypted to this device for messages we received, and to the sending
+// device's own key for messages we sent.
+type HistoryMessage struct {
+	ID             uint      `json:"id"`
+	Outgoing       bool      `json:"outgoing"`
+	SenderDeviceID uint      `json:"sender_device_id"`
+	Content        string    `json:"content"`
+	Signature      string    `json:"signature"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// GetHistory calls /messages for the conversation with username, newest
+// first. before is the cursor from the previous page, 0 for the latest
+// messages; next is 0 when there are no older messages.
+func GetHistory(username string, before uint, limit int, jwtToken string) (msgs []HistoryMessage, next uint, err error) {
+	req := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetHeader("X-Device-ID", strconv.FormatUint(uint64(CurrentDevice()), 10)).
+		SetQueryParam("with", username).
+		SetQueryParam("limit", strconv.Itoa(limit))
+	if before != 0 {
+		req.SetQueryParam("before", strconv.FormatUint(uint64(before), 10))
+	}
+	resp, err := req.Get(BaseURL + "/messages")
+	if err != nil {
+		return nil, 0, err
+	}
+	if !resp.IsSuccess() {
+		return nil, 0, fmt.Errorf("failed to fetch history: %s", resp.String())
+	}
+
+	var result struct {
+		Messages   []HistoryMessage `json:"messages"`
+		NextBefore *uint            `json:"next_before"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse history: %w", err)
+	}
+	if result.NextBefore != nil {
+		next = *result.NextBefore
+	}
+	return result.Messages, next, nil
+}
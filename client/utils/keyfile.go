@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// EncryptedKeyType is the PEM block type of a passphrase-protected key file
+const EncryptedKeyType = "CLI-CHAT ENCRYPTED PRIVATE KEY"
+
+// legacyEncryptedKeyType is the type key files were first written with,
+// before curve keys; they still open
+const legacyEncryptedKeyType = "ENCRYPTED RSA PRIVATE KEY"
+
+// Argon2id parameters for new key files. They are stored in the file, so
+// raising them later doesn't break existing keys.
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+)
+
+// ErrWrongPassphrase is returned when a key file can't be opened with the
+// given passphrase (or has been tampered with)
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// IsEncryptedKey reports whether data is a passphrase-protected key file
+func IsEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && (block.Type == EncryptedKeyType || block.Type == legacyEncryptedKeyType)
+}
+
+// EncryptKeyFile seals a private key PEM under a passphrase, using an
+// Argon2id-derived AES-256-GCM key. RSA keys store only the DER bytes, as
+// they always have; curve keys are two PEM blocks, so the whole PEM text is
+// sealed and marked with a "Contents: pem" header.
+func EncryptKeyFile(privPEM, passphrase string) ([]byte, error) {
+	block, rest := pem.Decode([]byte(privPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key PEM")
+	}
+	if block.Type == "RSA PRIVATE KEY" && len(strings.TrimSpace(string(rest))) == 0 {
+		return sealPEM(EncryptedKeyType, nil, block.Bytes, passphrase)
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("invalid private key PEM")
+	}
+	return sealPEM(EncryptedKeyType, map[string]string{"Contents": "pem"}, []byte(privPEM), passphrase)
+}
+
+// DecryptKeyFile opens a key file written by EncryptKeyFile and returns the
+// plaintext private key PEM
+func DecryptKeyFile(data []byte, passphrase string) (string, error) {
+	blockType := EncryptedKeyType
+	if block, _ := pem.Decode(data); block != nil && block.Type == legacyEncryptedKeyType {
+		blockType = legacyEncryptedKeyType
+	}
+	plain, headers, err := openPEM(data, blockType, passphrase)
+	if err != nil {
+		return "", err
+	}
+	if headers["Contents"] == "pem" {
+		return string(plain), nil
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: plain})), nil
+}
+
+// sealPEM encrypts plaintext under passphrase into a PEM block of the given
+// type. The KDF parameters, salt and nonce go in the block headers next to
+// any extra headers; the block type is authenticated.
+func sealPEM(blockType string, headers map[string]string, plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := keyFileAEAD(passphrase, salt, kdfTime, kdfMemory, kdfThreads)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := &pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"KDF":        "argon2id",
+			"KDF-Params": fmt.Sprintf("t=%d,m=%d,p=%d", kdfTime, kdfMemory, kdfThreads),
+			"Salt":       base64.StdEncoding.EncodeToString(salt),
+			"Nonce":      base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, plaintext, []byte(blockType)),
+	}
+	for k, v := range headers {
+		out.Headers[k] = v
+	}
+	return pem.EncodeToMemory(out), nil
+}
+
+// openPEM reverses sealPEM, returning the plaintext and the block headers
+func openPEM(data []byte, blockType, passphrase string) ([]byte, map[string]string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, nil, fmt.Errorf("not a %s file", strings.ToLower(blockType))
+	}
+	if block.Headers["KDF"] != "argon2id" {
+		return nil, nil, fmt.Errorf("unsupported key derivation %q", block.Headers["KDF"])
+	}
+	t, m, p, err := parseKDFParams(block.Headers["KDF-Params"])
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, nil, fmt.Errorf("invalid salt")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid nonce")
+	}
+
+	gcm, err := keyFileAEAD(passphrase, salt, t, m, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, nil, fmt.Errorf("invalid nonce")
+	}
+	plain, err := gcm.Open(nil, nonce, block.Bytes, []byte(blockType))
+	if err != nil {
+		return nil, nil, ErrWrongPassphrase
+	}
+	return plain, block.Headers, nil
+}
+
+func keyFileAEAD(passphrase string, salt []byte, t, m uint32, p uint8) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, t, m, p, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseKDFParams reads "t=<time>,m=<KiB>,p=<threads>", refusing values that
+// would make opening the file unreasonably slow
+func parseKDFParams(s string) (t, m uint32, p uint8, err error) {
+	for _, part := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		n, perr := strconv.ParseUint(v, 10, 32)
+		if perr != nil {
+			return 0, 0, 0, fmt.Errorf("invalid KDF parameters %q", s)
+		}
+		switch k {
+		case "t":
+			t = uint32(n)
+		case "m":
+			m = uint32(n)
+		case "p":
+			if n > 64 {
+				return 0, 0, 0, fmt.Errorf("invalid KDF parameters %q", s)
+			}
+			p = uint8(n)
+		}
+	}
+	if t == 0 || t > 16 || m < 8*1024 || m > 1024*1024 || p == 0 {
+		return 0, 0, 0, fmt.Errorf("invalid KDF parameters %q", s)
+	}
+	return t, m, p, nil
+}
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// The server appends every public key it hands out to a Merkle tree and
+// signs the tree's root (see the key transparency section of the readme).
+// Before trusting a key we check that the log has it for its device in a
+// signed tree, and that every tree we are shown extends the last one we saw.
+// That doesn't prove the entry is the device's latest: an old key still
+// verifies with its old entry. It does prove that every key we are shown is
+// in the one public log, so a server showing different keys to different
+// people has to log them all, where GET /keylog/entries shows them, or fork
+// the log, which comparing tree heads (`verify` prints ours) exposes.
+
+// keyEventRemoveDevice marks a key that is no longer in use
+const keyEventRemoveDevice = "remove-device"
+
+// KeyLogEntry is one leaf of the key transparency log
+type KeyLogEntry struct {
+	Index     uint64 `json:"index"`
+	Username  string `json:"username"`
+	DeviceID  uint   `json:"device_id"`
+	KeyDigest string `json:"key"`
+	Event     string `json:"event"`
+	LoggedAt  int64  `json:"logged_at"`
+}
+
+// TreeHead is the log's size and root hash, signed by the log key
+type TreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	RootHash  []byte `json:"root_hash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// KeyLogProof is the server's proof that a key is in the log
+type KeyLogProof struct {
+	Entry     KeyLogEntry `json:"entry"`
+	AuditPath [][]byte    `json:"audit_path"`
+	Head      TreeHead    `json:"head"`
+}
+
+// keyLogState is what we remember about the log, in keys/<owner>_keylog.json
+type keyLogState struct {
+	PublicKey []byte    `json:"public_key"` // pinned the first time we saw it
+	Head      *TreeHead `json:"head"`       // largest tree verified so far
+}
+
+// keyLogMu serializes checks, which may run from the receive loop too
+var keyLogMu sync.Mutex
+
+func keyLogPath() string {
+	return fmt.Sprintf("keys/%s_keylog.json", os.Getenv("CURRENT_USER"))
+}
+
+func loadKeyLogState() (*keyLogState, error) {
+	state := &keyLogState{}
+	data, err := os.ReadFile(keyLogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("corrupt key log state %s: %w", keyLogPath(), err)
+	}
+	return state, nil
+}
+
+func (s *keyLogState) save() error {
+	if err := os.MkdirAll("keys", 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyLogPath(), data, 0600)
+}
+
+// treeHeadStatement matches the text the server signs
+func treeHeadStatement(head TreeHead) string {
+	return fmt.Sprintf("cli-chat key log tree head\nsize: %d\nroot: %s\ntimestamp: %d", head.TreeSize, hex.EncodeToString(head.RootHash), head.Timestamp)
+}
+
+// keyLogLeaf matches the text the server hashes into the tree
+func keyLogLeaf(e KeyLogEntry) []byte {
+	return []byte(fmt.Sprintf("cli-chat key log entry\nusername: %s\ndevice: %d\nkey: %s\nevent: %s\nlogged-at: %d",
+		e.Username, e.DeviceID, e.KeyDigest, e.Event, e.LoggedAt))
+}
+
+// fetchKeyLogKey asks the server for its log signing key
+func fetchKeyLogKey() ([]byte, error) {
+	resp, err := resty.New().R().Get(BaseURL + "/keylog/public-key")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch key log key: %s", resp.String())
+	}
+	var result struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse key log key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(result.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("server sent an invalid key log key")
+	}
+	return key, nil
+}
+
+// fetchConsistencyProof asks for a proof that tree first extends to tree second
+func fetchConsistencyProof(first, second uint64) ([][]byte, error) {
+	resp, err := resty.New().R().
+		SetQueryParam("first", strconv.FormatUint(first, 10)).
+		SetQueryParam("second", strconv.FormatUint(second, 10)).
+		Get(BaseURL + "/keylog/consistency")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch consistency proof: %s", resp.String())
+	}
+	var result struct {
+		Proof [][]byte `json:"proof"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse consistency proof: %w", err)
+	}
+	return result.Proof, nil
+}
+
+// checkHeads verifies that a and b are two views of the same append-only
+// log, whichever of them is larger
+func checkHeads(a, b TreeHead) error {
+	if a.TreeSize > b.TreeSize {
+		a, b = b, a
+	}
+	var proof [][]byte
+	if a.TreeSize != b.TreeSize && a.TreeSize != 0 {
+		var err error
+		if proof, err = fetchConsistencyProof(a.TreeSize, b.TreeSize); err != nil {
+			return err
+		}
+	}
+	if err := verifyConsistency(a.TreeSize, b.TreeSize, a.RootHash, b.RootHash, proof); err != nil {
+		return fmt.Errorf("the key log of size %d is not consistent with the one of size %d: the server may be showing a forked log", a.TreeSize, b.TreeSize)
+	}
+	return nil
+}
+
+// VerifyKeyLog checks that the transparency log has pubPEM as a key of
+// username's device, and that it wasn't logged as removed
+func VerifyKeyLog(username string, deviceID uint, pubPEM string, proof *KeyLogProof) error {
+	if proof == nil {
+		return errors.New("the server sent no transparency proof for this key")
+	}
+
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+
+	state, err := loadKeyLogState()
+	if err != nil {
+		return err
+	}
+	if state.PublicKey == nil {
+		// Trust on first use, like contact keys
+		key, err := fetchKeyLogKey()
+		if err != nil {
+			return err
+		}
+		state.PublicKey = key
+		fmt.Printf("Pinned the server's key log key %s\n", base64.StdEncoding.EncodeToString(key))
+	}
+
+	head := proof.Head
+	if !ed25519.Verify(state.PublicKey, []byte(treeHeadStatement(head)), head.Signature) {
+		return errors.New("the key log tree head has a bad signature")
+	}
+	if state.Head != nil {
+		if err := checkHeads(*state.Head, head); err != nil {
+			return err
+		}
+	}
+
+	entry := proof.Entry
+	digest, err := KeyDigest(pubPEM)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry.Username != username || entry.DeviceID != deviceID:
+		return errors.New("the key log entry is for a different device")
+	case entry.Event == keyEventRemoveDevice:
+		return errors.New("the key log says this device was removed")
+	case entry.KeyDigest != digest:
+		return errors.New("the key log has a different key for this device")
+	}
+	if err := verifyInclusion(entry.Index, head.TreeSize, merkleLeafHash(keyLogLeaf(entry)), proof.AuditPath, head.RootHash); err != nil {
+		return errors.New("the key is not in the key log")
+	}
+
+	if state.Head == nil || head.TreeSize > state.Head.TreeSize {
+		state.Head = &head
+	}
+	return state.save()
+}
+
+// LastTreeHead returns the largest key log tree verified so far, or nil
+func LastTreeHead() (*TreeHead, error) {
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	state, err := loadKeyLogState()
+	if err != nil {
+		return nil, err
+	}
+	return state.Head, nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// KeyRotation is the body of POST /auth/rotate-key. Statement is signed by
+// both the current key (Signature) and the new key (NewSignature).
+type KeyRotation struct {
+	NewPublicKey string `json:"new_public_key"`
+	Statement    string `json:"statement"`
+	Signature    string `json:"signature"`
+	NewSignature string `json:"new_signature"`
+	// New certificates for the extra devices, signed with the new key
+	DeviceCertificates map[uint]string `json:"device_certificates,omitempty"`
+}
+
+// RotateKey replaces the caller's public key on the server
+func RotateKey(rotation KeyRotation, jwtToken string) error {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetBody(rotation).
+		Post(BaseURL + "/auth/rotate-key")
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("key rotation rejected: %s", resp.String())
+	}
+	return nil
+}
+
+// Challenge is a one-time server nonce a client proves key possession against
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	ServerKey string `json:"server_key"` // base64 X25519 public key, for curve key proofs
+}
+
+// GetRegisterChallenge asks the server for a registration challenge
+func GetRegisterChallenge() (*Challenge, error) {
+	var out Challenge
+	resp, err := resty.New().R().
+		SetResult(&out).
+		Post(BaseURL + "/auth/register/challenge")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to get a registration challenge: %s", resp.String())
+	}
+	return &out, nil
+}
+
+// GetDeviceChallenge asks the server for a challenge a new device answers
+// with its key
+func GetDeviceChallenge(jwtToken string) (*Challenge, error) {
+	var out Challenge
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetResult(&out).
+		Post(BaseURL + "/auth/devices/challenge")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to get a device challenge: %s", resp.String())
+	}
+	return &out, nil
+}
+
+// GetLoginChallenge asks the server for a passwordless login challenge
+func GetLoginChallenge() (string, error) {
+	var out Challenge
+	resp, err := resty.New().R().
+		SetResult(&out).
+		Post(BaseURL + "/auth/login/challenge")
+	if err != nil {
+		return "", err
+	}
+	if !resp.IsSuccess() {
+		return "", fmt.Errorf("failed to get a login challenge: %s", resp.String())
+	}
+	return out.Challenge, nil
+}
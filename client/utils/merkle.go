@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Merkle proof verification for the key transparency log (RFC 9162,
+// sections 2.1.3.2 and 2.1.4.2), with the RFC 6962 leaf and node prefixes
+
+var errBadProof = errors.New("invalid Merkle proof")
+
+func merkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// verifyInclusion checks that leafHash is leaf index of the tree of size
+// treeSize with the given root
+func verifyInclusion(index, treeSize uint64, leafHash []byte, path [][]byte, root []byte) error {
+	if index >= treeSize {
+		return errBadProof
+	}
+	fn, sn := index, treeSize-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return errBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errBadProof
+	}
+	return nil
+}
+
+// verifyConsistency checks that the tree of size first with root firstRoot
+// is a prefix of the tree of size second with root secondRoot
+func verifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first > second:
+		return errBadProof
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return errBadProof
+		}
+		return nil
+	case first == 0:
+		// The empty tree is a prefix of every tree
+		return nil
+	}
+	if len(proof) == 0 {
+		return errBadProof
+	}
+	// If first is a power of two, its root is the first node of the path
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errBadProof
+	}
+	return nil
+}
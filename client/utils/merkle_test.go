@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// The RFC 6962 test tree: eight leaves and the root of every prefix, from
+// the Certificate Transparency reference implementation
+var rfcLeaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+
+var rfcRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func hexPath(t *testing.T, hashes ...string) [][]byte {
+	t.Helper()
+	path := [][]byte{}
+	for _, h := range hashes {
+		path = append(path, mustHex(t, h))
+	}
+	return path
+}
+
+// tampered returns a copy of path with one bit of element i flipped
+func tampered(path [][]byte, i int) [][]byte {
+	out := make([][]byte, len(path))
+	for j, p := range path {
+		out[j] = append([]byte{}, p...)
+	}
+	out[i][0] ^= 1
+	return out
+}
+
+// The wrong-size cases pick sizes that change the tree's shape: a size only
+// means something together with its root, which the signed tree head binds
+func TestVerifyInclusion(t *testing.T) {
+	path08 := []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}
+	path58 := []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}
+	path15 := []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}
+	tests := []struct {
+		name   string
+		leaf   int    // index into rfcLeaves
+		index  uint64 // index the proof claims
+		size   uint64
+		root   int // size of the tree whose root is checked against
+		path   []string
+		wantOK bool
+	}{
+		{"single leaf", 0, 0, 1, 1, nil, true},
+		{"first of 8", 0, 0, 8, 8, path08, true},
+		{"sixth of 8", 5, 5, 8, 8, path58, true},
+		{"last of 3", 2, 2, 3, 3, []string{rfcRoots[1]}, true},
+		{"second of 5", 1, 1, 5, 5, path15, true},
+		{"wrong tree size", 5, 5, 6, 8, path58, false},
+		{"larger tree size", 5, 5, 9, 8, path58, false},
+		{"wrong index", 5, 4, 8, 8, path58, false},
+		{"index past the tree", 0, 8, 8, 8, path08, false},
+		{"wrong leaf", 1, 0, 8, 8, path08, false},
+		{"wrong root", 0, 0, 8, 7, path08, false},
+		{"short path", 0, 0, 8, 8, path08[:2], false},
+		{"long path", 0, 0, 8, 8, append(path08[:3:3], rfcRoots[0]), false},
+		{"path for a single leaf", 0, 0, 1, 1, []string{rfcRoots[0]}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leafHash := merkleLeafHash(mustHex(t, rfcLeaves[tt.leaf]))
+			err := verifyInclusion(tt.index, tt.size, leafHash, hexPath(t, tt.path...), mustHex(t, rfcRoots[tt.root-1]))
+			if (err == nil) != tt.wantOK {
+				t.Errorf("verifyInclusion = %v, want ok %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	proof18 := []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}
+	proof68 := []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}
+	proof25 := []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}
+	tests := []struct {
+		name          string
+		first, second uint64
+		firstRoot     int // sizes of the trees whose roots are checked against
+		secondRoot    int
+		proof         []string
+		wantOK        bool
+	}{
+		{"same tree", 1, 1, 1, 1, nil, true},
+		{"1 to 8", 1, 8, 1, 8, proof18, true},
+		{"6 to 8", 6, 8, 6, 8, proof68, true},
+		{"2 to 5", 2, 5, 2, 5, proof25, true},
+		{"same size, different roots", 3, 3, 3, 4, nil, false},
+		{"same size with a proof", 1, 1, 1, 1, []string{rfcRoots[0]}, false},
+		{"shrinking tree", 8, 6, 8, 6, proof68, false},
+		{"wrong first size", 5, 8, 6, 8, proof68, false},
+		{"wrong second size", 6, 16, 6, 8, proof68, false},
+		{"wrong first root", 6, 8, 5, 8, proof68, false},
+		{"wrong second root", 6, 8, 6, 7, proof68, false},
+		{"missing proof", 2, 5, 2, 5, nil, false},
+		{"short proof", 6, 8, 6, 8, proof68[:2], false},
+		{"long proof", 2, 5, 2, 5, append(proof25[:2:2], rfcRoots[0]), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyConsistency(tt.first, tt.second, mustHex(t, rfcRoots[tt.firstRoot-1]), mustHex(t, rfcRoots[tt.secondRoot-1]), hexPath(t, tt.proof...))
+			if (err == nil) != tt.wantOK {
+				t.Errorf("verifyConsistency = %v, want ok %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+// merkleProofs is the layout of testdata/merkle_proofs.json, written by the
+// server's TestProofsFixture from its proof code
+type merkleProofs struct {
+	Leaves    [][]byte `json:"leaves"`
+	Roots     [][]byte `json:"roots"`
+	Inclusion []struct {
+		Index uint64   `json:"index"`
+		Size  uint64   `json:"size"`
+		Path  [][]byte `json:"path"`
+	} `json:"inclusion"`
+	Consistency []struct {
+		First  uint64   `json:"first"`
+		Second uint64   `json:"second"`
+		Proof  [][]byte `json:"proof"`
+	} `json:"consistency"`
+}
+
+// TestServerProofs checks the verifiers against every proof the server's
+// code makes for trees of 1 to 13 leaves, and against each of them tampered
+func TestServerProofs(t *testing.T) {
+	data, err := os.ReadFile("testdata/merkle_proofs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p merkleProofs
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Roots) != len(p.Leaves) || len(p.Inclusion) == 0 || len(p.Consistency) == 0 {
+		t.Fatal("incomplete fixture")
+	}
+	root := func(size uint64) []byte { return p.Roots[size-1] }
+
+	for _, in := range p.Inclusion {
+		t.Run(fmt.Sprintf("inclusion %d of %d", in.Index, in.Size), func(t *testing.T) {
+			leaf := p.Leaves[in.Index]
+			if err := verifyInclusion(in.Index, in.Size, leaf, in.Path, root(in.Size)); err != nil {
+				t.Fatalf("valid proof rejected: %v", err)
+			}
+			for i := range in.Path {
+				if verifyInclusion(in.Index, in.Size, leaf, tampered(in.Path, i), root(in.Size)) == nil {
+					t.Errorf("accepted a proof with node %d tampered", i)
+				}
+			}
+			if in.Size < uint64(len(p.Roots)) && verifyInclusion(in.Index, in.Size+1, leaf, in.Path, root(in.Size+1)) == nil {
+				t.Errorf("accepted the proof for a tree of %d", in.Size+1)
+			}
+		})
+	}
+	for _, c := range p.Consistency {
+		t.Run(fmt.Sprintf("consistency %d to %d", c.First, c.Second), func(t *testing.T) {
+			if err := verifyConsistency(c.First, c.Second, root(c.First), root(c.Second), c.Proof); err != nil {
+				t.Fatalf("valid proof rejected: %v", err)
+			}
+			for i := range c.Proof {
+				if verifyConsistency(c.First, c.Second, root(c.First), root(c.Second), tampered(c.Proof, i)) == nil {
+					t.Errorf("accepted a proof with node %d tampered", i)
+				}
+			}
+			if c.Second < uint64(len(p.Roots)) && verifyConsistency(c.First, c.Second+1, root(c.First), root(c.Second+1), c.Proof) == nil {
+				t.Errorf("accepted the proof for a tree of %d", c.Second+1)
+			}
+		})
+	}
+}
@@ -1,19 +1,102 @@
 package utils
 
 import (
-    "encoding/base64"
     "fmt"
     "github.com/gorilla/websocket"
     "errors"
     "net"
     "net/http"
+    "strconv"
     "strings"
+    "sync"
     "time"
 )
 
+// Receipt statuses a client sends for messages it received
+const (
+	ReceiptDelivered = "delivered" // the message reached this device
+	ReceiptRead      = "read"      // the message was shown to the user
+)
+
+// Event types the server sends besides messages
+const (
+	EventSent        = "sent"         // a message was stored; IDs are its copies
+	EventError       = "error"        // a message was refused
+	EventReceipt     = "receipt"      // copies were delivered or read
+	EventTypingStart = "typing_start" // Sender is composing a message to us
+	EventTypingStop  = "typing_stop"  // Sender stopped or sent it
+	EventPresence    = "presence"     // a contact came online or went offline
+	EventGroup       = "group"        // a group's membership changed
+)
+
+// ChatMessage is a message relayed by the server
+type ChatMessage struct {
+	ID           uint   // server ID of this copy, acknowledged with SendReceipt
+	GroupID      uint   // group the message was sent to, 0 for a direct message
+	Sender       string // username the server claims sent the message
+	SenderDevice uint   // device of Sender that encrypted and signed it
+	Content      string // base64 encrypted message
+	Signature    string // base64 sender signature, empty for unsigned messages
+}
+
+// MessageCopy is a message encrypted and signed for one receiver device
+type MessageCopy struct {
+	Username  string `json:"username,omitempty"` // group messages: the member it is for
+	DeviceID  uint   `json:"device_id"`
+	Content   string `json:"content"`
+	Signature string `json:"signature"`
+}
+
+// Event is a server notice about messages this device sent
+type Event struct {
+	Type     string    // one of the Event constants
+	Sender   string    // typing: username who is typing; presence: the contact; group: the member
+	Ref      string    // sent, error: the ref passed to SendMessage
+	IDs      []uint    // sent: stored copies; receipt: copies it covers
+	BatchID  uint      // sent: the ID history lists the message under
+	Status   string    // receipt: ReceiptDelivered or ReceiptRead
+	Receiver string    // receipt: username who received the copies
+	At       time.Time // receipt: when the server recorded it
+	Error    string    // error: why the message was refused
+	Online   bool      // presence: whether Sender is online now
+	LastSeen time.Time // presence: when Sender went offline, zero if online
+	Group    uint      // group: the group whose membership changed
+	Change   string    // group: Sender "joined", "left", was "kicked" or had their "role" changed
+}
+
+// SenderCopy is a message encrypted and signed for the sender's own key, so
+// they can read what they sent when their history is fetched
+type SenderCopy struct {
+	Content   string `json:"sender_content"`
+	Signature string `json:"sender_signature"`
+}
+
 // WSClient represents a WebSocket connection
 type WSClient struct {
 	Conn *websocket.Conn
+	mu   sync.Mutex // one writer at a time: receipts go out from the read loop
+}
+
+// serverFrame is any frame the server sends
+type serverFrame struct {
+	Type           string     `json:"type"`
+	ID             uint       `json:"id"`
+	SenderUsername string     `json:"sender_username"`
+	SenderDeviceID uint       `json:"sender_device_id"`
+	Content        string     `json:"content"`
+	Signature      string     `json:"signature"`
+	Ref            string     `json:"ref"`
+	IDs            []uint     `json:"ids"`
+	BatchID        uint       `json:"batch_id"`
+	Status         string     `json:"status"`
+	Receiver       string     `json:"receiver_username"`
+	At             int64      `json:"at"`
+	Error          string     `json:"error"`
+	Username       string     `json:"username"`
+	Online         bool       `json:"online"`
+	LastSeenAt     *time.Time `json:"last_seen_at"`
+	GroupID        uint       `json:"group_id"`
+	Event          string     `json:"event"`
 }
 
 // NewWSClient connects to the WebSocket server with JWT in headers
@@ -21,6 +104,10 @@ func NewWSClient(jwtToken, wsURL string) (*WSClient, error) {
 	// Add Authorization header
 	header := http.Header{}
 	header.Add("Authorization", "Bearer "+jwtToken)
+	header.Add("X-Device-ID", strconv.FormatUint(uint64(CurrentDevice()), 10))
+	// We acknowledge messages, so the server waits for our receipts before
+	// marking them delivered
+	header.Add("X-Receipts", "1")
 
 	// Dial WebSocket
 	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
@@ -34,23 +121,77 @@ func NewWSClient(jwtToken, wsURL string) (*WSClient, error) {
 	return &WSClient{Conn: conn}, nil
 }
 
-// SendMessage sends an encrypted message to the server
-func (c *WSClient) SendMessage(receiver string, encrypted []byte) error {
-	msg := map[string]string{
+// SendMessage sends a message to the server, one encrypted copy per
+// receiver device plus, if own is set, a copy for the sender. The server
+// answers with an EventSent or EventError carrying ref.
+func (c *WSClient) SendMessage(ref, receiver string, copies []MessageCopy, own *SenderCopy) error {
+	msg := map[string]interface{}{
+		"type":              "message",
+		"ref":               ref,
 		"receiver_username": receiver,
-		"content":           base64.StdEncoding.EncodeToString(encrypted),
+		"copies":            copies,
+	}
+	if own != nil {
+		msg["sender_content"] = own.Content
+		msg["sender_signature"] = own.Signature
 	}
 
-	if err := c.Conn.WriteJSON(msg); err != nil {
+	if err := c.writeJSON(msg); err != nil {
 		return fmt.Errorf("failed to send message: %v", err)
 	}
 	return nil
 }
 
-// ReceiveMessages listens for incoming messages and invokes the callback
-func (c *WSClient) ReceiveMessages(handle func(sender, content string)) {
+// SendGroupMessage sends a message to a group, one encrypted copy per
+// member device plus, if own is set, a copy for the sender. Replies are
+// the same as for SendMessage.
+func (c *WSClient) SendGroupMessage(ref string, groupID uint, copies []MessageCopy, own *SenderCopy) error {
+	msg := map[string]interface{}{
+		"type":     "message",
+		"ref":      ref,
+		"group_id": groupID,
+		"copies":   copies,
+	}
+	if own != nil {
+		msg["sender_content"] = own.Content
+		msg["sender_signature"] = own.Signature
+	}
+
+	if err := c.writeJSON(msg); err != nil {
+		return fmt.Errorf("failed to send message: %v", err)
+	}
+	return nil
+}
+
+// SendReceipt acknowledges received messages by ID, with ReceiptDelivered
+// or ReceiptRead
+func (c *WSClient) SendReceipt(status string, ids []uint) error {
+	if err := c.writeJSON(map[string]interface{}{"type": status, "ids": ids}); err != nil {
+		return fmt.Errorf("failed to send receipt: %v", err)
+	}
+	return nil
+}
+
+// SendTyping tells receiver that we started or stopped typing to them
+func (c *WSClient) SendTyping(receiver string, typing bool) error {
+	frame := EventTypingStop
+	if typing {
+		frame = EventTypingStart
+	}
+	return c.writeJSON(map[string]interface{}{"type": frame, "receiver_username": receiver})
+}
+
+func (c *WSClient) writeJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// ReceiveMessages listens for incoming messages and invokes the callback,
+// and hands any other server notice to onEvent
+func (c *WSClient) ReceiveMessages(handle func(msg ChatMessage), onEvent func(ev Event)) {
 	for {
-		var msg map[string]interface{}
+		var msg serverFrame
 		err := c.Conn.ReadJSON(&msg)
 		if err != nil {
             // Suppress expected errors on normal shutdown
@@ -63,10 +204,32 @@ func (c *WSClient) ReceiveMessages(handle func(sender, content string)) {
 			return
 		}
 
-		sender, _ := msg["sender_username"].(string)
-		content, _ := msg["content"].(string)
+		// Servers without receipts send untyped messages
+		if msg.Type != "" && msg.Type != "message" {
+			ev := Event{
+				Type:     msg.Type,
+				Sender:   msg.SenderUsername,
+				Ref:      msg.Ref,
+				IDs:      msg.IDs,
+				BatchID:  msg.BatchID,
+				Status:   msg.Status,
+				Receiver: msg.Receiver,
+				At:       time.UnixMilli(msg.At),
+				Error:    msg.Error,
+				Online:   msg.Online,
+			}
+			if msg.Type == EventPresence || msg.Type == EventGroup {
+				ev.Sender = msg.Username
+				if !msg.Online && msg.LastSeenAt != nil {
+					ev.LastSeen = *msg.LastSeenAt
+				}
+				ev.Group, ev.Change = msg.GroupID, msg.Event
+			}
+			onEvent(ev)
+			continue
+		}
 
-		handle(sender, content)
+		handle(ChatMessage{ID: msg.ID, GroupID: msg.GroupID, Sender: msg.SenderUsername, SenderDevice: msg.SenderDeviceID, Content: msg.Content, Signature: msg.Signature})
 	}
 }
 
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrNoPrekeys is returned when a user has never published a prekey bundle
+var ErrNoPrekeys = errors.New("user has not published prekeys")
+
+// OneTimePrekey is a base64 X25519 public key and its id
+type OneTimePrekey struct {
+	ID  uint32 `json:"id"`
+	Key string `json:"key"`
+}
+
+// PrekeyBundle is the response of GET /auth/prekeys. OneTimePrekey is set when
+// fetching someone else's bundle; OneTimePrekeys counts the unused keys left
+// when fetching your own.
+type PrekeyBundle struct {
+	IdentityKey    string         `json:"identity_key"`
+	SignedPrekeyID uint32         `json:"signed_prekey_id"`
+	SignedPrekey   string         `json:"signed_prekey"`
+	Signature      string         `json:"signature"`
+	OneTimePrekey  *OneTimePrekey `json:"one_time_prekey,omitempty"`
+	OneTimePrekeys int64          `json:"one_time_prekeys,omitempty"`
+}
+
+// PrekeyUpload is the body of POST /auth/prekeys
+type PrekeyUpload struct {
+	IdentityKey    string          `json:"identity_key"`
+	SignedPrekeyID uint32          `json:"signed_prekey_id"`
+	SignedPrekey   string          `json:"signed_prekey"`
+	Signature      string          `json:"signature"`
+	OneTimePrekeys []OneTimePrekey `json:"one_time_prekeys"`
+}
+
+// GetPrekeyBundle calls /auth/prekeys?username=<username>&device_id=<id>
+func GetPrekeyBundle(username string, deviceID uint, jwtToken string) (*PrekeyBundle, error) {
+	return getPrekeyBundle(username, deviceID, true, jwtToken)
+}
+
+// GetSignedPrekeys is GetPrekeyBundle without taking one of the device's
+// one-time prekeys, for checking a bundle rather than starting a session
+func GetSignedPrekeys(username string, deviceID uint, jwtToken string) (*PrekeyBundle, error) {
+	return getPrekeyBundle(username, deviceID, false, jwtToken)
+}
+
+func getPrekeyBundle(username string, deviceID uint, oneTime bool, jwtToken string) (*PrekeyBundle, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetQueryParam("username", username).
+		SetQueryParam("device_id", strconv.FormatUint(uint64(deviceID), 10)).
+		SetQueryParam("one_time", strconv.FormatBool(oneTime)).
+		Get(BaseURL + "/auth/prekeys")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, ErrNoPrekeys
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch prekeys: %s", resp.String())
+	}
+
+	var result struct {
+		Bundle PrekeyBundle `json:"bundle"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse prekeys: %w", err)
+	}
+	return &result.Bundle, nil
+}
+
+// UploadPrekeys publishes the bundle of this device and returns how many
+// one-time prekeys the server now holds for it
+func UploadPrekeys(upload PrekeyUpload, jwtToken string) (int64, error) {
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		SetHeader("X-Device-ID", strconv.FormatUint(uint64(CurrentDevice()), 10)).
+		SetBody(upload).
+		Post(BaseURL + "/auth/prekeys")
+	if err != nil {
+		return 0, err
+	}
+	if !resp.IsSuccess() {
+		return 0, fmt.Errorf("failed to upload prekeys: %s", resp.String())
+	}
+
+	var result struct {
+		OneTimePrekeys int64 `json:"one_time_prekeys"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return 0, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return result.OneTimePrekeys, nil
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Presence is whether a contact is online, and when they were last seen
+type Presence struct {
+	Username   string     `json:"username"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at"` // nil if they never connected
+}
+
+// GetPresence calls /connections/presence for the logged-in user's accepted
+// connections, sorted by username
+func GetPresence(jwtToken string) ([]Presence, error) {
+	resp, err := resty.New().R().
+		SetHeader("Authorization", "Bearer "+jwtToken).
+		Get(BaseURL + "/connections/presence")
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to fetch presence: %s", resp.String())
+	}
+
+	var result []Presence
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse presence: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// SeenWindow is how long message IDs are remembered. Older messages can't
+	// be checked for replays, so they are flagged instead.
+	SeenWindow = 30 * 24 * time.Hour
+	// maxClockSkew is how far in the future a sender's timestamp may be
+	maxClockSkew = 5 * time.Minute
+)
+
+// SeenStatus is the result of checking a message ID against the seen-set
+type SeenStatus int
+
+const (
+	SeenNew       SeenStatus = iota // first time we see this message
+	SeenDuplicate                   // already received: a replay or a repeated delivery
+	SeenTooOld                      // older than SeenWindow, so it can't be checked
+	SeenFuture                      // timestamp is ahead of our clock
+)
+
+// SeenStore remembers the IDs of messages received from one contact, kept in
+// keys/<owner>_seen/<peer>.json
+type SeenStore struct {
+	mu   sync.Mutex
+	path string
+	Seen map[string]int64 `json:"seen"` // hex message ID -> sender timestamp (unix ms)
+}
+
+// LoadSeen reads the seen-set for the conversation between owner and peer
+func LoadSeen(owner, peer string) (*SeenStore, error) {
+	s := &SeenStore{
+		path: filepath.Join(fmt.Sprintf("keys/%s_seen", owner), peer+".json"),
+		Seen: map[string]int64{},
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("corrupt seen-set %s: %w", s.path, err)
+	}
+	if s.Seen == nil {
+		s.Seen = map[string]int64{}
+	}
+	return s, nil
+}
+
+// Check records a message ID and reports whether it was seen before. IDs of
+// messages outside the window are not recorded.
+func (s *SeenStore) Check(id []byte, sentAt time.Time) SeenStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(id)
+	if _, ok := s.Seen[key]; ok {
+		return SeenDuplicate
+	}
+	now := time.Now()
+	if sentAt.Before(now.Add(-SeenWindow)) {
+		return SeenTooOld
+	}
+	s.Seen[key] = sentAt.UnixMilli()
+	if sentAt.After(now.Add(maxClockSkew)) {
+		return SeenFuture
+	}
+	return SeenNew
+}
+
+// Save prunes IDs older than SeenWindow and writes the set back to disk
+func (s *SeenStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-SeenWindow).UnixMilli()
+	for id, ts := range s.Seen {
+		if ts < cutoff {
+			delete(s.Seen, id)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
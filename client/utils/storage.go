@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// The storage key encrypts what the client keeps next to its key files:
+// the session identity, ratchet states and the local message archive. It is
+// random and kept in keys/<username>_storage.pem, sealed under the key file
+// passphrase like a key file, so the KDF runs once per process instead of
+// on every write.
+
+// StorageKeyType is the PEM block type of a sealed storage key
+const StorageKeyType = "CLI-CHAT STORAGE KEY"
+
+// sealedMagic starts every file encrypted with a storage key
+var sealedMagic = []byte("cli-chat sealed v1\n")
+
+// StorageKey encrypts local state files with AES-256-GCM
+type StorageKey struct {
+	raw  []byte
+	aead cipher.AEAD
+}
+
+func newStorageKey(raw []byte) (*StorageKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageKey{raw: raw, aead: aead}, nil
+}
+
+// NewStorageKey makes a random storage key
+func NewStorageKey() (*StorageKey, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	return newStorageKey(raw)
+}
+
+// OpenStorageKey opens a storage key file written by Encode
+func OpenStorageKey(data []byte, passphrase string) (*StorageKey, error) {
+	raw, _, err := openPEM(data, StorageKeyType, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 32 {
+		return nil, errors.New("invalid storage key")
+	}
+	return newStorageKey(raw)
+}
+
+// Encode seals the key under passphrase for keys/<username>_storage.pem
+func (k *StorageKey) Encode(passphrase string) ([]byte, error) {
+	return sealPEM(StorageKeyType, nil, k.raw, passphrase)
+}
+
+// Seal encrypts the contents of the file called name. The name is
+// authenticated, so one sealed file can't be swapped for another.
+func (k *StorageKey) Seal(name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, sealedMagic...), nonce...)
+	return k.aead.Seal(out, nonce, plaintext, []byte(name)), nil
+}
+
+// Open decrypts a file written by Seal. Files without the sealed header
+// predate the storage key and are returned as they are; callers seal them
+// again when they next write them.
+func (k *StorageKey) Open(name string, data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	plain, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s does not open with the storage key", name)
+	}
+	return plain, nil
+}
+
+// IsSealed reports whether data was written by StorageKey.Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
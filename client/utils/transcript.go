@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ChainStatus is the result of checking a received message against the
+// sender's transcript chain
+type ChainStatus int
+
+const (
+	ChainOK        ChainStatus = iota // follows the previous message
+	ChainStart                        // first chained message we see from this device
+	ChainGap                          // messages before this one never arrived
+	ChainFork                         // right position, but it doesn't follow the message we have
+	ChainReordered                    // older than a message we already have
+	ChainRestart                      // the sender started over, e.g. after losing their state
+)
+
+// chainState is the last link of one direction of a transcript chain
+type chainState struct {
+	Seq  uint32 `json:"seq"`
+	Hash []byte `json:"hash"`
+}
+
+// Transcript tracks the hash chains of a conversation with one contact, kept
+// in keys/<owner>_transcripts/<peer>.json. Each sending device has its own
+// chain: Sent is ours, Received holds one per device of the contact.
+type Transcript struct {
+	mu       sync.Mutex
+	path     string
+	Sent     chainState           `json:"sent"`
+	Received map[uint]*chainState `json:"received"`
+}
+
+// LoadTranscript reads the transcript state of owner's conversation with peer
+func LoadTranscript(owner, peer string) (*Transcript, error) {
+	t := &Transcript{
+		path:     filepath.Join(fmt.Sprintf("keys/%s_transcripts", owner), peer+".json"),
+		Received: map[uint]*chainState{},
+	}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("corrupt transcript %s: %w", t.path, err)
+	}
+	if t.Received == nil {
+		t.Received = map[uint]*chainState{}
+	}
+	return t, nil
+}
+
+// NextLink returns the sequence number and previous hash for the next
+// message we send. Chains start at 1, after an all-zero hash.
+func (t *Transcript) NextLink() (uint32, []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Sent.Hash == nil {
+		return 1, make([]byte, sha256.Size)
+	}
+	return t.Sent.Seq + 1, t.Sent.Hash
+}
+
+// RecordSent advances our chain once a message has been sent
+func (t *Transcript) RecordSent(seq uint32, hash []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Sent = chainState{Seq: seq, Hash: hash}
+}
+
+// CheckReceived checks a message from one of the contact's devices against
+// that device's chain and advances it. missing is the number of messages
+// skipped for ChainGap.
+func (t *Transcript) CheckReceived(device uint, seq uint32, prev, hash []byte) (status ChainStatus, missing uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.Received[device]
+	next := &chainState{Seq: seq, Hash: hash}
+	switch {
+	case !ok:
+		t.Received[device] = next
+		return ChainStart, 0
+	case seq == 1 && bytes.Equal(prev, make([]byte, sha256.Size)) && last.Seq >= 1:
+		t.Received[device] = next
+		return ChainRestart, 0
+	case seq <= last.Seq:
+		return ChainReordered, 0
+	case seq > last.Seq+1:
+		t.Received[device] = next
+		return ChainGap, seq - last.Seq - 1
+	case !bytes.Equal(prev, last.Hash):
+		t.Received[device] = next
+		return ChainFork, 0
+	}
+	t.Received[device] = next
+	return ChainOK, 0
+}
+
+// Save writes the transcript state back to disk
+func (t *Transcript) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
@@ -8,10 +8,24 @@ import (
 )
 
 type UserInfo struct {
-	ID        uint   `json:"id"`
-	Username  string `json:"username"`
+	ID         uint              `json:"id"`
+	Username   string            `json:"username"`
+	PublicKey  string            `json:"public_key"`
+	KeyType    string            `json:"key_type"`
+	CreatedAt  string            `json:"created_at"`
+	KeyHistory []KeyHistoryEntry `json:"key_history"`
+	// Proof that PublicKey is in the key transparency log
+	Transparency *KeyLogProof `json:"transparency"`
+}
+
+// KeyHistoryEntry is a key the user rotated away from, with the statement
+// (signed by that key) that authorized the rotation
+type KeyHistoryEntry struct {
 	PublicKey string `json:"public_key"`
-	CreatedAt string `json:"created_at"`
+	KeyType   string `json:"key_type"`
+	Statement string `json:"statement"`
+	Signature string `json:"signature"`
+	RetiredAt string `json:"retired_at"`
 }
 
 type PendingRequest struct {
@@ -25,7 +39,8 @@ var BaseURL = "http://localhost:8080" // replace with your server URL
 var Requests []PendingRequest
 
 // GetUser calls /auth/user-info?username=<username>
-// Returns UserInfo struct and true if user exists, else nil and false
+// Returns UserInfo struct and true if user exists, else nil and false.
+// A key that isn't in the key transparency log is treated as an error.
 func GetUser(username string, jwtToken string) (*UserInfo, bool) {
 	client := resty.New()
 	resp, err := client.R().
@@ -48,6 +63,17 @@ func GetUser(username string, jwtToken string) (*UserInfo, bool) {
 			return nil, false
 		}
 
+		// The key must be logged for the user we asked about, not whoever
+		// the server says it is
+		if result.User.Username != username {
+			fmt.Printf("❌ Asked for %s but the server answered for %s\n", username, result.User.Username)
+			return nil, false
+		}
+		if err := VerifyKeyLog(username, PrimaryDevice, result.User.PublicKey, result.User.Transparency); err != nil {
+			fmt.Printf("❌ Key transparency check failed for %s: %v\n", username, err)
+			return nil, false
+		}
+
 		return &result.User, true
 	}
 
@@ -17,10 +17,29 @@ func ConnectToDB()error {
 
 	dbUrl := os.Getenv("DB_URL")
 	db,err := gorm.Open(postgres.Open(dbUrl),&gorm.Config{})
+	if err != nil {
+		return err
+	}
+	backfillBatches := db.Migrator().HasTable(&Message{}) && !db.Migrator().HasColumn(&Message{}, "BatchID")
 	// create table if not exists or update it if any columns changes
-    if err := db.AutoMigrate(&User{}, &Connection{}, &Message{}); err != nil {
+    if err := db.AutoMigrate(&User{}, &Connection{}, &Message{}, &Device{}, &PrekeyBundle{}, &OneTimePrekey{}, &KeyHistory{}, &KeyEscrow{}, &KeyLogEntry{}, &Group{}, &GroupMember{}); err != nil {
 		return err
 	}
+	// Prekey bundles used to be unique per user; they are now per device
+	if db.Migrator().HasIndex(&PrekeyBundle{}, "idx_prekey_bundles_user_id") {
+		if err := db.Migrator().DropIndex(&PrekeyBundle{}, "idx_prekey_bundles_user_id"); err != nil {
+			return err
+		}
+	}
+	// Messages stored before batch IDs were grouped by their sender copy,
+	// which every row of one send shares
+	if backfillBatches {
+		if err := db.Exec(`UPDATE messages SET batch_id = b.id FROM
+			(SELECT MIN(id) AS id, sender_content FROM messages WHERE sender_content <> '' GROUP BY sender_content) b
+			WHERE messages.sender_content = b.sender_content`).Error; err != nil {
+			return err
+		}
+	}
 	DB_Conn = db 
 	return nil
 }
\ No newline at end of file
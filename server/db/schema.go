@@ -7,7 +7,9 @@ type User struct {
 	Username  string    `gorm:"uniqueIndex;not null" json:"username"` // Unique and required column
 	Password  string    `gorm:"not null" json:"password"`           // Required column, will store hashed passwords
 	PublicKey string    `gorm:"not null" json:"public_key"`         // Required column for storing public key
+	KeyType   string    `gorm:"not null;default:'rsa'" json:"key_type"` // "rsa" or "curve25519", detected from PublicKey
 	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`   // Automatically set when a new row is created
+	LastSeenAt *time.Time `json:"last_seen_at"`                     // When the user's last WebSocket closed
 }
 
 type Connection struct {
@@ -23,10 +25,110 @@ type Connection struct {
 
 type Message struct {
     ID         uint      `gorm:"primaryKey" json:"id"`
-    SenderID   uint      `gorm:"not null" json:"sender_id"`
-    ReceiverID uint      `gorm:"not null" json:"receiver_id"`
+    SenderID   uint      `gorm:"not null;index:idx_messages_sender_receiver" json:"sender_id"`
+    ReceiverID uint      `gorm:"not null;index:idx_messages_sender_receiver" json:"receiver_id"`
     Content    string    `gorm:"not null" json:"content"` // encrypted text
+    Signature  string    `gorm:"not null;default:''" json:"signature"` // sender's signature over content
+    SenderDeviceID   uint `gorm:"not null;default:0" json:"sender_device_id"`
+    ReceiverDeviceID uint `gorm:"not null;default:0;index" json:"receiver_device_id"` // device the content is encrypted to
+    SenderContent    string `gorm:"type:text;not null;default:''" json:"sender_content"` // the same message encrypted to the sender's own key
+    SenderSignature  string `gorm:"not null;default:''" json:"sender_signature"` // sender's signature over sender_content
     Delivered  bool      `gorm:"default:false" json:"delivered"`
+    DeliveredAt      *time.Time `json:"delivered_at"` // when the receiver device acknowledged it
+    ReadAt           *time.Time `json:"read_at"`      // when it was shown to the receiver
+    GroupID          uint `gorm:"not null;default:0;index" json:"group_id"` // group it was sent to, 0 for a direct message
+    BatchID          uint `gorm:"not null;default:0" json:"batch_id"` // ID of the first row stored for the same send
     CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
 }
 
+// Group is a conversation between several users. A message to a group is
+// stored like a direct message, once per member device, with GroupID set.
+type Group struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// GroupMember is a user's membership of a group, with their role in it
+type GroupMember struct {
+	ID       uint      `gorm:"primaryKey" json:"-"`
+	GroupID  uint      `gorm:"not null;uniqueIndex:idx_group_member" json:"group_id"`
+	UserID   uint      `gorm:"not null;uniqueIndex:idx_group_member;index" json:"-"`
+	Role     string    `gorm:"type:varchar(20);not null;default:'member'" json:"role"` // owner, admin or member
+	JoinedAt time.Time `gorm:"autoCreateTime" json:"joined_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// Device is an extra device on an account, with its own key pair. The key in
+// User.PublicKey belongs to the primary device, which has ID 0. Certificate
+// is the primary key's signature over the device statement, so contacts can
+// tell the account itself added the device.
+type Device struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;index" json:"-"`
+	Name        string    `gorm:"not null" json:"name"`
+	PublicKey   string    `gorm:"not null" json:"public_key"`
+	KeyType     string    `gorm:"not null;default:'rsa'" json:"key_type"`
+	Certificate string    `gorm:"not null;default:''" json:"certificate"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// PrekeyBundle holds the X25519 keys a device publishes so others can start
+// forward-secret sessions with it. Keys are base64, and Signature is made
+// with the device's long-term key so clients can detect substituted bundles.
+type PrekeyBundle struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserID         uint      `gorm:"uniqueIndex:idx_prekey_user_device;not null" json:"user_id"`
+	DeviceID       uint      `gorm:"uniqueIndex:idx_prekey_user_device;not null;default:0" json:"device_id"`
+	IdentityKey    string    `gorm:"not null" json:"identity_key"`
+	SignedPrekeyID uint32    `gorm:"not null" json:"signed_prekey_id"`
+	SignedPrekey   string    `gorm:"not null" json:"signed_prekey"`
+	Signature      string    `gorm:"not null" json:"signature"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// OneTimePrekey is handed out at most once, then deleted
+type OneTimePrekey struct {
+	ID        uint   `gorm:"primaryKey" json:"-"`
+	UserID    uint   `gorm:"not null;index" json:"-"`
+	DeviceID  uint   `gorm:"not null;default:0;index" json:"-"`
+	KeyID     uint32 `gorm:"not null" json:"id"`
+	PublicKey string `gorm:"not null" json:"key"`
+}
+
+// KeyHistory records a public key a user has rotated away from, with the
+// rotation statement signed by that key naming its successor
+type KeyHistory struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	PublicKey string    `gorm:"not null" json:"public_key"`
+	KeyType   string    `gorm:"not null;default:'rsa'" json:"key_type"`
+	Statement string    `gorm:"not null" json:"statement"`
+	Signature string    `gorm:"not null" json:"signature"` // by PublicKey, over Statement
+	RetiredAt time.Time `gorm:"autoCreateTime" json:"retired_at"`
+}
+
+// KeyEscrow is a device's private key encrypted under a recovery code that
+// only the user knows. The server stores it for account recovery but can't
+// decrypt it.
+type KeyEscrow struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    uint      `gorm:"uniqueIndex:idx_escrow_user_device;not null" json:"-"`
+	DeviceID  uint      `gorm:"uniqueIndex:idx_escrow_user_device;not null;default:0" json:"device_id"`
+	Blob      string    `gorm:"type:text;not null" json:"blob"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// KeyLogEntry is one leaf of the key transparency log: a public key that was
+// registered, rotated in, added or removed. Rows are append-only and
+// LeafIndex is the leaf's position in the log's Merkle tree.
+type KeyLogEntry struct {
+	ID        uint   `gorm:"primaryKey" json:"-"`
+	LeafIndex uint64 `gorm:"uniqueIndex;not null" json:"index"`
+	Username  string `gorm:"not null;index" json:"username"`
+	DeviceID  uint   `gorm:"not null" json:"device_id"`
+	KeyDigest string `gorm:"not null" json:"key"`       // hex SHA-256 of the key's DER
+	Event     string `gorm:"not null" json:"event"`     // register, rotate, add-device, remove-device or import
+	LoggedAt  int64  `gorm:"not null" json:"logged_at"` // unix seconds
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // ---------------- User Model ----------------
@@ -23,16 +24,22 @@ type User struct {
 	Username  string    `gorm:"uniqueIndex;not null" json:"username"` // Unique and required column
 	Password  string    `gorm:"not null" json:"password"`             // Required column, will store hashed passwords
 	PublicKey string    `gorm:"not null" json:"public_key"`           // Required column for storing public key
+	KeyType   string    `gorm:"not null;default:'rsa'" json:"-"`      // Detected from PublicKey, never taken from the client
 	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`     // Automatically set when a new row is created
 }
 
 // ---------------- Register ----------------
 // Handles user registration.
 // Steps:
-// 1. Parse request body into User struct.
-// 2. Hash password before saving.
-// 3. Insert user into "users" table using GORM's Create method.
-// 4. Returns success or error response.
+// 1. Parse request body into User struct, plus the answer to a challenge
+//    from POST /auth/register/challenge.
+// 2. Validate the public key and record its type (rsa or curve25519).
+// 3. Check the client holds the private key: it must have signed the
+//    challenge (and, for curve keys, proven the X25519 key too).
+// 4. Hash password before saving.
+// 5. Insert user into "users" table using GORM's Create method, and append
+//    their key to the key transparency log in the same transaction.
+// 6. Returns success or error response.
 func register(c *fiber.Ctx) error {
 	conn := db.DB_Conn
 	if conn == nil {
@@ -43,6 +50,19 @@ func register(c *fiber.Ctx) error {
 	if err := c.BodyParser(body); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body " + err.Error()})
 	}
+	proof := struct {
+		Challenge string `json:"challenge"`
+		Signature string `json:"signature"` // over registrationStatement
+		KeyProof  string `json:"key_proof"` // curve keys only, see verifyPossession
+	}{}
+	if err := c.BodyParser(&proof); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body " + err.Error()})
+	}
+	// Check the challenge first; it is spent once answered
+	ch, err := openChallenge(proof.Challenge, "register")
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Validate username format: only letters, numbers, underscores
 	matched, err := regexp.MatchString(`^[a-zA-Z0-9_]+$`, body.Username)
@@ -59,6 +79,22 @@ func register(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Username already taken"})
 	}
 
+	// Clients encrypt to this key, so refuse anything they can't use
+	key, err := parsePublicKey(body.PublicKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid public key: " + err.Error()})
+	}
+	body.KeyType = key.Type
+
+	// A client that can't sign with the key can't decrypt with it either
+	statement := registrationStatement(body.Username, key, proof.Challenge)
+	if err := verifyPossession(ch, key, statement, proof.Signature, proof.KeyProof); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := ch.spend(); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	// Hash the password before storing
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -66,8 +102,14 @@ func register(c *fiber.Ctx) error {
 	}
 	body.Password = string(hashedPassword)
 
-	// Save the user into the "users" table
-	if err := conn.Create(&body).Error; err != nil {
+	// Save the user into the "users" table and log their key
+	err = withKeyLog(func(tx *gorm.DB, kl *keyLogWriter) error {
+		if err := tx.Create(&body).Error; err != nil {
+			return err
+		}
+		return kl.add(body.Username, primaryDevice, key, keyEventRegister)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to register user " + err.Error()})
 	}
 
@@ -113,9 +155,22 @@ func login(c *fiber.Ctx) error {
 	}
 
 	// Generate JWT token
+	tokenString, err := issueToken(user.ID, user.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token " + err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Login successful",
+		"token":   tokenString,
+	})
+}
+
+// issueToken signs the JWT every login method returns
+func issueToken(userID uint, username string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":  user.ID,
-		"username": user.Username,
+		"user_id":  userID,
+		"username": username,
 		"exp":      time.Now().Add(time.Hour * 72).Unix(), // Token expires in 3 days
 	})
 
@@ -124,11 +179,75 @@ func login(c *fiber.Ctx) error {
 		secret = "secret" // fallback (not recommended in production)
 	}
 
-	tokenString, err := token.SignedString([]byte(secret))
+	return token.SignedString([]byte(secret))
+}
+
+// ---------------- Login Challenge ----------------
+// Issues a nonce for passwordless login (see loginWithKey).
+func loginChallenge(c *fiber.Ctx) error {
+	nonce, err := issueChallenge("login")
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token " + err.Error()})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create challenge " + err.Error()})
+	}
+	return c.JSON(fiber.Map{"challenge": nonce, "expires_in": int(challengeTTL.Seconds())})
+}
+
+// ---------------- Login With Key ----------------
+// Passwordless login: the client signs a challenge with the private key of
+// one of the user's devices.
+// Steps:
+// 1. Parse username, device ID, challenge and signature.
+// 2. Check the challenge is one we issued for login and hasn't expired.
+// 3. Look up the device's stored public key.
+// 4. Verify the signature over loginStatement.
+// 5. Spend the challenge, so the answer can't be replayed.
+// 6. Issue the same JWT as login.
+func loginWithKey(c *fiber.Ctx) error {
+	body := struct {
+		Username  string `json:"username"`
+		DeviceID  uint   `json:"device_id"`
+		Challenge string `json:"challenge"`
+		Signature string `json:"signature"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body " + err.Error()})
+	}
+
+	ch, err := openChallenge(body.Challenge, "login")
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var user db.User
+	if err := db.DB_Conn.Where("username = ?", body.Username).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	pubPEM := user.PublicKey
+	if body.DeviceID != primaryDevice {
+		var device db.Device
+		if err := db.DB_Conn.Where("id = ? AND user_id = ?", body.DeviceID, user.ID).First(&device).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
+		}
+		pubPEM = device.PublicKey
+	}
+	key, err := parsePublicKey(pubPEM)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Stored key is invalid: " + err.Error()})
+	}
+
+	statement := loginStatement(user.Username, body.DeviceID, body.Challenge)
+	if err := verifyStatement(key, statement, body.Signature); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	// Only correct answers are remembered, so wrong ones can't fill memory
+	if err := ch.spend(); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 
+	tokenString, err := issueToken(user.ID, user.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token " + err.Error()})
+	}
 	return c.JSON(fiber.Map{
 		"message": "Login successful",
 		"token":   tokenString,
@@ -186,17 +305,135 @@ func getUserByUsername(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
 
+	// Past keys, newest first, so clients can follow a chain of rotations
+	history := []db.KeyHistory{}
+	if err := db.DB_Conn.Where("user_id = ?", user.ID).Order("retired_at desc").Find(&history).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Proof that this key is in the transparency log
+	proof, err := keyLogProofFor(user.Username, primaryDevice)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	// Return only safe fields
 	return c.JSON(fiber.Map{
 		"user": map[string]interface{}{
-			"id":         user.ID,
-			"username":   user.Username,
-			"public_key": user.PublicKey,
-			"created_at": user.CreatedAt,
+			"id":           user.ID,
+			"username":     user.Username,
+			"public_key":   user.PublicKey,
+			"key_type":     user.KeyType,
+			"created_at":   user.CreatedAt,
+			"key_history":  history,
+			"transparency": proof,
 		},
 	})
 }
 
+// ---------------- Rotate Key ----------------
+// Replaces the caller's public key.
+// Steps:
+// 1. Parse the new key and the rotation statement.
+// 2. Check the statement names this user, the current key and the new key.
+// 3. Verify the statement is signed by the current key (authorizes the change)
+//    and by the new key (proves the caller holds it).
+// 4. Check the new key certifies every extra device (see deviceStatement).
+// 5. Move the current key to key_histories, store the new one and log it.
+// The primary device's prekeys were signed with the old key, so they are
+// dropped and must be published again.
+func rotateKey(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+
+	body := struct {
+		NewPublicKey string `json:"new_public_key"`
+		Statement    string `json:"statement"`
+		Signature    string `json:"signature"`     // by the current key
+		NewSignature string `json:"new_signature"` // by the new key
+		// Device ID -> new certificate for each extra device
+		DeviceCertificates map[uint]string `json:"device_certificates"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var user db.User
+	if err := db.DB_Conn.First(&user, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	oldKey, err := parsePublicKey(user.PublicKey)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Stored key is invalid: " + err.Error()})
+	}
+	newKey, err := parsePublicKey(body.NewPublicKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid new key: " + err.Error()})
+	}
+	if err := checkRotationStatement(body.Statement, user.Username, oldKey.DER, newKey.DER); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := verifyStatement(oldKey, body.Statement, body.Signature); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Statement not signed by current key: " + err.Error()})
+	}
+	if err := verifyStatement(newKey, body.Statement, body.NewSignature); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Statement not signed by new key: " + err.Error()})
+	}
+
+	// Device certificates were signed with the old key
+	var devices []db.Device
+	if err := db.DB_Conn.Where("user_id = ?", user.ID).Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	for _, device := range devices {
+		deviceKey, err := parsePublicKey(device.PublicKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Stored key is invalid: " + err.Error()})
+		}
+		cert := body.DeviceCertificates[device.ID]
+		if err := verifyStatement(newKey, deviceStatement(user.Username, device.Name, deviceKey), cert); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Device %d is not certified by the new key", device.ID)})
+		}
+	}
+
+	err = withKeyLog(func(tx *gorm.DB, kl *keyLogWriter) error {
+		history := db.KeyHistory{
+			UserID:    user.ID,
+			PublicKey: user.PublicKey,
+			KeyType:   oldKey.Type,
+			Statement: body.Statement,
+			Signature: body.Signature,
+		}
+		if err := tx.Create(&history).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Updates(map[string]interface{}{"public_key": body.NewPublicKey, "key_type": newKey.Type}).Error; err != nil {
+			return err
+		}
+		for _, device := range devices {
+			if err := tx.Model(&device).Update("certificate", body.DeviceCertificates[device.ID]).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ? AND device_id = ?", user.ID, primaryDevice).Delete(&db.OneTimePrekey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND device_id = ?", user.ID, primaryDevice).Delete(&db.PrekeyBundle{}).Error; err != nil {
+			return err
+		}
+		return kl.add(user.Username, primaryDevice, newKey, keyEventRotate)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to rotate key " + err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Key rotated successfully"})
+}
+
 func JWTMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		tokenStr := c.Get("Authorization")
@@ -241,7 +478,20 @@ func JWTMiddleware() fiber.Handler {
 // Maps endpoints to handlers
 func HandleAuth(router fiber.Router) {
 	router.Post("/login", login)
+	router.Post("/login/challenge", loginChallenge)
+	router.Post("/login/key", loginWithKey)
+	router.Post("/register/challenge", registerChallenge)
 	router.Post("/register", register)
 	router.Get("/validate", validate)
 	router.Get("/user-info",JWTMiddleware(),getUserByUsername)
+	router.Post("/prekeys", JWTMiddleware(), uploadPrekeys)
+	router.Get("/prekeys", JWTMiddleware(), getPrekeyBundle)
+	router.Post("/rotate-key", JWTMiddleware(), rotateKey)
+	router.Post("/devices/challenge", JWTMiddleware(), deviceChallenge)
+	router.Post("/devices", JWTMiddleware(), registerDevice)
+	router.Get("/devices", JWTMiddleware(), listDevices)
+	router.Delete("/devices/:id", JWTMiddleware(), removeDevice)
+	router.Post("/escrow", JWTMiddleware(), storeEscrow)
+	router.Get("/escrow", JWTMiddleware(), getEscrow)
+	router.Delete("/escrow", JWTMiddleware(), deleteEscrow)
 }
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// challengeTTL is how long a challenge can be answered
+	challengeTTL = 5 * time.Minute
+	// challengeRandom is the number of random bytes in a nonce
+	challengeRandom = 16
+)
+
+// Challenges are stateless: a nonce is random bytes, its expiry and a MAC
+// over both and the purpose, keyed with a secret made at startup. Handing
+// them out costs no memory, so anonymous clients can't use them up; only
+// answered ones are remembered, until they expire, so each works once.
+var challengeSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+var (
+	spentMu    sync.Mutex
+	spentNonce = map[string]time.Time{}
+)
+
+// challenge is a verified server nonce a client proves key possession
+// against
+type challenge struct {
+	nonce   string
+	random  []byte
+	expires time.Time
+}
+
+// challengeMAC binds a nonce's random bytes and expiry to its purpose
+func challengeMAC(purpose string, body []byte) []byte {
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// issueChallenge returns a new base64 nonce for purpose
+func issueChallenge(purpose string) (string, error) {
+	body := make([]byte, challengeRandom, challengeRandom+8)
+	if _, err := rand.Read(body); err != nil {
+		return "", err
+	}
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Add(challengeTTL).Unix()))
+	return base64.StdEncoding.EncodeToString(append(body, challengeMAC(purpose, body)...)), nil
+}
+
+// openChallenge checks that nonce was issued for purpose, hasn't expired
+// and hasn't been answered yet
+func openChallenge(nonce, purpose string) (challenge, error) {
+	errBad := fmt.Errorf("unknown or expired challenge")
+	raw, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != challengeRandom+8+sha256.Size {
+		return challenge{}, errBad
+	}
+	body, mac := raw[:challengeRandom+8], raw[challengeRandom+8:]
+	if !hmac.Equal(mac, challengeMAC(purpose, body)) {
+		return challenge{}, errBad
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(body[challengeRandom:])), 0)
+	if time.Now().After(expires) {
+		return challenge{}, errBad
+	}
+	spentMu.Lock()
+	_, spent := spentNonce[nonce]
+	spentMu.Unlock()
+	if spent {
+		return challenge{}, errBad
+	}
+	return challenge{nonce: nonce, random: body[:challengeRandom], expires: expires}, nil
+}
+
+// spend marks the challenge answered. Call it once the answer checks out;
+// it fails if another request answered the same challenge first.
+func (ch challenge) spend() error {
+	spentMu.Lock()
+	defer spentMu.Unlock()
+	now := time.Now()
+	for n, expires := range spentNonce {
+		if now.After(expires) {
+			delete(spentNonce, n)
+		}
+	}
+	if _, spent := spentNonce[ch.nonce]; spent {
+		return fmt.Errorf("challenge already answered")
+	}
+	spentNonce[ch.nonce] = ch.expires
+	return nil
+}
+
+// serverKey derives the challenge's ephemeral X25519 key. Ed25519
+// signatures say nothing about the X25519 half of a curve key, so new keys
+// also prove they can complete a key agreement with this one.
+func (ch challenge) serverKey() (*ecdh.PrivateKey, error) {
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write([]byte("x25519"))
+	mac.Write([]byte{0})
+	mac.Write(ch.random)
+	return ecdh.X25519().NewPrivateKey(mac.Sum(nil))
+}
+
+// issueKeyChallenge issues a challenge for a new key and returns its nonce
+// and the server's X25519 public key, both base64
+func issueKeyChallenge(purpose string) (string, string, error) {
+	nonce, err := issueChallenge(purpose)
+	if err != nil {
+		return "", "", err
+	}
+	ch, err := openChallenge(nonce, purpose)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := ch.serverKey()
+	if err != nil {
+		return "", "", err
+	}
+	return nonce, base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// verifyPossession checks a client's answer to a challenge: a signature over
+// the statement with the key, and for curve keys a key proof, the base64
+// HMAC-SHA256 of the statement's SHA-256 keyed with the X25519 shared secret
+// between the key and the challenge's server key.
+func verifyPossession(ch challenge, key *accountKey, statement, signature, keyProof string) error {
+	if err := verifyStatement(key, statement, signature); err != nil {
+		return fmt.Errorf("challenge not signed by the key: %w", err)
+	}
+	if key.Type != keyTypeCurve {
+		return nil
+	}
+	proof, err := base64.StdEncoding.DecodeString(keyProof)
+	if err != nil || len(proof) == 0 {
+		return fmt.Errorf("missing X25519 key proof")
+	}
+	serverKey, err := ch.serverKey()
+	if err != nil {
+		return err
+	}
+	shared, err := serverKey.ECDH(key.dh)
+	if err != nil {
+		return fmt.Errorf("bad X25519 key")
+	}
+	digest := sha256.Sum256([]byte(statement))
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(digest[:])
+	if !hmac.Equal(mac.Sum(nil), proof) {
+		return fmt.Errorf("bad X25519 key proof")
+	}
+	return nil
+}
+
+// ---------------- Registration Challenge ----------------
+// Issues a nonce the client signs with its new key before registering.
+// Steps:
+// 1. Generate a nonce, MACed together with its expiry; nothing is stored.
+// 2. Derive an ephemeral X25519 key from the nonce.
+// 3. Return both; the client answers in POST /auth/register.
+func registerChallenge(c *fiber.Ctx) error {
+	nonce, serverKey, err := issueKeyChallenge("register")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create challenge " + err.Error()})
+	}
+	return c.JSON(fiber.Map{"challenge": nonce, "server_key": serverKey, "expires_in": int(challengeTTL.Seconds())})
+}
+
+// ---------------- Device Challenge ----------------
+// Issues a nonce a new device signs with its key before it is registered
+// with POST /auth/devices. Same as the registration challenge, but only for
+// logged-in users.
+func deviceChallenge(c *fiber.Ctx) error {
+	if c.Locals("user") == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	nonce, serverKey, err := issueKeyChallenge("device")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create challenge " + err.Error()})
+	}
+	return c.JSON(fiber.Map{"challenge": nonce, "server_key": serverKey, "expires_in": int(challengeTTL.Seconds())})
+}
+
+// loginStatement is what a client signs for passwordless login:
+//
+//	cli-chat login
+//	username: <username>
+//	device: <device id>
+//	challenge: <nonce>
+func loginStatement(username string, deviceID uint, nonce string) string {
+	return fmt.Sprintf("cli-chat login\nusername: %s\ndevice: %d\nchallenge: %s", username, deviceID, nonce)
+}
+
+// registrationStatement is what a registering client signs. Clients build
+// the same text:
+//
+//	cli-chat registration
+//	username: <username>
+//	key: <hex sha256 of key DER>
+//	challenge: <nonce>
+func registrationStatement(username string, key *accountKey, nonce string) string {
+	return fmt.Sprintf("cli-chat registration\nusername: %s\nkey: %s\nchallenge: %s", username, keyFingerprint(key.DER), nonce)
+}
+
+// deviceChallengeStatement is what a new device signs with its own key:
+//
+//	cli-chat device registration
+//	username: <username>
+//	key: <hex sha256 of key DER>
+//	challenge: <nonce>
+func deviceChallengeStatement(username string, key *accountKey, nonce string) string {
+	return fmt.Sprintf("cli-chat device registration\nusername: %s\nkey: %s\nchallenge: %s", username, keyFingerprint(key.DER), nonce)
+}
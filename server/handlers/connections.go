@@ -196,7 +196,15 @@ func getPendingRequests(c *fiber.Ctx) error {
 	return c.JSON(resp)
 }
 
-
+// isAcceptedConnection reports whether two users have an accepted connection
+func isAcceptedConnection(userA, userB uint) bool {
+	var count int64
+	db.DB_Conn.Model(&db.Connection{}).
+		Where("((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)) AND status = ?",
+			userA, userB, userB, userA, "accepted").
+		Count(&count)
+	return count > 0
+}
 
 func HandleConnections(app fiber.Router) {
 	app.Get("/", getAllConnections)             // accepted connections
@@ -204,4 +212,5 @@ func HandleConnections(app fiber.Router) {
 	app.Post("/connect", sendConnectionRequest) // send request
 	app.Post("/respond", respondConnection)     // accept/reject
 	app.Get("/pending/count", getPendingCount)
+	app.Get("/presence", getPresence) // online status of accepted connections
 }
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// maxDevices caps how many extra devices an account may register
+const maxDevices = 10
+
+// primaryDevice is the device ID of the key in User.PublicKey
+const primaryDevice uint = 0
+
+// errUnknownDevice is returned when a device ID doesn't belong to the user
+var errUnknownDevice = errors.New("unknown device")
+
+// requestDeviceID returns the device named by the X-Device-ID header, or the
+// primary device if it is absent
+func requestDeviceID(c *fiber.Ctx, userID uint) (uint, error) {
+	return parseDeviceID(c.Get("X-Device-ID"), userID)
+}
+
+// parseDeviceID checks that raw names one of the user's devices
+func parseDeviceID(raw string, userID uint) (uint, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return primaryDevice, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, errUnknownDevice
+	}
+	if uint(id) == primaryDevice {
+		return primaryDevice, nil
+	}
+	var count int64
+	db.DB_Conn.Model(&db.Device{}).Where("id = ? AND user_id = ?", id, userID).Count(&count)
+	if count == 0 {
+		return 0, errUnknownDevice
+	}
+	return uint(id), nil
+}
+
+// userDevices returns all devices of a user, the primary device first
+func userDevices(user db.User) ([]db.Device, error) {
+	devices := []db.Device{{
+		ID:        primaryDevice,
+		UserID:    user.ID,
+		Name:      "primary",
+		PublicKey: user.PublicKey,
+		KeyType:   user.KeyType,
+		CreatedAt: user.CreatedAt,
+	}}
+	var extra []db.Device
+	if err := db.DB_Conn.Where("user_id = ?", user.ID).Order("id asc").Find(&extra).Error; err != nil {
+		return nil, err
+	}
+	return append(devices, extra...), nil
+}
+
+// ---------------- Register Device ----------------
+// Adds a device with its own key pair to the caller's account. A password
+// alone isn't enough: the primary device has to certify the new key, and
+// the new device has to prove it holds it.
+// Steps:
+//  1. Take the challenge from POST /auth/devices/challenge.
+//  2. Validate the name and public key (RSA or curve25519).
+//  3. Verify the certificate, the primary key's signature over
+//     deviceStatement, and the new key's answer to the challenge.
+//  4. Enforce the device limit.
+//  5. Store the device, log its key in the transparency log, and return its
+//     ID, which the device sends as X-Device-ID from then on.
+func registerDevice(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+
+	body := struct {
+		Name        string `json:"name"`
+		PublicKey   string `json:"public_key"`
+		Certificate string `json:"certificate"` // by the primary key, over deviceStatement
+		Challenge   string `json:"challenge"`
+		Signature   string `json:"signature"` // by the new key, over deviceChallengeStatement
+		KeyProof    string `json:"key_proof"` // curve keys only, see verifyPossession
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	// Check the challenge first; it is spent once answered
+	ch, err := openChallenge(body.Challenge, "device")
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len(body.Name) > 64 || strings.ContainsAny(body.Name, "\r\n") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Device name must be 1-64 characters on one line"})
+	}
+	key, err := parsePublicKey(body.PublicKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid public key: " + err.Error()})
+	}
+
+	var user db.User
+	if err := db.DB_Conn.First(&user, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	primaryKey, err := parsePublicKey(user.PublicKey)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Stored key is invalid: " + err.Error()})
+	}
+	if err := verifyStatement(primaryKey, deviceStatement(user.Username, body.Name, key), body.Certificate); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Device not certified by the primary key: " + err.Error()})
+	}
+	statement := deviceChallengeStatement(user.Username, key, body.Challenge)
+	if err := verifyPossession(ch, key, statement, body.Signature, body.KeyProof); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := ch.spend(); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var count int64
+	db.DB_Conn.Model(&db.Device{}).Where("user_id = ?", userID).Count(&count)
+	if count >= maxDevices {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Device limit reached, remove a device first"})
+	}
+
+	device := db.Device{UserID: userID, Name: body.Name, PublicKey: body.PublicKey, KeyType: key.Type, Certificate: body.Certificate}
+	err = withKeyLog(func(tx *gorm.DB, kl *keyLogWriter) error {
+		if err := tx.Create(&device).Error; err != nil {
+			return err
+		}
+		return kl.add(user.Username, device.ID, key, keyEventAddDevice)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to register device " + err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Device registered", "device": device})
+}
+
+// deviceStatement is what the primary key signs to certify a device:
+//
+//	cli-chat device
+//	username: <username>
+//	name: <device name>
+//	key: <hex sha256 of key DER>
+func deviceStatement(username, name string, key *accountKey) string {
+	return fmt.Sprintf("cli-chat device\nusername: %s\nname: %s\nkey: %s", username, name, keyFingerprint(key.DER))
+}
+
+// ---------------- List Devices ----------------
+// Returns every device of a user with its public key. Senders encrypt each
+// message once per device.
+func listDevices(c *fiber.Ctx) error {
+	username := c.Query("username")
+	if username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Please provide username"})
+	}
+
+	var user db.User
+	if err := db.DB_Conn.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	devices, err := userDevices(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Each key comes with its proof of inclusion in the transparency log
+	type loggedDevice struct {
+		db.Device
+		Transparency *keyLogProof `json:"transparency"`
+	}
+	result := make([]loggedDevice, 0, len(devices))
+	for _, device := range devices {
+		proof, err := keyLogProofFor(user.Username, device.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		result = append(result, loggedDevice{Device: device, Transparency: proof})
+	}
+	return c.JSON(fiber.Map{"devices": result})
+}
+
+// ---------------- Remove Device ----------------
+// Deletes one of the caller's extra devices, its prekeys, key escrow and
+// anything still queued for it, logs the removal in the key transparency log,
+// and disconnects it. The primary device can't be removed.
+func removeDevice(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+
+	deviceID, err := parseDeviceID(c.Params("id"), userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+	if deviceID == primaryDevice {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The primary device cannot be removed"})
+	}
+
+	var user db.User
+	var device db.Device
+	if err := db.DB_Conn.First(&user, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if err := db.DB_Conn.Where("id = ? AND user_id = ?", deviceID, userID).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+
+	err = withKeyLog(func(tx *gorm.DB, kl *keyLogWriter) error {
+		if err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&db.OneTimePrekey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&db.PrekeyBundle{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("receiver_id = ? AND receiver_device_id = ? AND delivered = ?", userID, deviceID, false).Delete(&db.Message{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&db.KeyEscrow{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND user_id = ?", deviceID, userID).Delete(&db.Device{}).Error; err != nil {
+			return err
+		}
+		// Log the removal so the key can't quietly be served again
+		key, err := parsePublicKey(device.PublicKey)
+		if err != nil {
+			return nil
+		}
+		return kl.add(user.Username, deviceID, key, keyEventRemoveDevice)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to remove device " + err.Error()})
+	}
+
+	disconnectDevice(userID, deviceID)
+	return c.JSON(fiber.Map{"message": "Device removed"})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// maxEscrowSize bounds the stored blob; a key backup is a few KB
+const maxEscrowSize = 64 * 1024
+
+// ---------------- Store Escrow ----------------
+// Stores (or replaces) the calling device's encrypted key escrow.
+// The blob is encrypted client-side under a recovery code, never the login
+// password, so the server can't open it.
+func storeEscrow(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+	deviceID, err := requestDeviceID(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Unknown device"})
+	}
+
+	body := struct {
+		Blob string `json:"blob"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if body.Blob == "" || len(body.Blob) > maxEscrowSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Escrow blob is empty or too large"})
+	}
+
+	var escrow db.KeyEscrow
+	err = db.DB_Conn.Where("user_id = ? AND device_id = ?", userID, deviceID).First(&escrow).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	escrow.UserID = userID
+	escrow.DeviceID = deviceID
+	escrow.Blob = body.Blob
+	if err := db.DB_Conn.Save(&escrow).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store escrow " + err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Escrow stored"})
+}
+
+// ---------------- Get Escrow ----------------
+// Returns the caller's escrow for one of their devices (device_id, default
+// the primary device). Used by `recover` on a machine that has no key yet.
+func getEscrow(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+	deviceID, err := parseDeviceID(c.Query("device_id"), userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+
+	var escrow db.KeyEscrow
+	if err := db.DB_Conn.Where("user_id = ? AND device_id = ?", userID, deviceID).First(&escrow).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No escrow stored"})
+	}
+	return c.JSON(fiber.Map{"escrow": escrow})
+}
+
+// ---------------- Delete Escrow ----------------
+// Removes the calling device's escrow (opting out of recovery)
+func deleteEscrow(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+	deviceID, err := requestDeviceID(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Unknown device"})
+	}
+
+	if err := db.DB_Conn.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&db.KeyEscrow{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Escrow deleted"})
+}
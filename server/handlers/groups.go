@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Group roles. The owner can do everything, admins can invite and kick
+// members, and members can only talk and leave.
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+)
+
+// Group events sent to members in "group" frames
+const (
+	groupJoined = "joined"
+	groupLeft   = "left"
+	groupKicked = "kicked"
+	groupRole   = "role"
+)
+
+// maxGroupName is the longest group name accepted, in bytes
+const maxGroupName = 64
+
+// groupMemberInfo is a member as listed to the other members
+type groupMemberInfo struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Maps group endpoints to handlers
+func HandleGroups(app fiber.Router) {
+	app.Post("/", createGroup)
+	app.Get("/", listGroups)
+	app.Get("/:id", getGroup)
+	app.Post("/:id/invite", inviteToGroup)
+	app.Post("/:id/kick", kickFromGroup)
+	app.Post("/:id/leave", leaveGroup)
+	app.Post("/:id/role", setGroupRole)
+}
+
+// groupMembership returns userID's membership of the group in the :id
+// parameter, or writes the error response and returns nil
+func groupMembership(c *fiber.Ctx, userID uint) *db.GroupMember {
+	groupID, err := c.ParamsInt("id")
+	if err != nil || groupID <= 0 {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid group id"})
+		return nil
+	}
+	var member db.GroupMember
+	if err := db.DB_Conn.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		// Non-members can't tell a group they aren't in from one that doesn't exist
+		c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+		return nil
+	}
+	return &member
+}
+
+// groupMembers returns the members of a group with their users, oldest first
+func groupMembers(groupID uint) ([]db.GroupMember, error) {
+	var members []db.GroupMember
+	err := db.DB_Conn.Preload("User").Where("group_id = ?", groupID).Order("joined_at asc, id asc").Find(&members).Error
+	return members, err
+}
+
+// findGroupMember looks up the member of a group with the given username
+func findGroupMember(groupID uint, username string) (*db.GroupMember, error) {
+	var user db.User
+	if err := db.DB_Conn.Select("id", "username").Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, err
+	}
+	var member db.GroupMember
+	if err := db.DB_Conn.Where("group_id = ? AND user_id = ?", groupID, user.ID).First(&member).Error; err != nil {
+		return nil, err
+	}
+	member.User = user
+	return &member, nil
+}
+
+// notifyGroup tells the live connections of every member, and of the user
+// the event is about, that the membership changed
+func notifyGroup(groupID uint, event, username string, userID uint) {
+	members, err := groupMembers(groupID)
+	if err != nil {
+		log.Println("Failed to load group members:", err)
+		return
+	}
+	ids := []uint{userID}
+	for _, m := range members {
+		if m.UserID != userID {
+			ids = append(ids, m.UserID)
+		}
+	}
+	for _, id := range ids {
+		sendEvent(id, map[string]interface{}{
+			"type":     frameGroup,
+			"group_id": groupID,
+			"event":    event,
+			"username": username,
+		})
+	}
+}
+
+// ---------------- Create group ----------------
+// Steps:
+//  1. Validate the name
+//  2. Create the group with the logged-in user as its owner
+func createGroup(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	body := struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxGroupName {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Group name must be 1 to 64 characters"})
+	}
+
+	group := db.Group{Name: name}
+	err := db.DB_Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.GroupMember{GroupID: group.ID, UserID: userID, Role: roleOwner}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": group.ID, "name": group.Name, "role": roleOwner})
+}
+
+// ---------------- List groups ----------------
+// Steps:
+//  1. Return the groups the logged-in user is in, with their role and the
+//     number of members
+func listGroups(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	groups := []struct {
+		ID      uint   `json:"id"`
+		Name    string `json:"name"`
+		Role    string `json:"role"`
+		Members int64  `json:"members"`
+	}{}
+	if err := db.DB_Conn.Table("groups").
+		Select("groups.id, groups.name, gm.role, (SELECT COUNT(*) FROM group_members WHERE group_members.group_id = groups.id) AS members").
+		Joins("JOIN group_members gm ON gm.group_id = groups.id AND gm.user_id = ?", userID).
+		Order("groups.id asc").
+		Scan(&groups).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(groups)
+}
+
+// ---------------- Group info ----------------
+// Steps:
+//  1. Check the logged-in user is a member
+//  2. Return the group with its members and their roles
+func getGroup(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	me := groupMembership(c, userID)
+	if me == nil {
+		return nil
+	}
+	var group db.Group
+	if err := db.DB_Conn.First(&group, me.GroupID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	}
+	members, err := groupMembers(group.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	list := make([]groupMemberInfo, len(members))
+	for i, m := range members {
+		list[i] = groupMemberInfo{Username: m.User.Username, Role: m.Role, JoinedAt: m.JoinedAt}
+	}
+	return c.JSON(fiber.Map{"id": group.ID, "name": group.Name, "role": me.Role, "members": list})
+}
+
+// ---------------- Invite ----------------
+// Steps:
+//  1. Check the logged-in user is the owner or an admin
+//  2. Check they have an accepted connection with the invitee, so nobody
+//     can be added to a group by a stranger
+//  3. Add the invitee as a member and tell the group
+func inviteToGroup(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	me := groupMembership(c, userID)
+	if me == nil {
+		return nil
+	}
+	if me.Role == roleMember {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the owner and admins can invite"})
+	}
+	body := struct {
+		Username string `json:"username"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	var invitee db.User
+	if err := db.DB_Conn.Select("id", "username").Where("username = ?", body.Username).First(&invitee).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !isAcceptedConnection(userID, invitee.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only invite your accepted connections"})
+	}
+	var existing int64
+	db.DB_Conn.Model(&db.GroupMember{}).Where("group_id = ? AND user_id = ?", me.GroupID, invitee.ID).Count(&existing)
+	if existing > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User is already a member"})
+	}
+
+	if err := db.DB_Conn.Create(&db.GroupMember{GroupID: me.GroupID, UserID: invitee.ID, Role: roleMember}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	notifyGroup(me.GroupID, groupJoined, invitee.Username, invitee.ID)
+	return c.JSON(fiber.Map{"message": invitee.Username + " added to the group"})
+}
+
+// ---------------- Kick ----------------
+// Steps:
+//  1. Check the logged-in user is the owner or an admin
+//  2. Admins may only kick members; the owner may kick anyone else
+//  3. Remove the member and tell the group, and them
+func kickFromGroup(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	me := groupMembership(c, userID)
+	if me == nil {
+		return nil
+	}
+	if me.Role == roleMember {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the owner and admins can kick"})
+	}
+	body := struct {
+		Username string `json:"username"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	target, err := findGroupMember(me.GroupID, body.Username)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User is not a member"})
+	}
+	if target.UserID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Use leave to leave the group"})
+	}
+	if target.Role == roleOwner || (target.Role == roleAdmin && me.Role != roleOwner) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the owner can kick admins"})
+	}
+
+	if err := db.DB_Conn.Delete(target).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	notifyGroup(me.GroupID, groupKicked, target.User.Username, target.UserID)
+	return c.JSON(fiber.Map{"message": target.User.Username + " removed from the group"})
+}
+
+// ---------------- Leave ----------------
+// Steps:
+//  1. Remove the logged-in user from the group
+//  2. If they owned it, hand it to the longest-standing admin, or else
+//     member; a group nobody is left in is deleted
+//  3. Tell the group
+func leaveGroup(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	me := groupMembership(c, userID)
+	if me == nil {
+		return nil
+	}
+	err := db.DB_Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(me).Error; err != nil {
+			return err
+		}
+		if me.Role != roleOwner {
+			return nil
+		}
+		var heir db.GroupMember
+		err := tx.Where("group_id = ?", me.GroupID).
+			Order("CASE WHEN role = 'admin' THEN 0 ELSE 1 END, joined_at asc, id asc").
+			First(&heir).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Delete(&db.Group{}, me.GroupID).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&heir).Update("role", roleOwner).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var user db.User
+	if err := db.DB_Conn.Select("username").First(&user, userID).Error; err == nil {
+		notifyGroup(me.GroupID, groupLeft, user.Username, userID)
+	}
+	return c.JSON(fiber.Map{"message": "You left the group"})
+}
+
+// ---------------- Set role ----------------
+// Steps:
+//  1. Check the logged-in user is the owner
+//  2. Make another member an admin, or an admin a member again
+func setGroupRole(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	me := groupMembership(c, userID)
+	if me == nil {
+		return nil
+	}
+	if me.Role != roleOwner {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the owner can change roles"})
+	}
+	body := struct {
+		Username string `json:"username"`
+		Role     string `json:"role"` // "admin" or "member"
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if body.Role != roleAdmin && body.Role != roleMember {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role must be 'admin' or 'member'"})
+	}
+	target, err := findGroupMember(me.GroupID, body.Username)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User is not a member"})
+	}
+	if target.UserID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The owner's role can't be changed"})
+	}
+
+	if err := db.DB_Conn.Model(target).Update("role", body.Role).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	notifyGroup(me.GroupID, groupRole, target.User.Username, target.UserID)
+	return c.JSON(fiber.Map{"message": target.User.Username + " is now " + body.Role})
+}
@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Key transparency log. Every public key the server hands out is first
+// appended to a Merkle tree, and the server signs the tree's root. Clients
+// check that a key they fetch is in the tree and that each tree they see
+// extends the last one, so showing different keys to different people
+// means forking the log, which anyone comparing tree heads can detect.
+
+// Events recorded in the log
+const (
+	keyEventRegister     = "register"
+	keyEventRotate       = "rotate"
+	keyEventAddDevice    = "add-device"
+	keyEventRemoveDevice = "remove-device"
+	keyEventImport       = "import" // keys that existed before the log did
+)
+
+const (
+	// keyLogKeyFile holds the log signing key when KEYLOG_SIGNING_KEY is unset
+	keyLogKeyFile = "keylog.key"
+	// maxKeyLogEntries bounds one page of GET /keylog/entries
+	maxKeyLogEntries = 1000
+)
+
+// keyLog is the in-memory copy of the leaf hashes. The key_log_entries
+// table is the source of truth; writers hold mu across the database commit
+// and the append, so the two never disagree for a reader holding mu. head is
+// signed once per append rather than on every lookup.
+var keyLog struct {
+	mu     sync.RWMutex
+	leaves [][]byte
+	signer ed25519.PrivateKey
+	head   treeHead
+}
+
+// treeHead is a signed statement of the log's size and root hash
+type treeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	RootHash  []byte `json:"root_hash"`
+	Timestamp int64  `json:"timestamp"` // unix milliseconds
+	Signature []byte `json:"signature"` // Ed25519 over treeHeadStatement
+}
+
+// keyLogProof shows that a key is logged for its device. The server picks
+// the device's latest entry, but clients can't tell it did.
+type keyLogProof struct {
+	Entry     db.KeyLogEntry `json:"entry"`
+	AuditPath [][]byte       `json:"audit_path"`
+	Head      treeHead       `json:"head"`
+}
+
+// keyLogLeaf is the text hashed into the tree for an entry
+func keyLogLeaf(e db.KeyLogEntry) []byte {
+	return []byte(fmt.Sprintf("cli-chat key log entry\nusername: %s\ndevice: %d\nkey: %s\nevent: %s\nlogged-at: %d",
+		e.Username, e.DeviceID, e.KeyDigest, e.Event, e.LoggedAt))
+}
+
+// treeHeadStatement is the text the log key signs for a tree head
+func treeHeadStatement(size uint64, root []byte, timestamp int64) string {
+	return fmt.Sprintf("cli-chat key log tree head\nsize: %d\nroot: %s\ntimestamp: %d", size, hex.EncodeToString(root), timestamp)
+}
+
+// InitKeyLog loads the signing key and the log. On first start it imports
+// every existing account and device key, so they can be verified too.
+func InitKeyLog() error {
+	signer, err := loadKeyLogSigner()
+	if err != nil {
+		return fmt.Errorf("key log signing key: %w", err)
+	}
+
+	var entries []db.KeyLogEntry
+	if err := db.DB_Conn.Order("leaf_index asc").Find(&entries).Error; err != nil {
+		return err
+	}
+	leaves := make([][]byte, 0, len(entries))
+	for i, e := range entries {
+		if e.LeafIndex != uint64(i) {
+			return fmt.Errorf("key log is missing entry %d", i)
+		}
+		leaves = append(leaves, merkleLeafHash(keyLogLeaf(e)))
+	}
+
+	keyLog.mu.Lock()
+	keyLog.signer = signer
+	keyLog.leaves = leaves
+	keyLog.head = signTreeHead(leaves, signer)
+	keyLog.mu.Unlock()
+
+	if len(leaves) > 0 {
+		return nil
+	}
+	return withKeyLog(func(tx *gorm.DB, kl *keyLogWriter) error {
+		var users []db.User
+		if err := tx.Order("id asc").Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			devices, err := userDevices(user)
+			if err != nil {
+				return err
+			}
+			for _, device := range devices {
+				key, err := parsePublicKey(device.PublicKey)
+				if err != nil {
+					log.Printf("key log: not importing %s device %d: %v", user.Username, device.ID, err)
+					continue
+				}
+				if err := kl.add(user.Username, device.ID, key, keyEventImport); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// loadKeyLogSigner reads the Ed25519 seed from KEYLOG_SIGNING_KEY (base64),
+// or from keyLogKeyFile, creating it if needed. Losing this key means
+// clients can no longer verify the log, so back it up.
+func loadKeyLogSigner() (ed25519.PrivateKey, error) {
+	encoded := os.Getenv("KEYLOG_SIGNING_KEY")
+	if encoded == "" {
+		data, err := os.ReadFile(keyLogKeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			seed := make([]byte, ed25519.SeedSize)
+			if _, err := rand.Read(seed); err != nil {
+				return nil, err
+			}
+			encoded = base64.StdEncoding.EncodeToString(seed)
+			if err := os.WriteFile(keyLogKeyFile, []byte(encoded+"\n"), 0600); err != nil {
+				return nil, err
+			}
+			log.Printf("key log: created a new signing key in %s", keyLogKeyFile)
+		} else if err != nil {
+			return nil, err
+		} else {
+			encoded = string(data)
+		}
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("expected a base64 32-byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// keyLogWriter collects the entries logged inside one withKeyLog transaction
+type keyLogWriter struct {
+	tx     *gorm.DB
+	next   uint64
+	leaves [][]byte
+}
+
+// add logs key as the current key of a device
+func (w *keyLogWriter) add(username string, deviceID uint, key *accountKey, event string) error {
+	entry := db.KeyLogEntry{
+		LeafIndex: w.next,
+		Username:  username,
+		DeviceID:  deviceID,
+		KeyDigest: keyFingerprint(key.DER),
+		Event:     event,
+		LoggedAt:  time.Now().Unix(),
+	}
+	if err := w.tx.Create(&entry).Error; err != nil {
+		return err
+	}
+	w.next++
+	w.leaves = append(w.leaves, merkleLeafHash(keyLogLeaf(entry)))
+	return nil
+}
+
+// withKeyLog runs fn in a transaction and appends whatever it logged to the
+// tree once the transaction commits. Key changes are serialized by this.
+func withKeyLog(fn func(tx *gorm.DB, kl *keyLogWriter) error) error {
+	keyLog.mu.Lock()
+	defer keyLog.mu.Unlock()
+
+	kl := &keyLogWriter{next: uint64(len(keyLog.leaves))}
+	err := db.DB_Conn.Transaction(func(tx *gorm.DB) error {
+		kl.tx = tx
+		return fn(tx, kl)
+	})
+	if err != nil {
+		return err
+	}
+	if len(kl.leaves) > 0 {
+		keyLog.leaves = append(keyLog.leaves, kl.leaves...)
+		keyLog.head = signTreeHead(keyLog.leaves, keyLog.signer)
+	}
+	return nil
+}
+
+// signTreeHead signs a tree made of leaves
+func signTreeHead(leaves [][]byte, signer ed25519.PrivateKey) treeHead {
+	root := merkleRoot(leaves)
+	size := uint64(len(leaves))
+	now := time.Now().UnixMilli()
+	return treeHead{
+		TreeSize:  size,
+		RootHash:  root,
+		Timestamp: now,
+		Signature: ed25519.Sign(signer, []byte(treeHeadStatement(size, root, now))),
+	}
+}
+
+// keyLogProofFor proves the latest logged key of a device against the
+// current tree, or returns nil if the device has nothing in the log
+func keyLogProofFor(username string, deviceID uint) (*keyLogProof, error) {
+	keyLog.mu.RLock()
+	defer keyLog.mu.RUnlock()
+
+	var entry db.KeyLogEntry
+	err := db.DB_Conn.Where("username = ? AND device_id = ?", username, deviceID).Order("leaf_index desc").First(&entry).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.LeafIndex >= uint64(len(keyLog.leaves)) {
+		return nil, errors.New("key log entry is not in the tree")
+	}
+	return &keyLogProof{
+		Entry:     entry,
+		AuditPath: inclusionProof(int(entry.LeafIndex), keyLog.leaves),
+		Head:      keyLog.head,
+	}, nil
+}
+
+// parseTreeSize reads a tree size query parameter, defaulting to the current size
+func parseTreeSize(raw string, current int) (int, error) {
+	if raw == "" {
+		return current, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 || n > current {
+		return 0, fmt.Errorf("tree size must be between 0 and %d", current)
+	}
+	return n, nil
+}
+
+// ---------------- Tree Head ----------------
+// Returns the signed head of the key log
+func getTreeHead(c *fiber.Ctx) error {
+	keyLog.mu.RLock()
+	defer keyLog.mu.RUnlock()
+	return c.JSON(fiber.Map{"head": keyLog.head})
+}
+
+// ---------------- Log Public Key ----------------
+// Returns the Ed25519 key tree heads are signed with (base64). Clients pin
+// it the first time they see it.
+func getKeyLogPublicKey(c *fiber.Ctx) error {
+	pub := keyLog.signer.Public().(ed25519.PublicKey)
+	return c.JSON(fiber.Map{"public_key": base64.StdEncoding.EncodeToString(pub)})
+}
+
+// ---------------- Inclusion Proof ----------------
+// Returns the audit path for leaf `index` in the tree of size `tree_size`
+// (default: the current tree)
+func getInclusionProof(c *fiber.Ctx) error {
+	keyLog.mu.RLock()
+	defer keyLog.mu.RUnlock()
+
+	size, err := parseTreeSize(c.Query("tree_size"), len(keyLog.leaves))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	index, err := strconv.Atoi(c.Query("index"))
+	if err != nil || index < 0 || index >= size {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Index must be inside the tree"})
+	}
+	return c.JSON(fiber.Map{"index": index, "tree_size": size, "audit_path": inclusionProof(index, keyLog.leaves[:size])})
+}
+
+// ---------------- Consistency Proof ----------------
+// Proves the tree of size `first` is a prefix of the tree of size `second`
+// (default: the current tree)
+func getConsistencyProof(c *fiber.Ctx) error {
+	keyLog.mu.RLock()
+	defer keyLog.mu.RUnlock()
+
+	second, err := parseTreeSize(c.Query("second"), len(keyLog.leaves))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	first, err := parseTreeSize(c.Query("first"), second)
+	if err != nil || c.Query("first") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "first must be between 0 and second"})
+	}
+	return c.JSON(fiber.Map{"first": first, "second": second, "proof": consistencyProof(first, keyLog.leaves[:second])})
+}
+
+// ---------------- Log Entries ----------------
+// Returns up to `count` entries from `start`, so monitors can replay the
+// log and watch for keys they didn't register
+func getKeyLogEntries(c *fiber.Ctx) error {
+	start, err := strconv.Atoi(c.Query("start", "0"))
+	if err != nil || start < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid start"})
+	}
+	count, err := strconv.Atoi(c.Query("count", "100"))
+	if err != nil || count <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid count"})
+	}
+	if count > maxKeyLogEntries {
+		count = maxKeyLogEntries
+	}
+
+	keyLog.mu.RLock()
+	defer keyLog.mu.RUnlock()
+	entries := []db.KeyLogEntry{}
+	err = db.DB_Conn.Where("leaf_index >= ? AND leaf_index < ?", start, len(keyLog.leaves)).
+		Order("leaf_index asc").Limit(count).Find(&entries).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"entries": entries})
+}
+
+// ---------------- Register Routes ----------------
+// The log is public: anyone may audit it
+func HandleKeyLog(router fiber.Router) {
+	router.Get("/head", getTreeHead)
+	router.Get("/public-key", getKeyLogPublicKey)
+	router.Get("/inclusion", getInclusionProof)
+	router.Get("/consistency", getConsistencyProof)
+	router.Get("/entries", getKeyLogEntries)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotationWindow is how far a rotation statement's timestamp may be from now
+const rotationWindow = 10 * time.Minute
+
+// Key types a user or device key can have
+const (
+	keyTypeRSA   = "rsa"        // RSA, for both encryption and signatures
+	keyTypeCurve = "curve25519" // Ed25519 signing key followed by an X25519 encryption key
+)
+
+// accountKey is a parsed user or device public key
+type accountKey struct {
+	Type string
+	DER  []byte // every PEM block's DER bytes, concatenated; what fingerprints hash
+	rsa  *rsa.PublicKey
+	sign ed25519.PublicKey
+	dh   *ecdh.PublicKey
+}
+
+// parsePublicKey parses a public key as uploaded by clients: one PKIX RSA
+// block, or an Ed25519 block followed by an X25519 block
+func parsePublicKey(pubPEM string) (*accountKey, error) {
+	var blocks []*pem.Block
+	rest := []byte(pubPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("invalid public key PEM")
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("invalid public key PEM")
+	}
+
+	keys := make([]interface{}, len(blocks))
+	key := &accountKey{}
+	for i, block := range blocks {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		keys[i] = pub
+		key.DER = append(key.DER, block.Bytes...)
+	}
+
+	switch pub := keys[0].(type) {
+	case *rsa.PublicKey:
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("unexpected data after RSA public key")
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key must be at least 2048 bits")
+		}
+		key.Type, key.rsa = keyTypeRSA, pub
+	case ed25519.PublicKey:
+		if len(keys) != 2 {
+			return nil, fmt.Errorf("Ed25519 key must be followed by an X25519 key")
+		}
+		dh, ok := keys[1].(*ecdh.PublicKey)
+		if !ok || dh.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("Ed25519 key must be followed by an X25519 key")
+		}
+		key.Type, key.sign, key.dh = keyTypeCurve, pub, dh
+	default:
+		return nil, fmt.Errorf("unsupported public key type")
+	}
+	return key, nil
+}
+
+// keyFingerprint is the hex SHA-256 of a public key's DER bytes
+func keyFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyStatement checks a base64 signature over the SHA-256 of statement:
+// RSA-PSS for RSA keys, Ed25519 over the digest for curve keys
+func verifyStatement(pub *accountKey, statement, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(statement))
+	switch pub.Type {
+	case keyTypeRSA:
+		err = rsa.VerifyPSS(pub.rsa, crypto.SHA256, digest[:], sig, nil)
+	case keyTypeCurve:
+		if !ed25519.Verify(pub.sign, digest[:], sig) {
+			err = fmt.Errorf("bad signature")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// parseStatement reads the "key: value" lines of a signed statement
+func parseStatement(statement string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(statement, "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// checkRotationStatement ensures a rotation statement names this user, the
+// current key, the new key and a recent time. Clients build it as:
+//
+//	cli-chat key rotation
+//	username: <username>
+//	old-key: <hex sha256 of old key DER>
+//	new-key: <hex sha256 of new key DER>
+//	timestamp: <unix seconds>
+func checkRotationStatement(statement, username string, oldDER, newDER []byte) error {
+	if !strings.HasPrefix(statement, "cli-chat key rotation\n") {
+		return fmt.Errorf("not a key rotation statement")
+	}
+	fields := parseStatement(statement)
+	if fields["username"] != username {
+		return fmt.Errorf("statement is for a different user")
+	}
+	if fields["old-key"] != keyFingerprint(oldDER) {
+		return fmt.Errorf("statement does not name the current key")
+	}
+	if fields["new-key"] != keyFingerprint(newDER) {
+		return fmt.Errorf("statement does not name the new key")
+	}
+	ts, err := strconv.ParseInt(fields["timestamp"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("statement has no valid timestamp")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > rotationWindow || d < -rotationWindow {
+		return fmt.Errorf("statement timestamp is too far from server time")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import "crypto/sha256"
+
+// Merkle tree hashing as in RFC 6962: leaves and interior nodes get
+// different prefixes so a leaf can't be passed off as a node
+
+// merkleLeafHash hashes one log entry
+func merkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash hashes two children
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint is the largest power of two smaller than n (n > 1)
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot is MTH(D[n]) over already hashed leaves
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// inclusionProof is PATH(m, D[n]): the audit path for leaf m
+func inclusionProof(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(inclusionProof(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(inclusionProof(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// consistencyProof is PROOF(m, D[n]): shows the tree of the first m leaves
+// is a prefix of the tree of all of them
+func consistencyProof(m int, leaves [][]byte) [][]byte {
+	if m == 0 || m == len(leaves) {
+		return [][]byte{}
+	}
+	return subproof(m, leaves, true)
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+	k := splitPoint(len(leaves))
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), merkleRoot(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// update rewrites the proofs fixture the client verifies:
+//
+//	go test ./handlers -run TestProofsFixture -update
+var update = flag.Bool("update", false, "rewrite the Merkle proofs fixture")
+
+// proofsFixture is shared with the client's Merkle tests, which check that
+// its verifiers accept every proof this code produces
+const proofsFixture = "../../client/utils/testdata/merkle_proofs.json"
+
+// The RFC 6962 test tree: eight leaves and the root of every prefix, from
+// the Certificate Transparency reference implementation
+var rfcLeaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+
+var rfcRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func rfcLeafHashes(t *testing.T) [][]byte {
+	t.Helper()
+	leaves := make([][]byte, len(rfcLeaves))
+	for i, l := range rfcLeaves {
+		leaves[i] = merkleLeafHash(mustHex(t, l))
+	}
+	return leaves
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func hexPath(t *testing.T, hashes ...string) [][]byte {
+	t.Helper()
+	path := [][]byte{}
+	for _, h := range hashes {
+		path = append(path, mustHex(t, h))
+	}
+	return path
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := rfcLeafHashes(t)
+	for n := 1; n <= len(leaves); n++ {
+		if got := hex.EncodeToString(merkleRoot(leaves[:n])); got != rfcRoots[n-1] {
+			t.Errorf("root of %d leaves = %s, want %s", n, got, rfcRoots[n-1])
+		}
+	}
+	if got := hex.EncodeToString(merkleRoot(nil)); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("root of the empty tree = %s", got)
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	tests := []struct {
+		index, size int
+		path        []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	leaves := rfcLeafHashes(t)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.index, tt.size), func(t *testing.T) {
+			got := inclusionProof(tt.index, leaves[:tt.size])
+			if !equalPaths(got, hexPath(t, tt.path...)) {
+				t.Errorf("got %x", got)
+			}
+		})
+	}
+}
+
+func TestConsistencyProof(t *testing.T) {
+	tests := []struct {
+		first, second int
+		proof         []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{6, 8, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 5, []string{
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+	leaves := rfcLeafHashes(t)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d to %d", tt.first, tt.second), func(t *testing.T) {
+			got := consistencyProof(tt.first, leaves[:tt.second])
+			if !equalPaths(got, hexPath(t, tt.proof...)) {
+				t.Errorf("got %x", got)
+			}
+		})
+	}
+}
+
+// merkleProofs is the layout of the proofs fixture: the roots of a test
+// tree's prefixes, and proofs between every pair of sizes
+type merkleProofs struct {
+	Leaves      [][]byte             `json:"leaves"` // leaf hashes
+	Roots       [][]byte             `json:"roots"`  // Roots[n-1] is the root of the first n leaves
+	Inclusion   []fixtureInclusion   `json:"inclusion"`
+	Consistency []fixtureConsistency `json:"consistency"`
+}
+
+type fixtureInclusion struct {
+	Index uint64   `json:"index"`
+	Size  uint64   `json:"size"`
+	Path  [][]byte `json:"path"`
+}
+
+type fixtureConsistency struct {
+	First  uint64   `json:"first"`
+	Second uint64   `json:"second"`
+	Proof  [][]byte `json:"proof"`
+}
+
+// buildProofs makes every inclusion and consistency proof for trees of 1
+// to 13 leaves, which covers powers of two and sizes on either side of them
+func buildProofs() merkleProofs {
+	var p merkleProofs
+	for i := 0; i < 13; i++ {
+		p.Leaves = append(p.Leaves, merkleLeafHash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	for n := 1; n <= len(p.Leaves); n++ {
+		p.Roots = append(p.Roots, merkleRoot(p.Leaves[:n]))
+		for m := 0; m < n; m++ {
+			p.Inclusion = append(p.Inclusion, fixtureInclusion{uint64(m), uint64(n), inclusionProof(m, p.Leaves[:n])})
+		}
+		for m := 1; m <= n; m++ {
+			p.Consistency = append(p.Consistency, fixtureConsistency{uint64(m), uint64(n), consistencyProof(m, p.Leaves[:n])})
+		}
+	}
+	return p
+}
+
+// TestProofsFixture keeps the client's fixture in step with this code
+func TestProofsFixture(t *testing.T) {
+	want, err := json.MarshalIndent(buildProofs(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, '\n')
+	if *update {
+		if err := os.WriteFile(proofsFixture, want, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	got, err := os.ReadFile(proofsFixture)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date; run with -update", proofsFixture)
+	}
+}
+
+func equalPaths(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Page sizes for GET /messages
+const (
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+)
+
+// historyMessage is one message of a conversation as returned by GET
+// /messages. Content is the copy the caller can read: for messages they
+// received, the one encrypted to the calling device; for messages they
+// sent, the copy encrypted to the sending device's own key.
+type historyMessage struct {
+	ID             uint      `json:"id"`
+	Outgoing       bool      `json:"outgoing"`
+	SenderDeviceID uint      `json:"sender_device_id"`
+	Content        string    `json:"content"`
+	Signature      string    `json:"signature"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Maps message endpoints to handlers
+func HandleMessages(router fiber.Router) {
+	router.Get("/", getMessages)
+}
+
+// ---------------- History ----------------
+// Steps:
+//  1. Check the logged-in user has an accepted connection with `with`
+//  2. Select the direct messages between them older than `before`: those
+//     received on the calling device, and the first row of each message
+//     they sent (every receiver device's row carries the same sender copy)
+//  3. Return them newest first, with the cursor for the next page
+func getMessages(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	deviceID, err := requestDeviceID(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Unknown device"})
+	}
+	var other db.User
+	if err := db.DB_Conn.Select("id", "username").Where("username = ?", c.Query("with")).First(&other).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !isAcceptedConnection(userID, other.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Not connected"})
+	}
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultHistoryPage)))
+	if err != nil || limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid limit"})
+	}
+	if limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+
+	query := db.DB_Conn.Where("group_id = 0 AND ((sender_id = ? AND receiver_id = ? AND receiver_device_id = ?) OR (sender_id = ? AND receiver_id = ? AND id = batch_id))",
+		other.ID, userID, deviceID, userID, other.ID)
+	if raw := c.Query("before"); raw != "" {
+		before, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid before"})
+		}
+		query = query.Where("id < ?", before)
+	}
+	// One extra row tells whether there is another page
+	var rows []db.Message
+	if err := query.Order("id desc").Limit(limit + 1).Find(&rows).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var next *uint
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next = &rows[limit-1].ID
+	}
+	messages := make([]historyMessage, len(rows))
+	for i, m := range rows {
+		messages[i] = historyMessage{ID: m.ID, SenderDeviceID: m.SenderDeviceID, Content: m.Content, Signature: m.Signature, CreatedAt: m.CreatedAt}
+		if m.SenderID == userID {
+			messages[i].Outgoing = true
+			messages[i].Content, messages[i].Signature = m.SenderContent, m.SenderSignature
+		}
+	}
+	return c.JSON(fiber.Map{"messages": messages, "next_before": next})
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"encoding/base64"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxOneTimePrekeys caps how many unused one-time prekeys a user may store
+const maxOneTimePrekeys = 200
+
+// isX25519Key reports whether s is a base64 encoded 32-byte public key
+func isX25519Key(s string) bool {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(raw) == 32
+}
+
+// ---------------- Upload Prekeys ----------------
+// Stores the prekey bundle of the calling device (X-Device-ID) and appends any
+// one-time prekeys. Publishing a new identity key discards one-time prekeys
+// made for the old one.
+func uploadPrekeys(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	userID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+	deviceID, err := requestDeviceID(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Unknown device"})
+	}
+
+	body := struct {
+		IdentityKey    string `json:"identity_key"`
+		SignedPrekeyID uint32 `json:"signed_prekey_id"`
+		SignedPrekey   string `json:"signed_prekey"`
+		Signature      string `json:"signature"`
+		OneTimePrekeys []struct {
+			ID  uint32 `json:"id"`
+			Key string `json:"key"`
+		} `json:"one_time_prekeys"`
+	}{}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if !isX25519Key(body.IdentityKey) || !isX25519Key(body.SignedPrekey) || body.Signature == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Identity key, signed prekey and signature are required"})
+	}
+	for _, k := range body.OneTimePrekeys {
+		if k.ID == 0 || !isX25519Key(k.Key) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid one-time prekey"})
+		}
+	}
+
+	var remaining int64
+	err = db.DB_Conn.Transaction(func(tx *gorm.DB) error {
+		var bundle db.PrekeyBundle
+		err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).First(&bundle).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err == nil && bundle.IdentityKey != body.IdentityKey {
+			if err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&db.OneTimePrekey{}).Error; err != nil {
+				return err
+			}
+		}
+
+		bundle.UserID = userID
+		bundle.DeviceID = deviceID
+		bundle.IdentityKey = body.IdentityKey
+		bundle.SignedPrekeyID = body.SignedPrekeyID
+		bundle.SignedPrekey = body.SignedPrekey
+		bundle.Signature = body.Signature
+		if err := tx.Save(&bundle).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&db.OneTimePrekey{}).Where("user_id = ? AND device_id = ?", userID, deviceID).Count(&remaining).Error; err != nil {
+			return err
+		}
+		for _, k := range body.OneTimePrekeys {
+			if remaining >= maxOneTimePrekeys {
+				break
+			}
+			if err := tx.Create(&db.OneTimePrekey{UserID: userID, DeviceID: deviceID, KeyID: k.ID, PublicKey: k.Key}).Error; err != nil {
+				return err
+			}
+			remaining++
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store prekeys " + err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Prekeys uploaded", "one_time_prekeys": remaining})
+}
+
+// ---------------- Get Prekey Bundle ----------------
+// Returns the prekey bundle of one of a user's devices (device_id, default
+// the primary device). Fetching someone else's bundle requires an
+// accepted connection and consumes one of their one-time prekeys, if any are
+// left, unless one_time=false asks only for the signed part. Fetching your
+// own only reports how many remain.
+func getPrekeyBundle(c *fiber.Ctx) error {
+	claims := c.Locals("user")
+	if claims == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthorized"})
+	}
+	requesterID := uint(claims.(jwt.MapClaims)["user_id"].(float64))
+
+	username := c.Query("username")
+	if username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Please provide username"})
+	}
+	var user db.User
+	if err := db.DB_Conn.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	deviceID, err := parseDeviceID(c.Query("device_id"), user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+	self := user.ID == requesterID
+	if !self && !isAcceptedConnection(requesterID, user.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No accepted connection with this user"})
+	}
+
+	var bundle db.PrekeyBundle
+	if err := db.DB_Conn.Where("user_id = ? AND device_id = ?", user.ID, deviceID).First(&bundle).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device has not published prekeys"})
+	}
+
+	resp := fiber.Map{
+		"identity_key":     bundle.IdentityKey,
+		"signed_prekey_id": bundle.SignedPrekeyID,
+		"signed_prekey":    bundle.SignedPrekey,
+		"signature":        bundle.Signature,
+	}
+
+	if self {
+		var remaining int64
+		db.DB_Conn.Model(&db.OneTimePrekey{}).Where("user_id = ? AND device_id = ?", user.ID, deviceID).Count(&remaining)
+		resp["one_time_prekeys"] = remaining
+		return c.JSON(fiber.Map{"bundle": resp})
+	}
+	// Checking who started a session doesn't need a one-time prekey
+	if c.Query("one_time") == "false" {
+		return c.JSON(fiber.Map{"bundle": resp})
+	}
+
+	var otk db.OneTimePrekey
+	err = db.DB_Conn.Transaction(func(tx *gorm.DB) error {
+		// SKIP LOCKED keeps two concurrent fetches from receiving the same key
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("user_id = ? AND device_id = ?", user.ID, deviceID).Order("id asc").First(&otk).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&otk).Error
+	})
+	if err == nil {
+		resp["one_time_prekey"] = otk
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"bundle": resp})
+}
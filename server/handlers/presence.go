@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"chat-server/db"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// presence is what a contact may know about whether a user is around
+type presence struct {
+	Username   string     `json:"username"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at"` // when the last connection closed, null if never
+}
+
+// isOnline reports whether the user has a live WebSocket connection
+func isOnline(userID uint) bool {
+	_, ok := Clients.Load(userID)
+	return ok
+}
+
+// contactIDs returns the users with an accepted connection to userID
+func contactIDs(userID uint) ([]uint, error) {
+	var connections []db.Connection
+	if err := db.DB_Conn.
+		Where("(sender_id = ? OR receiver_id = ?) AND status = ?", userID, userID, "accepted").
+		Find(&connections).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(connections))
+	for _, conn := range connections {
+		if conn.SenderID == userID {
+			ids = append(ids, conn.ReceiverID)
+		} else {
+			ids = append(ids, conn.SenderID)
+		}
+	}
+	return ids, nil
+}
+
+// presenceLocks holds a mutex per user (userID -> *sync.Mutex). Presence
+// is broadcast after clientsMu is released, so a quick reconnect could
+// otherwise send "online" and then a stale "offline". Under the lock each
+// broadcast re-checks the user's state, so the last one sent is current.
+var presenceLocks sync.Map
+
+func presenceLock(userID uint) *sync.Mutex {
+	mu, _ := presenceLocks.LoadOrStore(userID, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// userOnline tells the user's contacts that they came online, unless they
+// already went offline again
+func userOnline(userID uint) {
+	mu := presenceLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+	if !isOnline(userID) {
+		return
+	}
+	var user db.User
+	if err := db.DB_Conn.Select("id", "username", "last_seen_at").First(&user, userID).Error; err != nil {
+		log.Println("Failed to load user for presence:", err)
+		return
+	}
+	broadcastPresence(userID, presence{Username: user.Username, Online: true, LastSeenAt: user.LastSeenAt})
+}
+
+// userOffline stores when the user's last connection closed and tells their
+// contacts, unless they already came back
+func userOffline(userID uint) {
+	mu := presenceLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+	if isOnline(userID) {
+		return
+	}
+	now := time.Now()
+	if err := db.DB_Conn.Model(&db.User{}).Where("id = ?", userID).Update("last_seen_at", now).Error; err != nil {
+		log.Println("Failed to store last seen:", err)
+	}
+	var user db.User
+	if err := db.DB_Conn.Select("id", "username").First(&user, userID).Error; err != nil {
+		log.Println("Failed to load user for presence:", err)
+		return
+	}
+	broadcastPresence(userID, presence{Username: user.Username, Online: false, LastSeenAt: &now})
+}
+
+// broadcastPresence sends a presence frame to every live connection of the
+// user's accepted contacts
+func broadcastPresence(userID uint, p presence) {
+	contacts, err := contactIDs(userID)
+	if err != nil {
+		log.Println("Failed to load contacts for presence:", err)
+		return
+	}
+	for _, id := range contacts {
+		sendEvent(id, map[string]interface{}{
+			"type":         framePresence,
+			"username":     p.Username,
+			"online":       p.Online,
+			"last_seen_at": p.LastSeenAt,
+		})
+	}
+}
+
+// ---------------- Presence ----------------
+// Steps:
+//  1. Load the logged-in user's accepted connections
+//  2. Return each contact's username, whether they are online and when they
+//     were last seen
+func getPresence(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	ids, err := contactIDs(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	var users []db.User
+	if len(ids) > 0 {
+		if err := db.DB_Conn.Select("id", "username", "last_seen_at").Where("id IN ?", ids).
+			Order("username asc").Find(&users).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	resp := make([]presence, len(users))
+	for i, u := range users {
+		resp[i] = presence{Username: u.Username, Online: isOnline(u.ID), LastSeenAt: u.LastSeenAt}
+	}
+	return c.JSON(resp)
+}
@@ -135,90 +135,215 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
     "github.com/golang-jwt/jwt/v5"
 )
 
-// Clients stores userID -> []*websocket.Conn
+// Clients stores userID -> []*ClientConn
 var Clients sync.Map
 
+// clientsMu serializes adding and removing connections, so exactly one of a
+// user's connections sees them come online and one sees them go offline
+var clientsMu sync.Mutex
+
+// addClient registers a connection and reports whether it is the user's first
+func addClient(userID uint, client *ClientConn) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	conns, _ := Clients.LoadOrStore(userID, []*ClientConn{})
+	connSlice := conns.([]*ClientConn)
+	Clients.Store(userID, append(connSlice, client))
+	return len(connSlice) == 0
+}
+
+// removeClient forgets a connection and reports whether it was the user's last
+func removeClient(userID uint, client *ClientConn) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	conns, ok := Clients.Load(userID)
+	if !ok {
+		return false
+	}
+	newSlice := []*ClientConn{}
+	for _, c := range conns.([]*ClientConn) {
+		if c != client {
+			newSlice = append(newSlice, c)
+		}
+	}
+	if len(newSlice) == 0 {
+		Clients.Delete(userID)
+		return true
+	}
+	Clients.Store(userID, newSlice)
+	return false
+}
+
+// ClientConn is one device's live WebSocket connection
+type ClientConn struct {
+	Conn     *websocket.Conn
+	DeviceID uint
+	Receipts bool       // the client acknowledges messages; see handleReceipt
+	mu       sync.Mutex // websocket connections allow one writer at a time
+
+	pendingMu sync.Mutex
+	pending   map[uint]bool // written to this connection, not yet acknowledged
+}
+
+// markPending records that message id is being written to the connection,
+// and reports false if it already was and the client hasn't acked it yet
+func (c *ClientConn) markPending(id uint) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending[id] {
+		return false
+	}
+	if c.pending == nil {
+		c.pending = map[uint]bool{}
+	}
+	c.pending[id] = true
+	return true
+}
+
+// acked forgets pending messages once the client acknowledged them
+func (c *ClientConn) acked(ids []uint) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for _, id := range ids {
+		delete(c.pending, id)
+	}
+}
+
+// Send writes payload to the connection as JSON
+func (c *ClientConn) Send(payload interface{}) error {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(websocket.TextMessage, out)
+}
+
+// Frame types. Clients send messages (the type may be omitted) and receipts;
+// the server sends messages, "sent" confirmations, errors and receipts, plus
+// typing, presence and group membership notices.
+const (
+	frameMessage     = "message"
+	frameSent        = "sent"
+	frameError       = "error"
+	frameReceipt     = "receipt"
+	frameTypingStart = "typing_start"
+	frameTypingStop  = "typing_stop"
+	framePresence    = "presence"
+	frameGroup       = "group"
+)
+
+// Receipt statuses, sent by clients as frame types
+const (
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+)
+
 // IncomingMessage represents a message sent by a client
 type IncomingMessage struct {
-	ReceiverUsername string `json:"receiver_username"` // Receiver username
-	Content          string `json:"content"`           // Encrypted message
+	Type             string        `json:"type"`
+	Ref              string        `json:"ref"`               // Client's reference, echoed in the sent or error reply
+	ReceiverUsername string        `json:"receiver_username"` // Receiver username
+	GroupID          uint          `json:"group_id"`          // Group the message is for, instead of a receiver
+	Content          string        `json:"content"`           // Encrypted message (clients without device support)
+	Signature        string        `json:"signature"`         // Sender's signature over the encrypted message
+	Copies           []MessageCopy `json:"copies"`            // One encrypted copy per receiver device
+	SenderContent    string        `json:"sender_content"`    // Encrypted to the sender's own key, for their history
+	SenderSignature  string        `json:"sender_signature"`  // Sender's signature over sender_content
+}
+
+// IncomingReceipt acknowledges messages the client received ("delivered")
+// or showed to the user ("read")
+type IncomingReceipt struct {
+	Type string `json:"type"`
+	IDs  []uint `json:"ids"`
+}
+
+// IncomingTyping tells a contact that the user started or stopped typing to
+// them. It is relayed as is and never stored.
+type IncomingTyping struct {
+	Type             string `json:"type"`
+	ReceiverUsername string `json:"receiver_username"`
+}
+
+// MessageCopy is a message encrypted to one of the receiver's devices
+type MessageCopy struct {
+	Username  string `json:"username"` // group messages: the member the copy is for
+	DeviceID  uint   `json:"device_id"`
+	Content   string `json:"content"`
+	Signature string `json:"signature"`
+}
+
+// messagePayload builds the JSON payload relayed to a receiver for msg
+func messagePayload(senderUsername string, msg db.Message) map[string]interface{} {
+	payload := map[string]interface{}{
+		"type":             frameMessage,
+		"id":               msg.ID,
+		"sender_username":  senderUsername,
+		"sender_device_id": msg.SenderDeviceID,
+		"content":          msg.Content,
+		"signature":        msg.Signature,
+	}
+	if msg.GroupID != 0 {
+		payload["group_id"] = msg.GroupID
+	}
+	return payload
 }
 
 // HandleWebSocketServer sets up the WebSocket endpoint
 func HandleWebSocketServer(router fiber.Router) {
 	router.Use(func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
 		}
-		return fiber.ErrUpgradeRequired
+		// The device decides which copy of each message this connection gets
+		claims := c.Locals("user").(jwt.MapClaims)
+		deviceID, err := requestDeviceID(c, uint(claims["user_id"].(float64)))
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Unknown device"})
+		}
+		c.Locals("device_id", deviceID)
+		c.Locals("receipts", c.Get("X-Receipts") == "1")
+		return c.Next()
 	})
 
 	router.Get("/", websocket.New(func(conn *websocket.Conn) {
 		// --- 1. Identify user from Locals (JWT claims must be stored here) ---
         claims := conn.Locals("user").(jwt.MapClaims)
         senderID := uint(claims["user_id"].(float64))
+		client := &ClientConn{Conn: conn, DeviceID: conn.Locals("device_id").(uint), Receipts: conn.Locals("receipts").(bool)}
 
 		// --- 2. Add connection to Clients map ---
-		conns, _ := Clients.LoadOrStore(senderID, []*websocket.Conn{})
-		connSlice := conns.([]*websocket.Conn)
-		connSlice = append(connSlice, conn)
-		Clients.Store(senderID, connSlice)
+		// Contacts hear when the first connection opens and the last closes
+		if addClient(senderID, client) {
+			userOnline(senderID)
+		}
 
 		defer func() {
 			// Remove connection on disconnect
-			conns, ok := Clients.Load(senderID)
-			if ok {
-				connSlice := conns.([]*websocket.Conn)
-				newSlice := []*websocket.Conn{}
-				for _, c := range connSlice {
-					if c != conn {
-						newSlice = append(newSlice, c)
-					}
-				}
-				if len(newSlice) == 0 {
-					Clients.Delete(senderID)
-				} else {
-					Clients.Store(senderID, newSlice)
-				}
+			if removeClient(senderID, client) {
+				userOffline(senderID)
 			}
 			conn.Close()
-			log.Printf("User %d disconnected\n", senderID)
+			log.Printf("User %d (device %d) disconnected\n", senderID, client.DeviceID)
 		}()
 
-		log.Printf("User %d connected via WebSocket\n", senderID)
+		log.Printf("User %d (device %d) connected via WebSocket\n", senderID, client.DeviceID)
 
-		// On connect: deliver any undelivered messages to this user
+		// On connect: deliver any undelivered messages to this device
 		{
 			var backlog []db.Message
-			db.DB_Conn.Where("receiver_id = ? AND delivered = ?", senderID, false).
-				Order("created_at asc").Find(&backlog)
-
-			if len(backlog) > 0 {
-				if conns, ok := Clients.Load(senderID); ok {
-					for _, c := range conns.([]*websocket.Conn) {
-						for _, msg := range backlog {
-							var fromUser db.User
-							if err := db.DB_Conn.Select("username").First(&fromUser, msg.SenderID).Error; err != nil {
-								log.Println("Failed to load sender username for backlog message:", msg.ID)
-								continue
-							}
-							payload := map[string]interface{}{
-								"sender_username": fromUser.Username,
-								"content":          msg.Content,
-							}
-							out, _ := json.Marshal(payload)
-							c.WriteMessage(websocket.TextMessage, out)
-							db.DB_Conn.Model(&msg).Update("delivered", true)
-						}
-					}
-				}
-			}
+			db.DB_Conn.Where("receiver_id = ? AND receiver_device_id = ? AND delivered = ?", senderID, client.DeviceID, false).
+				Order("id asc").Find(&backlog)
+			deliver(senderID, backlog)
 		}
 
 		for {
@@ -228,30 +353,71 @@ func HandleWebSocketServer(router fiber.Router) {
 				break
 			}
 
-			go handleIncomingMessage(senderID, msg)
+			// One frame at a time, so messages are stored and relayed in
+			// the order the client sent them, and typing_stop can't
+			// overtake typing_start
+			handleFrame(senderID, client, msg)
 		}
 	}))
 }
 
+// handleFrame dispatches a frame read from a client connection
+func handleFrame(userID uint, client *ClientConn, raw []byte) {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		log.Println("invalid message format:", err)
+		return
+	}
+	switch frame.Type {
+	case "", frameMessage:
+		handleIncomingMessage(userID, client, raw)
+	case receiptDelivered, receiptRead:
+		var receipt IncomingReceipt
+		if err := json.Unmarshal(raw, &receipt); err != nil {
+			log.Println("invalid receipt format:", err)
+			return
+		}
+		handleReceipt(userID, client, receipt)
+	case frameTypingStart, frameTypingStop:
+		var typing IncomingTyping
+		if err := json.Unmarshal(raw, &typing); err != nil {
+			log.Println("invalid typing format:", err)
+			return
+		}
+		handleTyping(userID, client, typing)
+	default:
+		log.Printf("Unknown frame type %q from user %d\n", frame.Type, userID)
+	}
+}
+
 // handleIncomingMessage validates connection and delivers messages
-func handleIncomingMessage(senderID uint, raw []byte) {
+func handleIncomingMessage(senderID uint, client *ClientConn, raw []byte) {
+	senderDeviceID := client.DeviceID
 	var incoming IncomingMessage
 	if err := json.Unmarshal(raw, &incoming); err != nil {
 		log.Println("invalid message format:", err)
 		return
 	}
+	// Tell the sender why a message went nowhere
+	reject := func(reason string) {
+		client.Send(map[string]interface{}{"type": frameError, "ref": incoming.Ref, "error": reason})
+	}
+	if incoming.GroupID != 0 {
+		handleGroupMessage(senderID, client, incoming, reject)
+		return
+	}
+	// Clients without device support send one ciphertext for the primary device
+	if len(incoming.Copies) == 0 {
+		incoming.Copies = []MessageCopy{{DeviceID: primaryDevice, Content: incoming.Content, Signature: incoming.Signature}}
+	}
 
 	// --- 1. Fetch receiver from DB ---
 	var receiver db.User
 	if err := db.DB_Conn.Where("username = ?", incoming.ReceiverUsername).First(&receiver).Error; err != nil {
 		log.Println("Receiver not found:", incoming.ReceiverUsername)
-		return
-	}
-
-	// Also fetch sender username (for payloads to receiver)
-	var senderUser db.User
-	if err := db.DB_Conn.First(&senderUser, senderID).Error; err != nil {
-		log.Println("Sender not found:", senderID)
+		reject("receiver not found")
 		return
 	}
 
@@ -262,61 +428,345 @@ func handleIncomingMessage(senderID uint, raw []byte) {
 		senderID, receiver.ID, receiver.ID, senderID,
 	).First(&conn).Error; err != nil {
 		log.Printf("No connection between %d and %d\n", senderID, receiver.ID)
+		reject("not connected")
 		return
 	}
 
 	if conn.Status != "accepted" {
 		log.Printf("Connection not accepted between %d and %d\n", senderID, receiver.ID)
+		reject("connection not accepted")
 		return
 	}
 
-	// --- 3. Save message in DB ---
-	message := db.Message{
-		SenderID:   senderID,
-		ReceiverID: receiver.ID,
-		Content:    incoming.Content,
-		Delivered:  false,
+	// --- 3. Save one message per receiver device ---
+	devices, err := userDevices(receiver)
+	if err != nil {
+		log.Println("Failed to load receiver devices:", err)
+		reject("server error")
+		return
+	}
+	known := map[uint]bool{}
+	for _, d := range devices {
+		known[d.ID] = true
 	}
-	db.DB_Conn.Create(&message)
+	var messages []db.Message
+	for _, cp := range incoming.Copies {
+		if !known[cp.DeviceID] {
+			log.Printf("Dropping copy for unknown device %d of user %d\n", cp.DeviceID, receiver.ID)
+			continue
+		}
+		known[cp.DeviceID] = false // one copy per device
+		message := db.Message{
+			SenderID:         senderID,
+			ReceiverID:       receiver.ID,
+			Content:          cp.Content,
+			Signature:        cp.Signature,
+			SenderDeviceID:   senderDeviceID,
+			ReceiverDeviceID: cp.DeviceID,
+			SenderContent:    incoming.SenderContent,
+			SenderSignature:  incoming.SenderSignature,
+			Delivered:        false,
+		}
+		if err := db.DB_Conn.Create(&message).Error; err != nil {
+			log.Println("Failed to store message:", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		reject("no copy for any of the receiver's devices")
+		return
+	}
+
+	// Confirm to the sending connection which IDs the copies were stored
+	// under, so it can match the receipts that follow
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	markBatch(ids)
+	client.Send(map[string]interface{}{"type": frameSent, "ref": incoming.Ref, "ids": ids, "batch_id": ids[0]})
 
 	// --- 4. Deliver undelivered messages to sender (if any) ---
 	var undelivered []db.Message
 	db.DB_Conn.Where("sender_id = ? AND receiver_id = ? AND delivered = ?", receiver.ID, senderID, false).
-		Order("created_at asc").Find(&undelivered)
-
-	if conns, ok := Clients.Load(senderID); ok {
-		for _, c := range conns.([]*websocket.Conn) {
-			for _, msg := range undelivered {
-				// Lookup sender username for each undelivered message
-				var fromUser db.User
-				if err := db.DB_Conn.Select("username").First(&fromUser, msg.SenderID).Error; err != nil {
-					log.Println("Failed to load sender username for message:", msg.ID)
-					continue
-				}
-				payload := map[string]interface{}{
-					"sender_username": fromUser.Username,
-					"content":          msg.Content,
-				}
-				out, _ := json.Marshal(payload)
-				c.WriteMessage(websocket.TextMessage, out)
-				db.DB_Conn.Model(&msg).Update("delivered", true)
-			}
+		Order("id asc").Find(&undelivered)
+	deliver(senderID, undelivered)
+
+	// --- 5. Deliver message to receiver if online ---
+	deliver(receiver.ID, messages)
+}
+
+// handleGroupMessage stores a group message once per member device it was
+// encrypted to and delivers it to the members who are online. Copies for
+// users who aren't members, or for devices they don't have, are dropped.
+func handleGroupMessage(senderID uint, client *ClientConn, incoming IncomingMessage, reject func(string)) {
+	// --- 1. Check the sender is a member ---
+	var membership db.GroupMember
+	if err := db.DB_Conn.Where("group_id = ? AND user_id = ?", incoming.GroupID, senderID).First(&membership).Error; err != nil {
+		reject("not a member of this group")
+		return
+	}
+	members, err := groupMembers(incoming.GroupID)
+	if err != nil {
+		log.Println("Failed to load group members:", err)
+		reject("server error")
+		return
+	}
+
+	// --- 2. Collect the devices of every other member ---
+	type memberDevice struct {
+		username string
+		deviceID uint
+	}
+	receivers := map[string]uint{}
+	known := map[memberDevice]bool{}
+	for _, m := range members {
+		if m.UserID == senderID {
+			continue
+		}
+		devices, err := userDevices(m.User)
+		if err != nil {
+			log.Println("Failed to load member devices:", err)
+			continue
+		}
+		receivers[m.User.Username] = m.UserID
+		for _, d := range devices {
+			known[memberDevice{m.User.Username, d.ID}] = true
 		}
 	}
 
-	// --- 5. Deliver message to receiver if online ---
-	if conns, ok := Clients.Load(receiver.ID); ok {
-		for _, c := range conns.([]*websocket.Conn) {
-			payload := map[string]interface{}{
-				"sender_username": senderUser.Username,
-				"content":          message.Content,
+	// --- 3. Save one message per member device ---
+	byReceiver := map[uint][]db.Message{}
+	var ids []uint
+	for _, cp := range incoming.Copies {
+		key := memberDevice{cp.Username, cp.DeviceID}
+		if !known[key] {
+			log.Printf("Dropping group copy for %q device %d in group %d\n", cp.Username, cp.DeviceID, incoming.GroupID)
+			continue
+		}
+		known[key] = false // one copy per device
+		message := db.Message{
+			SenderID:         senderID,
+			ReceiverID:       receivers[cp.Username],
+			GroupID:          incoming.GroupID,
+			Content:          cp.Content,
+			Signature:        cp.Signature,
+			SenderDeviceID:   client.DeviceID,
+			ReceiverDeviceID: cp.DeviceID,
+			SenderContent:    incoming.SenderContent,
+			SenderSignature:  incoming.SenderSignature,
+			Delivered:        false,
+		}
+		if err := db.DB_Conn.Create(&message).Error; err != nil {
+			log.Println("Failed to store message:", err)
+			continue
+		}
+		byReceiver[message.ReceiverID] = append(byReceiver[message.ReceiverID], message)
+		ids = append(ids, message.ID)
+	}
+	if len(ids) == 0 {
+		reject("no copy for any member's devices")
+		return
+	}
+	markBatch(ids)
+	client.Send(map[string]interface{}{"type": frameSent, "ref": incoming.Ref, "ids": ids, "batch_id": ids[0]})
+
+	// --- 4. Deliver to the members who are online ---
+	for receiverID, msgs := range byReceiver {
+		deliver(receiverID, msgs)
+	}
+}
+
+// markBatch records that the rows stored for one send belong together, under
+// the first row's ID, so history can list the send once
+func markBatch(ids []uint) {
+	if err := db.DB_Conn.Model(&db.Message{}).Where("id IN ?", ids).Update("batch_id", ids[0]).Error; err != nil {
+		log.Println("Failed to mark message batch:", err)
+	}
+}
+
+// deliver writes each message to the receiver's connections for the device
+// it was encrypted to, and marks it delivered once written
+func deliver(userID uint, msgs []db.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	conns, ok := Clients.Load(userID)
+	if !ok {
+		return
+	}
+
+	usernames := map[uint]string{}
+	for _, msg := range msgs {
+		// Lookup sender username for each message
+		name, ok := usernames[msg.SenderID]
+		if !ok {
+			var fromUser db.User
+			if err := db.DB_Conn.Select("username").First(&fromUser, msg.SenderID).Error; err != nil {
+				log.Println("Failed to load sender username for message:", msg.ID)
+				continue
 			}
-			out, _ := json.Marshal(payload)
-			if err := c.WriteMessage(websocket.TextMessage, out); err != nil {
+			name = fromUser.Username
+			usernames[msg.SenderID] = name
+		}
+
+		for _, c := range conns.([]*ClientConn) {
+			if c.DeviceID != msg.ReceiverDeviceID {
+				continue
+			}
+			// Clients that send receipts get each message once per
+			// connection, until they ack it
+			if c.Receipts && !c.markPending(msg.ID) {
+				continue
+			}
+			if err := c.Send(messagePayload(name, msg)); err != nil {
 				log.Println("send error:", err)
 				continue
 			}
-			db.DB_Conn.Model(&message).Update("delivered", true)
+			// Older clients never ack, so a successful write has to count
+			if !c.Receipts {
+				markReceived(userID, []db.Message{msg}, receiptDelivered)
+			}
+		}
+	}
+}
+
+// handleTyping relays a typing event to the receiver's live connections,
+// if the two users have an accepted connection
+func handleTyping(senderID uint, client *ClientConn, typing IncomingTyping) {
+	var sender, receiver db.User
+	if err := db.DB_Conn.Select("id", "username").Where("username = ?", typing.ReceiverUsername).First(&receiver).Error; err != nil {
+		return
+	}
+	if !isAcceptedConnection(senderID, receiver.ID) {
+		return
+	}
+	if !isOnline(receiver.ID) {
+		return
+	}
+	if err := db.DB_Conn.Select("username").First(&sender, senderID).Error; err != nil {
+		return
+	}
+	sendEvent(receiver.ID, map[string]interface{}{
+		"type":             typing.Type,
+		"sender_username":  sender.Username,
+		"sender_device_id": client.DeviceID,
+	})
+}
+
+// sendEvent sends an event frame to every live connection of a user
+func sendEvent(userID uint, frame map[string]interface{}) {
+	conns, ok := Clients.Load(userID)
+	if !ok {
+		return
+	}
+	for _, c := range conns.([]*ClientConn) {
+		// Clients from before typed frames would take it for a message
+		if !c.Receipts {
+			continue
+		}
+		c.Send(frame)
+	}
+}
+
+// handleReceipt records a client's acks for messages sent to its device.
+// Acks for other messages are ignored.
+func handleReceipt(userID uint, client *ClientConn, receipt IncomingReceipt) {
+	if len(receipt.IDs) == 0 {
+		return
+	}
+	client.acked(receipt.IDs)
+
+	var msgs []db.Message
+	if err := db.DB_Conn.Where("id IN ? AND receiver_id = ? AND receiver_device_id = ?", receipt.IDs, userID, client.DeviceID).
+		Find(&msgs).Error; err != nil {
+		log.Println("Failed to load acknowledged messages:", err)
+		return
+	}
+	markReceived(userID, msgs, receipt.Type)
+}
+
+// markReceived stores that msgs were delivered to, or read by, userID and
+// relays a receipt to the devices that sent them. A read message counts as
+// delivered too. Messages already marked are not relayed again.
+func markReceived(userID uint, msgs []db.Message, status string) {
+	now := time.Now()
+	bySender := map[uint][]db.Message{}
+	for _, msg := range msgs {
+		changed := false
+		if msg.DeliveredAt == nil {
+			msg.DeliveredAt = &now
+			changed = true
+		}
+		if status == receiptRead && msg.ReadAt == nil {
+			msg.ReadAt = &now
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if err := db.DB_Conn.Model(&msg).Updates(map[string]interface{}{
+			"delivered":    true,
+			"delivered_at": msg.DeliveredAt,
+			"read_at":      msg.ReadAt,
+		}).Error; err != nil {
+			log.Println("Failed to store receipt:", err)
+			continue
+		}
+		bySender[msg.SenderID] = append(bySender[msg.SenderID], msg)
+	}
+	if len(bySender) == 0 {
+		return
+	}
+
+	var receiver db.User
+	if err := db.DB_Conn.Select("username").First(&receiver, userID).Error; err != nil {
+		log.Println("Failed to load receiver username:", err)
+		return
+	}
+	for senderID, sent := range bySender {
+		relayReceipt(senderID, receiver.Username, status, sent, now)
+	}
+}
+
+// relayReceipt tells the sender's devices that their messages were
+// delivered or read. Each device only hears about the messages it sent.
+func relayReceipt(senderID uint, receiverUsername, status string, msgs []db.Message, at time.Time) {
+	conns, ok := Clients.Load(senderID)
+	if !ok {
+		return
+	}
+	byDevice := map[uint][]uint{}
+	for _, msg := range msgs {
+		byDevice[msg.SenderDeviceID] = append(byDevice[msg.SenderDeviceID], msg.ID)
+	}
+	for _, c := range conns.([]*ClientConn) {
+		ids, ok := byDevice[c.DeviceID]
+		if !ok {
+			continue
+		}
+		if err := c.Send(map[string]interface{}{
+			"type":              frameReceipt,
+			"status":            status,
+			"receiver_username": receiverUsername,
+			"ids":               ids,
+			"at":                at.UnixMilli(),
+		}); err != nil {
+			log.Println("send error:", err)
+		}
+	}
+}
+
+// disconnectDevice closes any live connection of a removed device
+func disconnectDevice(userID, deviceID uint) {
+	conns, ok := Clients.Load(userID)
+	if !ok {
+		return
+	}
+	for _, c := range conns.([]*ClientConn) {
+		if c.DeviceID == deviceID {
+			c.Conn.Close()
 		}
 	}
 }
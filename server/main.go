@@ -21,6 +21,9 @@ func main() {
 	if err != nil {
 		log.Fatal("Error in loading env: ", err)
 	}
+	if err := handlers.InitKeyLog(); err != nil {
+		log.Fatal("Error in loading the key log: ", err)
+	}
 	app := fiber.New()
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"message": "Hello world"})
@@ -28,10 +31,21 @@ func main() {
 	AuthRoutes := app.Group("/auth")
 	handlers.HandleAuth(AuthRoutes)
 
+	KeyLogRoutes := app.Group("/keylog") // public, so anyone can audit it
+	handlers.HandleKeyLog(KeyLogRoutes)
+
 	ConnectionRoutes := app.Group("/connections")
 	ConnectionRoutes.Use(middleware.JWTMiddleware()) // to validate the jwt sent by user
 	handlers.HandleConnections(ConnectionRoutes)
 
+	GroupRoutes := app.Group("/groups")
+	GroupRoutes.Use(middleware.JWTMiddleware())
+	handlers.HandleGroups(GroupRoutes)
+
+	MessageRoutes := app.Group("/messages")
+	MessageRoutes.Use(middleware.JWTMiddleware())
+	handlers.HandleMessages(MessageRoutes)
+
 	WebSocketRoutes := app.Group("/chat")
 	WebSocketRoutes.Use(middleware.JWTMiddleware())      // Using consistent middleware from middleware package
 	WebSocketRoutes.Use(middleware.ValidateConnection()) // validates whether both users are connected or not